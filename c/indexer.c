@@ -90,6 +90,7 @@ static struct gzip_index *addpoint(struct gzip_index *index, int bits,
     /* fill in entry and increment how many we have */
     next = index->list + index->have;
     next->bits = bits;
+    next->windowless = 0;
     next->in = in;
     next->out = out;
     if (left)
@@ -104,8 +105,60 @@ static struct gzip_index *addpoint(struct gzip_index *index, int bits,
 
 
 
-/* Pretty much the same as from zran.c */
-int generate_index_fp(FILE* in, off_t span, struct gzip_index** idx)
+/* Describes where access points are placed after the first one */
+struct placement
+{
+    off_t span;                 /* (target) distance between access points */
+    off_t tolerance;            /* allowed deviation from span if ranges is set */
+    struct file_ranges* ranges; /* if set, avoid splitting these files */
+    off_t* flushes;             /* if set, the only offsets to place points at */
+    int flush_count;
+    int cur;                    /* first file/flush point not behind totout */
+};
+
+/* Returns non-zero if an access point at uncompressed offset out would split
+   one of the files in ranges, i.e. if out is in (start, end] of a file. Offsets
+   are only ever increasing while building an index, so p->cur remembers the
+   first file that can still contain out. */
+static int splits_file(struct placement* p, off_t out)
+{
+    struct file_ranges* ranges = p->ranges;
+    while (p->cur < ranges->count && ranges->end[p->cur] < out)
+        p->cur++;
+    return p->cur < ranges->count && ranges->start[p->cur] < out;
+}
+
+/* Returns non-zero if an access point should be added at the block boundary
+   at uncompressed offset totout, given that the last one is at offset last.
+   - by default, there is an access point every span bytes (as in zran.c)
+   - with file ranges, an access point is only added once span - tolerance
+     bytes were uncompressed since the last one, and only where it doesn't split
+     a file, unless span + tolerance bytes were uncompressed already
+   - with flush points, there is an access point at the first block boundary at
+     each flush point */
+static int want_point(struct placement* p, off_t totout, off_t last)
+{
+    if (p->flushes != NULL) {
+        while (p->cur < p->flush_count && p->flushes[p->cur] < totout)
+            p->cur++;
+        if (p->cur < p->flush_count && p->flushes[p->cur] == totout) {
+            p->cur++;
+            return 1;
+        }
+        return 0;
+    }
+    if (p->ranges != NULL) {
+        if (totout - last > p->span + p->tolerance)
+            return 1;
+        return totout - last > p->span - p->tolerance && !splits_file(p, totout);
+    }
+    return totout - last > p->span;
+}
+
+/* Pretty much the same as from zran.c, with access points placed according to
+   p. Past full flush points, the compressed data doesn't refer to anything
+   before, so the windows of access points at flush points are left empty. */
+static int generate_index_placed(FILE* in, struct placement* p, struct gzip_index** idx)
 {
     int ret;
     off_t totin, totout;        /* our own total counters to avoid 4GB limit */
@@ -146,7 +199,7 @@ int generate_index_fp(FILE* in, off_t span, struct gzip_index** idx)
         }
         strm.next_in = input;
 
-        /* process all of that, or until end of stream */
+        /* process all of that, or until end of input */
         do {
             /* reset sliding window if necessary */
             if (strm.avail_out == 0) {
@@ -165,8 +218,19 @@ int generate_index_fp(FILE* in, off_t span, struct gzip_index** idx)
                 ret = Z_DATA_ERROR;
             if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR)
                 goto build_index_error;
-            if (ret == Z_STREAM_END)
-                break;
+            if (ret == Z_STREAM_END) {
+                /* a gzip member has ended; if there is more input, it is the
+                   header of the next member (e.g. layers written by pigz or
+                   made of concatenated gzip files), so reset inflate to read
+                   it -- the header is followed by a block boundary, so the
+                   next member can get an access point of its own */
+                if (strm.avail_in == 0 && ungetc(getc(in), in) == EOF)
+                    break;
+                ret = inflateReset(&strm);
+                if (ret != Z_OK)
+                    goto build_index_error;
+                continue;
+            }
 
             /* if at end of block, consider adding an index entry (note that if
                data_type indicates an end-of-block, then all of the
@@ -178,13 +242,17 @@ int generate_index_fp(FILE* in, off_t span, struct gzip_index** idx)
                access point after the last block by checking bit 6 of data_type
              */
             if ((strm.data_type & 128) && !(strm.data_type & 64) &&
-                (totout == 0 || totout - last > span)) {
+                (totout == 0 || want_point(p, totout, last))) {
                 index = addpoint(index, strm.data_type & 7, totin,
                                  totout, strm.avail_out, window);
                 if (index == NULL) {
                     ret = Z_MEM_ERROR;
                     goto build_index_error;
                 }
+                if (p->flushes != NULL) {
+                    memset(index->list[index->have - 1].window, 0, WINSIZE);
+                    index->list[index->have - 1].windowless = 1;
+                }
                 last = totout;
             }
         } while (strm.avail_in != 0);
@@ -194,7 +262,7 @@ int generate_index_fp(FILE* in, off_t span, struct gzip_index** idx)
     (void)inflateEnd(&strm);
     index->list = realloc(index->list, sizeof(struct gzip_index_point) * index->have);
     index->size = index->have;
-    index->span_size = span;
+    index->span_size = p->span;
     *idx = index;
     return index->size;
 
@@ -206,6 +274,14 @@ int generate_index_fp(FILE* in, off_t span, struct gzip_index** idx)
 
 }
 
+int generate_index_fp(FILE* in, off_t span, struct gzip_index** idx)
+{
+    struct placement p = {
+        .span = span,
+    };
+    return generate_index_placed(in, &p, idx);
+}
+
 int has_bits(struct gzip_index* index, int point_index)
 {
     if (point_index >= index->have)
@@ -230,9 +306,101 @@ off_t get_comp_off(struct gzip_index* index, int point_index)
     return index->list[point_index].in;
 }
 
-static int min(int lhs, int rhs)
+off_t get_span_size(struct gzip_index* index)
+{
+    return index->span_size;
+}
+
+/* Refills strm with more compressed input. Returns the number of bytes made
+   available, 0 at the end of the input or a negative zlib error code. */
+typedef int (*refill_fn)(z_stream *strm, void *ctx);
+
+struct buffer_source
+{
+    uchar *data;        /* next compressed byte to hand out */
+    off_t remaining;    /* number of compressed bytes left */
+    uchar *input;       /* CHUNK sized staging buffer */
+};
+
+static int refill_from_buffer(z_stream *strm, void *ctx)
+{
+    struct buffer_source *src = ctx;
+    int read = src->remaining < CHUNK ? src->remaining : CHUNK;
+    memcpy(src->input, src->data, read);
+    src->data += read;
+    src->remaining -= read;
+    strm->avail_in = read;
+    strm->next_in = src->input;
+    return read;
+}
+
+struct file_source
 {
-    return lhs < rhs ? lhs : rhs;
+    FILE *in;
+    uchar *input;       /* CHUNK sized staging buffer */
+};
+
+static int refill_from_file(z_stream *strm, void *ctx)
+{
+    struct file_source *src = ctx;
+    strm->avail_in = fread(src->input, 1, CHUNK, src->in);
+    if (ferror(src->in))
+        return Z_ERRNO;
+    strm->next_in = src->input;
+    return strm->avail_in;
+}
+
+/* Moves a raw inflate stream that just returned Z_STREAM_END to the start of
+   the next gzip member: the 8 byte trailer of the member that ended and the
+   header of the member that follows are consumed, and strm is left ready to
+   raw inflate the next member. Returns Z_OK if there is another member,
+   Z_STREAM_END if the input ends after the trailer, or a zlib error code. */
+static int next_gzip_member(z_stream *strm, refill_fn refill, void *ctx)
+{
+    int ret;
+    unsigned drop = 8;  /* gzip trailer: CRC-32 and ISIZE */
+
+    while (drop) {
+        if (strm->avail_in == 0) {
+            ret = refill(strm, ctx);
+            if (ret < 0)
+                return ret;
+            if (ret == 0)
+                return Z_DATA_ERROR;    /* truncated trailer */
+        }
+        unsigned n = strm->avail_in < drop ? strm->avail_in : drop;
+        strm->avail_in -= n;
+        strm->next_in += n;
+        drop -= n;
+    }
+
+    if (strm->avail_in == 0) {
+        ret = refill(strm, ctx);
+        if (ret < 0)
+            return ret;
+        if (ret == 0)
+            return Z_STREAM_END;
+    }
+
+    /* let inflate parse the gzip header; with Z_BLOCK it returns as soon as
+       the header is done (bit 7 of data_type), before any data is produced */
+    ret = inflateReset2(strm, 31);
+    if (ret != Z_OK)
+        return ret;
+    do {
+        if (strm->avail_in == 0) {
+            ret = refill(strm, ctx);
+            if (ret < 0)
+                return ret;
+            if (ret == 0)
+                return Z_DATA_ERROR;    /* truncated header */
+        }
+        ret = inflate(strm, Z_BLOCK);
+        if (ret != Z_OK)
+            return ret == Z_NEED_DICT ? Z_DATA_ERROR : ret;
+    } while (!(strm->data_type & 128));
+
+    return inflateReset2(strm, -15);
 }
 
 // This is the same as extract_data_fp, but instead of a file, it decompresses data from a buffer which contains the exact data to decompress 
@@ -249,6 +417,7 @@ int extract_data_from_buffer(void* d, off_t datalen, struct gzip_index* index, o
         return 0;
 
     uint8_t bits = get_bits(index, first_point_index);
+    struct buffer_source src;
 
     strm.zalloc = Z_NULL;
     strm.zfree = Z_NULL;
@@ -267,8 +436,10 @@ int extract_data_from_buffer(void* d, off_t datalen, struct gzip_index* index, o
     (void)inflateSetDictionary(&strm, index->list[first_point_index].window, WINSIZE);
     offset -= index->list[first_point_index].out;
     strm.avail_in = 0;
+    src.data = data;
+    src.remaining = datalen - (bits ? 1 : 0);
+    src.input = input;
     skip = 1;                               /* while skipping to offset */
-    int remaining = datalen;
     do {
         /* define where to put uncompressed data, and how much */
         if (offset == 0 && skip) {          /* at offset now */
@@ -288,21 +459,26 @@ int extract_data_from_buffer(void* d, off_t datalen, struct gzip_index* index, o
         }
         /* uncompress until avail_out filled, or end of stream */
         do {
-            if (strm.avail_in == 0) {
-                int read = min(remaining, CHUNK);
-                remaining -= read;
-                memcpy(input, data, read);
-                data += read;
-                strm.avail_in = read;
-                strm.next_in = input;
-            }
+            if (strm.avail_in == 0)
+                refill_from_buffer(&strm, &src);
             ret = inflate(&strm, Z_NO_FLUSH);       /* normal inflate */
             if (ret == Z_NEED_DICT)
                 ret = Z_DATA_ERROR;
             if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR)
                 goto extract_ret;
-            if (ret == Z_STREAM_END)
-                break;
+            if (ret == Z_STREAM_END) {
+                /* the gzip member has ended; move on to the next one only
+                   if more output is needed */
+                if (strm.avail_out == 0) {
+                    ret = Z_OK;
+                    break;
+                }
+                ret = next_gzip_member(&strm, refill_from_buffer, &src);
+                if (ret == Z_STREAM_END)
+                    break;
+                if (ret != Z_OK)
+                    goto extract_ret;
+            }
         } while (strm.avail_out != 0);
 
         /* if reach end of stream, then don't keep trying to get more */
@@ -327,6 +503,7 @@ int extract_data_fp(FILE *in, struct gzip_index *index, off_t offset, void *buff
     int ret, skip;
     z_stream strm;
     struct gzip_index_point *here;
+    struct file_source src;
     unsigned char input[CHUNK];
     unsigned char discard[WINSIZE];
     uchar* buf = buffer; 
@@ -365,6 +542,8 @@ int extract_data_fp(FILE *in, struct gzip_index *index, off_t offset, void *buff
     /* skip uncompressed bytes until offset reached, then satisfy request */
     offset -= here->out;
     strm.avail_in = 0;
+    src.in = in;
+    src.input = input;
     skip = 1;                               /* while skipping to offset */
     do {
         /* define where to put uncompressed data, and how much */
@@ -386,24 +565,32 @@ int extract_data_fp(FILE *in, struct gzip_index *index, off_t offset, void *buff
         /* uncompress until avail_out filled, or end of stream */
         do {
             if (strm.avail_in == 0) {
-                strm.avail_in = fread(input, 1, CHUNK, in);
-                if (ferror(in)) {
-                    ret = Z_ERRNO;
+                ret = refill_from_file(&strm, &src);
+                if (ret < 0)
                     goto extract_ret;
-                }
-                if (strm.avail_in == 0) {
+                if (ret == 0) {
                     ret = Z_DATA_ERROR;
                     goto extract_ret;
                 }
-                strm.next_in = input;
             }
             ret = inflate(&strm, Z_NO_FLUSH);       /* normal inflate */
             if (ret == Z_NEED_DICT)
                 ret = Z_DATA_ERROR;
             if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR)
                 goto extract_ret;
-            if (ret == Z_STREAM_END)
-                break;
+            if (ret == Z_STREAM_END) {
+                /* the gzip member has ended; move on to the next one only
+                   if more output is needed */
+                if (strm.avail_out == 0) {
+                    ret = Z_OK;
+                    break;
+                }
+                ret = next_gzip_member(&strm, refill_from_file, &src);
+                if (ret == Z_STREAM_END)
+                    break;
+                if (ret != Z_OK)
+                    goto extract_ret;
+            }
         } while (strm.avail_out != 0);
 
         /* if reach end of stream, then don't keep trying to get more */
@@ -448,6 +635,96 @@ int generate_index(const char* filepath, off_t span, struct gzip_index** index)
     return ret;
 }
 
+int generate_index_aligned(const char* filepath, off_t span, off_t tolerance, off_t* starts, off_t* ends, int count, struct gzip_index** index)
+{
+    FILE* fp = fopen(filepath, "rb");
+    if (fp == NULL)
+    {
+        return GZIP_INDEXER_FILE_NOT_FOUND;
+    }
+    struct file_ranges ranges = {
+        .count = count,
+        .start = starts,
+        .end = ends,
+    };
+    struct placement p = {
+        .span = span,
+        .tolerance = tolerance,
+        .ranges = &ranges,
+    };
+    int ret = generate_index_placed(fp, &p, index);
+    fclose(fp);
+    return ret;
+}
+
+int generate_index_flushed(const char* filepath, off_t span, off_t* flushes, int count, struct gzip_index** index)
+{
+    FILE* fp = fopen(filepath, "rb");
+    if (fp == NULL)
+    {
+        return GZIP_INDEXER_FILE_NOT_FOUND;
+    }
+    struct placement p = {
+        .span = span,
+        .flushes = flushes,
+        .flush_count = count,
+    };
+    int ret = generate_index_placed(fp, &p, index);
+    fclose(fp);
+    return ret;
+}
+
+z_stream* gzip_deflate_new(int level)
+{
+    z_stream* strm = malloc(sizeof(z_stream));
+    if (strm == NULL)
+    {
+        return NULL;
+    }
+    strm->zalloc = Z_NULL;
+    strm->zfree = Z_NULL;
+    strm->opaque = Z_NULL;
+    /* 15 window bits + 16 to write a gzip header and trailer */
+    if (deflateInit2(strm, level, Z_DEFLATED, 31, 8, Z_DEFAULT_STRATEGY) != Z_OK)
+    {
+        free(strm);
+        return NULL;
+    }
+    return strm;
+}
+
+int gzip_deflate(z_stream* strm, void* in, unsigned in_len, unsigned* in_used, void* out, unsigned out_len, int flush)
+{
+    strm->next_in = in;
+    strm->avail_in = in_len;
+    strm->next_out = out;
+    strm->avail_out = out_len;
+    int ret = deflate(strm, flush);
+    *in_used = in_len - strm->avail_in;
+    int have = out_len - strm->avail_out;
+
+    /* the buffers belong to the caller, don't hold on to them */
+    strm->next_in = Z_NULL;
+    strm->avail_in = 0;
+    strm->next_out = Z_NULL;
+    strm->avail_out = 0;
+
+    if (ret == Z_STREAM_ERROR)
+    {
+        return ret;
+    }
+    return have;
+}
+
+void gzip_deflate_free(z_stream* strm)
+{
+    if (strm != NULL)
+    {
+        (void)deflateEnd(strm);
+        free(strm);
+    }
+}
+
 int span_indices_for_file(struct gzip_index* index, off_t start, off_t end, void* is, void* ie)
 {
     if (index == NULL)
@@ -488,6 +765,9 @@ int pt_index_from_ucmp_offset(struct gzip_index* index, off_t off)
 }
 
 
+/* Set in the serialized bits of the access points whose windows are left out */
+#define POINT_WINDOWLESS 0x80
+
 unsigned get_blob_size(struct gzip_index* index)
 {
     if (index == NULL)
@@ -495,8 +775,6 @@ unsigned get_blob_size(struct gzip_index* index)
         return 0;
     }
 
-    unsigned size = index->size; 
-
     /*
         The buffer will be tightly packed. The layout of the buffer is: 
         -   4 bytes, number of span entries
@@ -504,10 +782,17 @@ unsigned get_blob_size(struct gzip_index* index)
         -   for each entry (except span 0)
             -  8 bytes, compressed offset
             -  8 bytes, uncompressed offset
-            -  1 byte, bits
-            -  32768 bytes, window
+            -  1 byte, bits, with POINT_WINDOWLESS set if the window is left out
+            -  32768 bytes, window, unless it is left out
     */
-    return  ((2 << 14) + 17) * (size - 1)  + 12;
+    unsigned size = 12;
+    for (int i = 1; i < index->have; i++)
+    {
+        size += 17;
+        if (!index->list[i].windowless)
+            size += WINSIZE;
+    }
+    return size;
 }
 
 int index_to_blob(struct gzip_index* index, void* buf)
@@ -538,8 +823,13 @@ int index_to_blob(struct gzip_index* index, void* buf)
         cur += 8;
         memcpy(cur, &pt->out, 8);
         cur += 8;
-        memcpy(cur, &pt->bits, 1);
+        uint8_t bits = pt->bits;
+        if (pt->windowless)
+            bits |= POINT_WINDOWLESS;
+        memcpy(cur, &bits, 1);
         cur += 1;
+        if (pt->windowless)
+            continue;
         memcpy(cur, &pt->window, WINSIZE);
         cur += WINSIZE;
     }
@@ -581,17 +871,27 @@ struct gzip_index* blob_to_index(void* buf)
     // gzip header takes the first 10 bytes, so span 0 always starts at offset 10 in compressed file
     pt0->in = 10; 
     pt0->out = 0;
+    pt0->windowless = 0;
     memset(pt0->window, 0, WINSIZE);
 
     for(int i = 1; i < size; i++)
     {
         struct gzip_index_point* pt = &index->list[i];
+        uint8_t bits;
         memcpy(&pt->in, cur, 8);
         cur += 8;
         memcpy(&pt->out, cur, 8);
         cur += 8;
-        memcpy(&pt->bits, cur, 1);
+        // bits is stored as a single byte, so it can't be copied straight into the int
+        memcpy(&bits, cur, 1);
+        pt->bits = bits & ~POINT_WINDOWLESS;
+        pt->windowless = (bits & POINT_WINDOWLESS) != 0;
         cur += 1;
+        if (pt->windowless)
+        {
+            memset(pt->window, 0, WINSIZE);
+            continue;
+        }
         memcpy(&pt->window, cur, WINSIZE);
         cur += WINSIZE;
     }
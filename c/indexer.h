@@ -67,9 +67,18 @@ struct gzip_index_point
     off_t out;          /* corresponding offset in uncompressed data */
     off_t in;           /* offset in input file of first full byte */
     int bits;           /* number of bits (1-7) from byte at in - 1, or 0 */
+    int windowless;     /* whether the window is empty and isn't serialized */
     unsigned char window[WINSIZE];  /* preceding 32K of uncompressed data */    
 };
 
+/* Uncompressed [start, end) ranges of the files in an archive, sorted by start */
+struct file_ranges
+{
+    int count;
+    off_t* start;
+    off_t* end;
+};
+
 struct gzip_index 
 {
     int have;           /* number of list entries filled in */
@@ -87,6 +96,36 @@ int pt_index_from_ucmp_offset(struct gzip_index* index, off_t off);
 int generate_index_fp(FILE* fp, off_t span, struct gzip_index** index);
 int generate_index(const char* filepath, off_t span, struct gzip_index** index);
 
+/* Same as generate_index, but access points are placed between span - tolerance
+   and span + tolerance bytes apart, preferably outside of the data of the files
+   described by starts and ends (count entries, sorted by start), so that most
+   small files are contained in a single span.
+*/
+int generate_index_aligned(const char* filepath, off_t span, off_t tolerance, off_t* starts, off_t* ends, int count, struct gzip_index** index);
+
+/* Same as generate_index, but access points are placed exactly at the full flush
+   points given in flushes (count uncompressed offsets, sorted). Since the data
+   following a full flush point doesn't refer to the data before it, these access
+   points have empty windows, which are left out of the blob of the index.
+*/
+int generate_index_flushed(const char* filepath, off_t span, off_t* flushes, int count, struct gzip_index** index);
+
+/* Subroutines to write gzip streams, e.g. with full flush points */
+
+/* Allocates a deflate stream writing gzip with the given compression level,
+   or returns NULL on failure */
+z_stream* gzip_deflate_new(int level);
+
+/* Deflates up to in_len bytes from in into out, using a zlib flush value
+   (Z_NO_FLUSH, Z_FULL_FLUSH, Z_FINISH). Returns the number of bytes written to
+   out, or a negative zlib error code, and sets in_used to the number of bytes
+   consumed from in. As with deflate, if out is filled up, the call must be
+   repeated with the rest of the input and the same flush value.
+*/
+int gzip_deflate(z_stream* strm, void* in, unsigned in_len, unsigned* in_used, void* out, unsigned out_len, int flush);
+
+void gzip_deflate_free(z_stream* strm);
+
 // TODO: Improve this
 int extract_data_from_buffer(void* d, off_t datalen, struct gzip_index* index, off_t offset, void* buffer, off_t len, int first_point_index);
 int extract_data_fp(FILE *in, struct gzip_index *index, off_t offset, void *buf, int len);
@@ -96,6 +135,7 @@ int extract_data(const char* file, struct gzip_index* index, off_t offset, void*
 int has_bits(struct gzip_index* index, int point_index);
 off_t get_ucomp_off(struct gzip_index* index, int point_index);
 off_t get_comp_off(struct gzip_index* index, int point_index);
+off_t get_span_size(struct gzip_index* index);
 
 /* Given a file's uncompressed start and end offset, returns the spans which
     contains those offsets
@@ -49,6 +49,10 @@ import (
 const (
 	defaultMaxLRUCacheEntry = 10
 	defaultMaxCacheFds      = 10
+
+	// wipDirectoryName is the directory of a directory cache where contents are written
+	// before being committed.
+	wipDirectoryName = "wip"
 )
 
 type DirectoryCacheConfig struct {
@@ -78,6 +82,14 @@ type DirectoryCacheConfig struct {
 	// Direct forcefully enables direct mode for all operation in cache.
 	// Thus operation won't use on-memory caches.
 	Direct bool
+
+	// Persistent keeps the cached contents in the directory when the cache is closed,
+	// so that a cache on the same directory can use them later, e.g. after a restart.
+	Persistent bool
+
+	// Quota optionally bounds the size of the contents on the disk, together with the
+	// other directory caches sharing it.
+	Quota *DiskQuota
 }
 
 // TODO: contents validation.
@@ -165,7 +177,7 @@ func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache
 	if err := os.MkdirAll(directory, 0700); err != nil {
 		return nil, err
 	}
-	wipdir := filepath.Join(directory, "wip")
+	wipdir := filepath.Join(directory, wipDirectoryName)
 	if err := os.MkdirAll(wipdir, 0700); err != nil {
 		return nil, err
 	}
@@ -177,6 +189,8 @@ func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache
 		wipDirectory: wipdir,
 		bufPool:      bufPool,
 		direct:       config.Direct,
+		persistent:   config.Persistent,
+		quota:        config.Quota,
 	}
 	dc.syncAdd = config.SyncAdd
 	return dc, nil
@@ -192,8 +206,10 @@ type directoryCache struct {
 
 	bufPool *sync.Pool
 
-	syncAdd bool
-	direct  bool
+	syncAdd    bool
+	direct     bool
+	persistent bool
+	quota      *DiskQuota
 
 	closed   bool
 	closedMu sync.Mutex
@@ -209,6 +225,9 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 		opt = o(opt)
 	}
 
+	// Keep the contents on the disk while they're read.
+	unpin := dc.pin(key)
+
 	if !dc.direct && !opt.direct {
 		// Get data from memory
 		if b, done, ok := dc.cache.Get(key); ok {
@@ -216,6 +235,7 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 				ReaderAt: bytes.NewReader(b.(*bytes.Buffer).Bytes()),
 				closeFunc: func() error {
 					done()
+					unpin()
 					return nil
 				},
 			}, nil
@@ -227,6 +247,7 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 				ReaderAt: f.(*os.File),
 				closeFunc: func() error {
 					done() // file will be closed when it's evicted from the cache
+					unpin()
 					return nil
 				},
 			}, nil
@@ -238,6 +259,7 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	//       or simply report the cache miss?
 	file, err := os.Open(dc.cachePath(key))
 	if err != nil {
+		unpin()
 		return nil, errors.Wrapf(err, "failed to open blob file for %q", key)
 	}
 
@@ -246,8 +268,11 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	// that won't be accessed immediately.
 	if dc.direct || opt.direct {
 		return &reader{
-			ReaderAt:  file,
-			closeFunc: func() error { return file.Close() },
+			ReaderAt: file,
+			closeFunc: func() error {
+				unpin()
+				return file.Close()
+			},
 		}, nil
 	}
 
@@ -257,6 +282,7 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	return &reader{
 		ReaderAt: file,
 		closeFunc: func() error {
+			defer unpin()
 			_, done, added := dc.fileCache.Add(key, file)
 			defer done() // Release it immediately. Cleaned up on eviction.
 			if !added {
@@ -297,7 +323,15 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 				return multierror.Append(allErr,
 					errors.Wrapf(err, "failed to create cache directory %q", c))
 			}
-			return os.Rename(wip.Name(), c)
+			if err := os.Rename(wip.Name(), c); err != nil {
+				return err
+			}
+			if dc.quota != nil {
+				if info, err := os.Stat(c); err == nil {
+					dc.quota.add(dc, key, c, info.Size())
+				}
+			}
+			return nil
 		},
 		abortFunc: func() error {
 			return os.Remove(wip.Name())
@@ -366,7 +400,32 @@ func (dc *directoryCache) Close() error {
 		return nil
 	}
 	dc.closed = true
-	return os.RemoveAll(dc.directory)
+	if dc.persistent {
+		if dc.quota != nil {
+			dc.quota.release(dc, false)
+		}
+		return nil
+	}
+	err := os.RemoveAll(dc.directory)
+	if dc.quota != nil {
+		dc.quota.release(dc, true)
+	}
+	return err
+}
+
+// pin keeps the contents of key from being evicted by the quota until the returned function
+// is called.
+func (dc *directoryCache) pin(key string) (unpin func()) {
+	if dc.quota == nil {
+		return func() {}
+	}
+	return dc.quota.pin(dc, key, dc.cachePath(key))
+}
+
+// drop discards the contents of key kept in memory, when they're evicted by the quota.
+func (dc *directoryCache) drop(key string) {
+	dc.cache.Remove(key)
+	dc.fileCache.Remove(key)
 }
 
 func (dc *directoryCache) isClosed() bool {
@@ -424,6 +483,30 @@ func (mc *MemoryCache) Close() error {
 	return nil
 }
 
+// NewNopCache returns a cache which doesn't keep any contents, for blobs whose
+// contents are cached elsewhere.
+func NewNopCache() BlobCache {
+	return nopCache{}
+}
+
+type nopCache struct{}
+
+func (nopCache) Get(key string, opts ...Option) (Reader, error) {
+	return nil, fmt.Errorf("Missed cache: %q", key)
+}
+
+func (nopCache) Add(key string, opts ...Option) (Writer, error) {
+	return &writer{
+		WriteCloser: nopWriteCloser(io.Discard),
+		commitFunc:  func() error { return nil },
+		abortFunc:   func() error { return nil },
+	}, nil
+}
+
+func (nopCache) Close() error {
+	return nil
+}
+
 type reader struct {
 	io.ReaderAt
 	closeFunc func() error
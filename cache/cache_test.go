@@ -87,6 +87,39 @@ func TestDirectoryCache(t *testing.T) {
 	testCache(t, "dir-with-small-mem", newCache)
 }
 
+func TestPersistentDirectoryCache(t *testing.T) {
+	tmp := t.TempDir()
+	newCache := func() BlobCache {
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			SyncAdd:    true,
+			Persistent: true,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c
+	}
+	c := newCache()
+	w, err := c.Add(digestFor(sampleData))
+	if err != nil {
+		t.Fatalf("failed to add %v: %v", sampleData, err)
+	}
+	if _, err := w.Write([]byte(sampleData)); err != nil {
+		t.Fatalf("failed to write %v: %v", sampleData, err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit %v: %v", sampleData, err)
+	}
+	w.Close()
+	if err := c.Close(); err != nil {
+		t.Fatalf("failed to close cache: %v", err)
+	}
+
+	c = newCache()
+	defer c.Close()
+	hit(sampleData)(t, c)
+}
+
 func TestMemoryCache(t *testing.T) {
 	testCache(t, "memory", func() (BlobCache, cleanFunc) { return NewMemoryCache(), func() {} })
 }
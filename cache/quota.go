@@ -0,0 +1,217 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"container/list"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DiskQuota bounds the total size of the contents of the directory caches sharing it.
+// When the total size exceeds the quota, the least recently used contents are evicted
+// from the disk, except for the contents which are being read.
+type DiskQuota struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	usage   int64
+	lru     *list.List // of *quotaEntry, most recently used first
+	entries map[string]*list.Element
+
+	// OnUsage optionally specifies a callback function to be executed
+	// with the total size of the contents when it changes.
+	OnUsage func(usage int64)
+
+	// OnEvicted optionally specifies a callback function to be executed
+	// when contents are evicted from the disk.
+	OnEvicted func(path string, size int64)
+}
+
+type quotaEntry struct {
+	path string
+	size int64
+	pins int
+
+	// dc and key locate the contents in the open cache holding them, if any.
+	dc  *directoryCache
+	key string
+}
+
+// NewDiskQuota returns a quota of maxBytes for directory caches.
+// A quota of 0 doesn't bound the size of the contents, but still tracks it.
+func NewDiskQuota(maxBytes int64) *DiskQuota {
+	return &DiskQuota{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// Usage returns the total size of the contents in bytes.
+func (q *DiskQuota) Usage() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.usage
+}
+
+// Load accounts the contents left in the directory root, e.g. by persistent caches before a
+// restart, as least recently used in the order of their modification times. Stale contents
+// whose writes were interrupted are removed, and the contents over the quota are evicted.
+func (q *DiskQuota) Load(root string) error {
+	type content struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var contents []content
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() && d.Name() == wipDirectoryName {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		contents = append(contents, content{path, info.Size(), info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(contents, func(i, j int) bool {
+		return contents[i].modTime.After(contents[j].modTime)
+	})
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, c := range contents {
+		if _, ok := q.entries[c.path]; ok {
+			continue
+		}
+		q.entries[c.path] = q.lru.PushBack(&quotaEntry{path: c.path, size: c.size})
+		q.usage += c.size
+	}
+	q.evictLocked()
+	return nil
+}
+
+// add accounts the contents of key committed to dc at path, as the most recently used.
+func (q *DiskQuota) add(dc *directoryCache, key, path string, size int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if e, ok := q.entries[path]; ok {
+		entry := e.Value.(*quotaEntry)
+		q.usage += size - entry.size
+		entry.size, entry.dc, entry.key = size, dc, key
+		q.lru.MoveToFront(e)
+	} else {
+		q.entries[path] = q.lru.PushFront(&quotaEntry{path: path, size: size, dc: dc, key: key})
+		q.usage += size
+	}
+	q.evictLocked()
+}
+
+// pin marks the contents of key in dc at path as the most recently used, and keeps them from
+// being evicted until the returned function is called.
+func (q *DiskQuota) pin(dc *directoryCache, key, path string) (unpin func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.entries[path]
+	if !ok {
+		return func() {}
+	}
+	entry := e.Value.(*quotaEntry)
+	entry.pins++
+	entry.dc, entry.key = dc, key
+	q.lru.MoveToFront(e)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			entry.pins--
+			q.evictLocked()
+		})
+	}
+}
+
+// release stops accounting the contents of dc when it's closed. The contents are kept
+// accounted if they're kept on the disk.
+func (q *DiskQuota) release(dc *directoryCache, removed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for e := q.lru.Front(); e != nil; {
+		next := e.Next()
+		if entry := e.Value.(*quotaEntry); entry.dc == dc {
+			if removed {
+				q.removeLocked(e)
+			} else {
+				entry.dc = nil
+			}
+		}
+		e = next
+	}
+	q.notifyLocked()
+}
+
+func (q *DiskQuota) evictLocked() {
+	for e := q.lru.Back(); e != nil && q.maxBytes > 0 && q.usage > q.maxBytes; {
+		prev := e.Prev()
+		if entry := e.Value.(*quotaEntry); entry.pins == 0 {
+			if entry.dc != nil {
+				entry.dc.drop(entry.key)
+			}
+			if err := os.Remove(entry.path); err == nil || os.IsNotExist(err) {
+				q.removeLocked(e)
+				if q.OnEvicted != nil {
+					q.OnEvicted(entry.path, entry.size)
+				}
+			}
+		}
+		e = prev
+	}
+	q.notifyLocked()
+}
+
+func (q *DiskQuota) removeLocked(e *list.Element) {
+	entry := q.lru.Remove(e).(*quotaEntry)
+	delete(q.entries, entry.path)
+	q.usage -= entry.size
+}
+
+func (q *DiskQuota) notifyLocked() {
+	if q.OnUsage != nil {
+		q.OnUsage(q.usage)
+	}
+}
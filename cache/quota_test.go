@@ -0,0 +1,116 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskQuota(t *testing.T) {
+	add := func(c BlobCache, key string) {
+		w, err := c.Add(key)
+		if err != nil {
+			t.Fatalf("failed to add %q: %v", key, err)
+		}
+		defer w.Close()
+		if _, err := w.Write([]byte(sampleData)); err != nil {
+			t.Fatalf("failed to write %q: %v", key, err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("failed to commit %q: %v", key, err)
+		}
+	}
+	cached := func(c BlobCache, key string) bool {
+		r, err := c.Get(key)
+		if err != nil {
+			return false
+		}
+		r.Close()
+		return true
+	}
+
+	// the quota holds two contents across the caches
+	quota := NewDiskQuota(int64(2 * len(sampleData)))
+	var evicted []string
+	quota.OnEvicted = func(path string, size int64) { evicted = append(evicted, filepath.Base(path)) }
+	newCache := func() BlobCache {
+		c, err := NewDirectoryCache(t.TempDir(), DirectoryCacheConfig{SyncAdd: true, Direct: true, Quota: quota})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c
+	}
+	c1, c2 := newCache(), newCache()
+	defer c1.Close()
+	add(c1, "a")
+	add(c2, "b")
+	cached(c1, "a") // b is the least recently used
+	add(c1, "c")
+	if cached(c2, "b") || !cached(c1, "a") || !cached(c1, "c") {
+		t.Fatalf("least recently used contents weren't evicted: %v", evicted)
+	}
+
+	// contents being read aren't evicted
+	r, err := c1.Get("a")
+	if err != nil {
+		t.Fatalf("failed to get a: %v", err)
+	}
+	add(c2, "d")
+	if !cached(c1, "a") || cached(c1, "c") {
+		t.Fatalf("contents being read were evicted: %v", evicted)
+	}
+	r.Close()
+	if usage := quota.Usage(); usage != int64(2*len(sampleData)) {
+		t.Fatalf("unexpected usage %d", usage)
+	}
+
+	// the contents of a removed cache aren't accounted
+	c2.Close()
+	if usage := quota.Usage(); usage != int64(len(sampleData)) {
+		t.Fatalf("unexpected usage %d after closing a cache", usage)
+	}
+}
+
+func TestDiskQuotaLoad(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "layer")
+	for _, path := range []string{"a", "b", filepath.Join(wipDirectoryName, "c-1")} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0700); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, path), []byte(sampleData), 0600); err != nil {
+			t.Fatalf("failed to write %q: %v", path, err)
+		}
+	}
+
+	quota := NewDiskQuota(int64(len(sampleData)))
+	if err := quota.Load(root); err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, wipDirectoryName)); !os.IsNotExist(err) {
+		t.Fatalf("stale wip contents weren't removed: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+	if len(entries) != 1 || quota.Usage() != int64(len(sampleData)) {
+		t.Fatalf("contents over the quota weren't evicted: %v, usage %d", entries, quota.Usage())
+	}
+}
@@ -0,0 +1,233 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
+	"github.com/awslabs/soci-snapshotter/soci"
+	eventstypes "github.com/containerd/containerd/api/events"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/typeurl"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// AutoIndexCommand is a command to build SOCI indices of images as they are created or updated in containerd
+var AutoIndexCommand = cli.Command{
+	Name:  "autoindex",
+	Usage: "build SOCI indices of images as they are pulled",
+	Description: `Watch containerd for images being created or updated, and build the SOCI index of each
+image whose name matches one of the --pattern globs, with the same defaults as soci create.
+The index of an image manifest is built once, and failed attempts are retried. The jobs are
+tracked in the artifacts db, so that pending jobs are resumed after a restart.
+
+With --push, the indices are pushed to the repositories of the images, with the credentials
+from --user, or else from the docker config and its credential helpers.`,
+	Flags: append([]cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "pattern",
+			Usage: "glob of the names of the images to index, e.g. registry.example.com/*, can be repeated. Default is all images",
+		},
+		cli.BoolFlag{
+			Name:  "existing",
+			Usage: "also index the images already in containerd",
+		},
+		cli.Int64Flag{
+			Name:  "max-attempts",
+			Usage: "number of attempts to build an index before giving up",
+			Value: 3,
+		},
+		cli.DurationFlag{
+			Name:  "retry-delay",
+			Usage: "delay before retrying to build an index",
+			Value: 30 * time.Second,
+		},
+		cli.BoolFlag{
+			Name:  "push",
+			Usage: "push the built indices to the repositories of the images",
+		},
+		cli.StringFlag{
+			Name:  "user,u",
+			Usage: "User[:password] Registry user and password",
+		},
+		cli.BoolFlag{
+			Name:  "plain-http",
+			Usage: "Allow connections using plain HTTP",
+		},
+	}, internal.BuildFlags...),
+	Action: func(cliContext *cli.Context) error {
+		buildOpts, err := internal.BuildOptions(cliContext)
+		if err != nil {
+			return err
+		}
+		spanSize := cliContext.Int64("span-size")
+		push := cliContext.Bool("push")
+		pushOpts := []soci.PushOption{soci.WithPlainHTTP(cliContext.Bool("plain-http"))}
+		if username := cliContext.String("user"); username != "" {
+			var secret string
+			if i := strings.IndexByte(username, ':'); i > 0 {
+				secret = username[i+1:]
+				username = username[0:i]
+			}
+			pushOpts = append(pushOpts, soci.WithCredentials(username, secret))
+		} else {
+			pushOpts = append(pushOpts, soci.WithKeychain(dockerconfig.DockerCreds))
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		db, err := soci.NewDB()
+		if err != nil {
+			return err
+		}
+		blobStore, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return err
+		}
+		cs := client.ContentStore()
+		is := client.ImageService()
+
+		resolve := func(ctx context.Context, name string) (digest.Digest, error) {
+			img, err := is.Get(ctx, name)
+			if err != nil {
+				return "", err
+			}
+			desc, err := soci.GetImageManifestDescriptor(ctx, cs, img, platforms.Default())
+			if err != nil {
+				return "", err
+			}
+			return desc.Digest, nil
+		}
+		index := func(ctx context.Context, name string, manifestDigest digest.Digest) (digest.Digest, error) {
+			img, err := is.Get(ctx, name)
+			if err != nil {
+				return "", err
+			}
+			// the image target is content addressed, so the index is built from the checked manifest
+			desc, err := soci.GetImageManifestDescriptor(ctx, cs, img, platforms.Default())
+			if err != nil {
+				return "", err
+			}
+			if desc.Digest != manifestDigest {
+				return "", fmt.Errorf("image %s no longer resolves to manifest %s", name, manifestDigest)
+			}
+			indexWithMetadata, err := soci.CreateIndex(ctx, cs, img, spanSize, blobStore, buildOpts...)
+			if err != nil {
+				return "", err
+			}
+			b, err := json.Marshal(indexWithMetadata.Index)
+			if err != nil {
+				return "", err
+			}
+			indexDesc := ocispec.Descriptor{
+				MediaType: indexWithMetadata.Index.MediaType,
+				Digest:    digest.FromBytes(b),
+				Size:      int64(len(b)),
+			}
+			if push {
+				refspec, err := reference.Parse(name)
+				if err != nil {
+					return "", err
+				}
+				if _, err := soci.PushIndex(ctx, blobStore, refspec.Locator, indexDesc, pushOpts...); err != nil {
+					return "", fmt.Errorf("cannot push soci index %s: %w", indexDesc.Digest, err)
+				}
+			}
+			return indexDesc.Digest, nil
+		}
+
+		autoIndexer, err := soci.NewAutoIndexer(db, resolve, index,
+			soci.WithImagePatterns(cliContext.StringSlice("pattern")...),
+			soci.WithMaxAttempts(cliContext.Int64("max-attempts")),
+			soci.WithRetryDelay(cliContext.Duration("retry-delay")))
+		if err != nil {
+			return err
+		}
+		enqueue := func(name string) {
+			queued, err := autoIndexer.Enqueue(ctx, name)
+			if err != nil {
+				log.G(ctx).WithError(err).WithField("image", name).Warn("cannot queue image for indexing")
+			} else if queued {
+				fmt.Printf("queued %s for indexing\n", name)
+			}
+		}
+
+		eventsCh, errCh := client.Subscribe(ctx, `topic=="/images/create"`, `topic=="/images/update"`)
+		if cliContext.Bool("existing") {
+			imgs, err := is.List(ctx)
+			if err != nil {
+				return err
+			}
+			for _, img := range imgs {
+				enqueue(img.Name)
+			}
+		}
+
+		go func() {
+			for {
+				select {
+				case e := <-eventsCh:
+					if e == nil || e.Event == nil {
+						continue
+					}
+					v, err := typeurl.UnmarshalAny(e.Event)
+					if err != nil {
+						log.G(ctx).WithError(err).Warn("cannot unmarshal an event")
+						continue
+					}
+					switch event := v.(type) {
+					case *eventstypes.ImageCreate:
+						enqueue(event.Name)
+					case *eventstypes.ImageUpdate:
+						enqueue(event.Name)
+					}
+				case err := <-errCh:
+					if err != nil && ctx.Err() == nil {
+						log.G(ctx).WithError(err).Error("event subscription failed")
+					}
+					stop()
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+		return autoIndexer.Run(ctx)
+	},
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/images/converter"
+	"github.com/containerd/containerd/platforms"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// ConvertCommand converts an image into an image with SOCI-optimized layers and creates its SOCI index.
+// The layers are recompressed with deflate full flush points at file boundaries, so that spans line up
+// with files and the ztocs don't need windows. The uncompressed layers are unchanged, so the diff IDs
+// of the new image are the same, but the layer and manifest digests aren't.
+var ConvertCommand = cli.Command{
+	Name:      "convert",
+	Usage:     "convert an image into an image with SOCI-optimized layers and create its SOCI index",
+	ArgsUsage: "[flags] <source_ref> <target_ref>",
+	Flags: []cli.Flag{
+		cli.Int64Flag{
+			Name:  "span-size",
+			Usage: "maximum span size of index, i.e. how often full flush points are added. Default is 1 MiB",
+			Value: 1 << 20,
+		},
+		cli.Int64Flag{
+			Name:  "min-layer-size",
+			Usage: "The minimum layer size in bytes to convert and build zTOC for. Default is 0.",
+			Value: 0,
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		srcRef := cliContext.Args().Get(0)
+		dstRef := cliContext.Args().Get(1)
+		if srcRef == "" || dstRef == "" {
+			return errors.New("source and target image need to be specified")
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		blobStore, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return err
+		}
+		conv, err := soci.NewConverter(cliContext.Int64("span-size"), blobStore,
+			soci.WithMinLayerSize(cliContext.Int64("min-layer-size")),
+			soci.WithBuildToolIdentifier(internal.BuildToolIdentifier),
+			soci.WithBuildToolVersion(internal.BuildToolVersion))
+		if err != nil {
+			return err
+		}
+
+		dstImg, err := converter.Convert(ctx, client, dstRef, srcRef,
+			converter.WithLayerConvertFunc(conv.LayerConvertFunc),
+			converter.WithPlatform(platforms.Default()))
+		if err != nil {
+			return err
+		}
+
+		sociIndex, err := conv.BuildSociIndex(ctx, client.ContentStore(), *dstImg)
+		if err != nil {
+			return err
+		}
+		if err := internal.PrintZtocs(ctx, cliContext.App.Writer, client.ContentStore(), sociIndex); err != nil {
+			return err
+		}
+
+		sociIndexWithMetadata := soci.IndexWithMetadata{
+			Index:       sociIndex,
+			ImageDigest: dstImg.Target.Digest,
+			Platform:    platforms.DefaultSpec(),
+		}
+		if err := soci.WriteSociIndex(ctx, sociIndexWithMetadata, blobStore); err != nil {
+			return err
+		}
+
+		fmt.Fprintln(cliContext.App.Writer, dstImg.Target.Digest.String())
+		return nil
+	},
+}
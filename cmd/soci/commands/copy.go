@@ -0,0 +1,176 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	oraslib "oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// CopyCommand is a command to copy an image and its SOCI artifacts between registries and OCI layouts
+var CopyCommand = cli.Command{
+	Name:      "copy",
+	Usage:     "copy an image and its SOCI artifacts",
+	ArgsUsage: "[flags] <src-ref> <dst-ref>",
+	Description: `Copy an image and every SOCI index and ztoc of its manifests, preserving their digests.
+
+The source and destination are image references in registries, or OCI layout directories
+given as <path>[:<tag>] with --from-oci-layout and --to-oci-layout. The SOCI indices are found
+with the Referrers API, the referrers fallback tag of each manifest and, in OCI layouts, by their
+subject. On destinations without the Referrers API, the referrers fallback tags are updated to
+list the copied indices.
+
+Credentials of the source are taken from --src-user, of the destination from --dst-user,
+and of either from --user if not given, or else from the docker config and its credential helpers.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "user,u",
+			Usage: "User[:password] Registry user and password of the source and destination",
+		},
+		cli.StringFlag{
+			Name:  "src-user",
+			Usage: "User[:password] Registry user and password of the source, overrides --user",
+		},
+		cli.StringFlag{
+			Name:  "dst-user",
+			Usage: "User[:password] Registry user and password of the destination, overrides --user",
+		},
+		cli.BoolFlag{
+			Name:  "plain-http",
+			Usage: "Allow connections using plain HTTP",
+		},
+		cli.BoolFlag{
+			Name:  "from-oci-layout",
+			Usage: "the source is an OCI layout directory",
+		},
+		cli.BoolFlag{
+			Name:  "to-oci-layout",
+			Usage: "the destination is an OCI layout directory",
+		},
+		cli.Uint64Flag{
+			Name:  "max-concurrent-uploads",
+			Usage: "Max concurrent uploads. Default is 10",
+			Value: 10,
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		if cliContext.NArg() != 2 {
+			return fmt.Errorf("please provide a source and a destination")
+		}
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		opts := []soci.PushOption{
+			soci.WithPlainHTTP(cliContext.Bool("plain-http")),
+			soci.WithMaxConcurrentUploads(int64(cliContext.Uint64("max-concurrent-uploads"))),
+			soci.WithPushProgress(func(event soci.PushEvent, desc ocispec.Descriptor) {
+				switch event {
+				case soci.PushEventPushed:
+					fmt.Printf("copied artifact with digest: %v\n", desc.Digest)
+				case soci.PushEventSkipped:
+					fmt.Printf("skipped artifact with digest: %v\n", desc.Digest)
+				}
+			}),
+		}
+		srcUser, dstUser := cliContext.String("src-user"), cliContext.String("dst-user")
+		if srcUser == "" {
+			srcUser = cliContext.String("user")
+		}
+		if dstUser == "" {
+			dstUser = cliContext.String("user")
+		}
+
+		src, srcRef, err := copyTarget(cliContext.Args().Get(0), cliContext.Bool("from-oci-layout"),
+			append(opts, credentialOption(srcUser)))
+		if err != nil {
+			return err
+		}
+		dst, dstRef, err := copyTarget(cliContext.Args().Get(1), cliContext.Bool("to-oci-layout"),
+			append(opts, credentialOption(dstUser)))
+		if err != nil {
+			return err
+		}
+
+		result, err := soci.CopyImage(ctx, src, srcRef, dst, dstRef, opts...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("copied image %s\n", result.Root.Digest)
+		for _, indexDesc := range result.Indices {
+			fmt.Printf("copied soci index %s\n", indexDesc.Digest)
+		}
+		for _, tag := range result.ReferrersTags {
+			fmt.Printf("updated referrers tag %s\n", tag)
+		}
+		return nil
+	},
+}
+
+// credentialOption returns the option to authenticate to a registry as the user given as
+// user[:password], or with the docker config if there is none.
+func credentialOption(username string) soci.PushOption {
+	if username == "" {
+		return soci.WithKeychain(dockerconfig.DockerCreds)
+	}
+	var secret string
+	if i := strings.IndexByte(username, ':'); i > 0 {
+		secret = username[i+1:]
+		username = username[0:i]
+	}
+	return soci.WithCredentials(username, secret)
+}
+
+// copyTarget returns the target and reference of the image arg, which is either an image
+// reference or, for an OCI layout, a directory with an optional tag.
+func copyTarget(arg string, layout bool, opts []soci.PushOption) (oraslib.Target, string, error) {
+	if layout {
+		path, tag := arg, "latest"
+		if i := strings.LastIndexByte(arg, ':'); i > strings.LastIndexByte(arg, '/') {
+			path, tag = arg[:i], arg[i+1:]
+		}
+		store, err := oci.New(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot open OCI layout %s: %w", path, err)
+		}
+		return store, tag, nil
+	}
+	refspec, err := reference.Parse(arg)
+	if err != nil {
+		return nil, "", err
+	}
+	repo, err := soci.NewRepository(refspec.Locator, opts...)
+	if err != nil {
+		return nil, "", err
+	}
+	if dgst := refspec.Digest(); dgst != "" {
+		return repo, dgst.String(), nil
+	}
+	return repo, refspec.Object, nil
+}
@@ -17,20 +17,15 @@
 package commands
 
 import (
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
 	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/cmd/ctr/commands"
-	"github.com/containerd/containerd/platforms"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"oras.land/oras-go/v2/content/oci"
 )
 
-const (
-	buildToolIdentifier = "AWS SOCI CLI"
-	buildToolVersion    = "0.1"
-)
-
 // CreateCommand creates SOCI index for an image
 // Output of this command is SOCI layers and SOCI index stored in a local directory
 // SOCI layer is named as <image-layer-digest>.soci.layer
@@ -39,18 +34,7 @@ var CreateCommand = cli.Command{
 	Name:      "create",
 	Usage:     "create SOCI index",
 	ArgsUsage: "[flags] <image_ref>",
-	Flags: []cli.Flag{
-		cli.Int64Flag{
-			Name:  "span-size",
-			Usage: "span size of index. Default is 1 MiB",
-			Value: 1 << 20,
-		},
-		cli.Int64Flag{
-			Name:  "min-layer-size",
-			Usage: "The minimum layer size in bytes to build zTOC for. Default is 0.",
-			Value: 0,
-		},
-	},
+	Flags:     internal.BuildFlags,
 	Action: func(cliContext *cli.Context) error {
 		srcRef := cliContext.Args().Get(0)
 		if srcRef == "" {
@@ -69,36 +53,19 @@ var CreateCommand = cli.Command{
 		if err != nil {
 			return err
 		}
-		spanSize := cliContext.Int64("span-size")
-		minLayerSize := cliContext.Int64("min-layer-size")
-		blobStore, err := oci.New(config.SociContentStorePath)
+		opts, err := internal.BuildOptions(cliContext)
 		if err != nil {
 			return err
 		}
-
-		sociIndex, err := soci.BuildSociIndex(ctx, cs, srcImg, spanSize, blobStore,
-			soci.WithMinLayerSize(minLayerSize),
-			soci.WithBuildToolIdentifier(buildToolIdentifier),
-			soci.WithBuildToolVersion(buildToolVersion))
-
+		blobStore, err := oci.New(config.SociContentStorePath)
 		if err != nil {
 			return err
 		}
 
-		sociIndexWithMetadata := soci.IndexWithMetadata{
-			Index:       sociIndex,
-			ImageDigest: srcImg.Target.Digest,
-			// TODO: This is not strictly correct because the default platform matcher used in BuildSociIndex
-			// might match a compatible version (i.e. linux/amd64 will match linux/i386). Building indices for
-			// multiple/non-default platforms will be needed at some point and this should be fixed with that change as well.
-			Platform: platforms.DefaultSpec(),
-		}
-
-		err = soci.WriteSociIndex(ctx, sociIndexWithMetadata, blobStore)
+		indexWithMetadata, err := soci.CreateIndex(ctx, cs, srcImg, cliContext.Int64("span-size"), blobStore, opts...)
 		if err != nil {
 			return err
 		}
-
-		return nil
+		return internal.PrintZtocs(ctx, cliContext.App.Writer, cs, indexWithMetadata.Index)
 	},
 }
@@ -0,0 +1,126 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+// FsckCommand checks the SOCI content store and rebuilds the artifacts db from it
+var FsckCommand = cli.Command{
+	Name:  "fsck",
+	Usage: "check the SOCI content store and repair the artifacts db",
+	Description: `Verify the digests of all blobs in the SOCI content store, rebuild the artifacts db entries
+of the SOCI indices and ztocs in it, linking the indices to their images in containerd, and report
+artifacts db entries of blobs missing from the store.
+
+With --remove, corrupt blobs are removed from the store and dangling entries from the artifacts db.
+`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "remove",
+			Usage: "remove corrupt blobs and dangling artifacts db entries",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		db, err := soci.NewDB()
+		if err != nil {
+			return fmt.Errorf("%w; if it's corrupted, move it out of %s and run fsck again", err, config.SociSnapshotterRootPath)
+		}
+
+		is := client.ImageService()
+		cs := client.ContentStore()
+		link := func(ctx context.Context, manifestDigest digest.Digest) (digest.Digest, ocispec.Platform, bool, error) {
+			imgs, err := is.List(ctx)
+			if err != nil {
+				return "", ocispec.Platform{}, false, err
+			}
+			for _, img := range imgs {
+				if platform, ok := findManifest(ctx, cs, img.Target, manifestDigest); ok {
+					return img.Target.Digest, platform, true, nil
+				}
+			}
+			return "", ocispec.Platform{}, false, nil
+		}
+
+		remove := cliContext.Bool("remove")
+		report, err := db.Fsck(ctx, config.SociContentStorePath, link, remove)
+		if err != nil {
+			return err
+		}
+		for _, dgst := range report.CorruptBlobs {
+			fmt.Printf("corrupt blob %s%s\n", dgst, removedSuffix(remove))
+		}
+		for _, ae := range report.RebuiltEntries {
+			fmt.Printf("rebuilt %s entry %s for %s\n", ae.Type, ae.Digest, ae.OriginalDigest)
+		}
+		for _, ae := range report.DanglingEntries {
+			fmt.Printf("dangling %s entry %s%s\n", ae.Type, ae.Digest, removedSuffix(remove))
+		}
+		fmt.Printf("%d corrupt blobs, %d rebuilt entries, %d dangling entries\n",
+			len(report.CorruptBlobs), len(report.RebuiltEntries), len(report.DanglingEntries))
+		return nil
+	},
+}
+
+// findManifest returns the platform of the manifest with the given digest if target is that
+// manifest or an index of it.
+func findManifest(ctx context.Context, cs content.Store, target ocispec.Descriptor, manifestDigest digest.Digest) (ocispec.Platform, bool) {
+	if target.Digest == manifestDigest {
+		return platforms.DefaultSpec(), true
+	}
+	if !images.IsIndexType(target.MediaType) {
+		return ocispec.Platform{}, false
+	}
+	manifests, err := images.Children(ctx, cs, target)
+	if err != nil {
+		return ocispec.Platform{}, false
+	}
+	for _, m := range manifests {
+		if m.Digest == manifestDigest {
+			if m.Platform != nil {
+				return *m.Platform, true
+			}
+			return platforms.DefaultSpec(), true
+		}
+	}
+	return ocispec.Platform{}, false
+}
+
+func removedSuffix(removed bool) string {
+	if removed {
+		return " (removed)"
+	}
+	return ""
+}
@@ -0,0 +1,107 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/urfave/cli"
+)
+
+var diffCommand = cli.Command{
+	Name:  "diff",
+	Usage: "show the files added (A), removed (D) and modified (M) between two images from their ztocs, without fetching their layers",
+	ArgsUsage: "[flags] <ref-a> <ref-b>\n\n" +
+		"Ztocs don't record the digests of files, so files are compared by type, size, mode, owner,\n" +
+		"modification time, link target and xattrs.",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "soci-index-digest-a",
+			Usage: "digest of the SOCI index of <ref-a> to fetch from the registry, instead of the latest local index",
+		},
+		cli.StringFlag{
+			Name:  "soci-index-digest-b",
+			Usage: "digest of the SOCI index of <ref-b> to fetch from the registry, instead of the latest local index",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		refA, refB := cliContext.Args().Get(0), cliContext.Args().Get(1)
+		if refA == "" || refB == "" {
+			return fmt.Errorf("please provide two image references")
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		layersA, err := loadLayerZtocs(ctx, client, refA, cliContext.String("soci-index-digest-a"))
+		if err != nil {
+			return err
+		}
+		layersB, err := loadLayerZtocs(ctx, client, refB, cliContext.String("soci-index-digest-b"))
+		if err != nil {
+			return err
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
+		for _, c := range soci.DiffInventories(soci.Inventory(layersA), soci.Inventory(layersB)) {
+			writer.Write([]byte(fmt.Sprintf("%s\t%s\t%s\t\n", c.Kind, c.Path, describeChange(&c))))
+		}
+		writer.Flush()
+		return nil
+	},
+}
+
+// describeChange describes how the metadata of a file changed.
+func describeChange(c *soci.InventoryChange) string {
+	var details []string
+	switch c.Kind {
+	case soci.ChangeAdded:
+		details = append(details, fmt.Sprintf("%s, size: %d", c.New.Type, c.New.UncompressedSize))
+	case soci.ChangeRemoved:
+		details = append(details, fmt.Sprintf("%s, size: %d", c.Old.Type, c.Old.UncompressedSize))
+	case soci.ChangeModified:
+		o, n := c.Old, c.New
+		for _, f := range c.Fields {
+			switch f {
+			case "Type":
+				details = append(details, fmt.Sprintf("type: %s -> %s", o.Type, n.Type))
+			case "UncompressedSize":
+				details = append(details, fmt.Sprintf("size: %d -> %d", o.UncompressedSize, n.UncompressedSize))
+			case "Mode":
+				details = append(details, fmt.Sprintf("mode: %s -> %s", soci.GetFileMode(&o.FileMetadata), soci.GetFileMode(&n.FileMetadata)))
+			case "Owner":
+				details = append(details, fmt.Sprintf("owner: %d:%d -> %d:%d", o.UID, o.GID, n.UID, n.GID))
+			case "ModTime":
+				details = append(details, fmt.Sprintf("mtime: %s -> %s", o.ModTime.UTC().Format(time.RFC3339), n.ModTime.UTC().Format(time.RFC3339)))
+			case "Linkname":
+				details = append(details, fmt.Sprintf("link: %s -> %s", o.Linkname, n.Linkname))
+			default:
+				details = append(details, strings.ToLower(f))
+			}
+		}
+	}
+	return strings.Join(details, ", ")
+}
@@ -0,0 +1,324 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package image
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/remote"
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	"golang.org/x/sys/unix"
+)
+
+var extractCommand = cli.Command{
+	Name:  "extract",
+	Usage: "extract files of an image, fetching only the spans of its layers containing them",
+	ArgsUsage: "[flags] <ref> <path>...\n\n" +
+		"Directories are extracted with all of their contents.",
+	Flags: []cli.Flag{
+		sociIndexDigestFlag,
+		cli.StringFlag{
+			Name:  "directory, C",
+			Usage: "directory to extract the files to",
+			Value: ".",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		ref := cliContext.Args().First()
+		paths := cliContext.Args().Tail()
+		if ref == "" || len(paths) == 0 {
+			return fmt.Errorf("please provide an image reference and the paths to extract")
+		}
+		refspec, err := reference.Parse(ref)
+		if err != nil {
+			return fmt.Errorf("cannot parse image ref (%s): %w", ref, err)
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		layers, err := loadLayerZtocs(ctx, client, ref, cliContext.String(sociIndexDigestFlag.Name))
+		if err != nil {
+			return err
+		}
+		inventory := soci.Inventory(layers)
+		entries, err := soci.InventorySubtrees(inventory, paths)
+		if err != nil {
+			return err
+		}
+
+		ex := &extractor{
+			ctx:       ctx,
+			dir:       cliContext.String("directory"),
+			refspec:   refspec,
+			hosts:     resolver.RegistryHostsFromConfig(resolver.Config{}, dockerconfig.NewDockerConfigKeychain(ctx)),
+			resolver:  remote.NewResolver(config.BlobConfig{}, nil),
+			ztocs:     make(map[string]*soci.Ztoc),
+			readers:   make(map[string]*layerReader),
+			inventory: make(map[string]*soci.InventoryEntry),
+			extracted: make(map[string]bool),
+		}
+		defer ex.close()
+		for _, l := range layers {
+			ex.ztocs[l.LayerDigest.String()] = l.Ztoc
+		}
+		for i := range inventory {
+			ex.inventory[inventory[i].Path] = &inventory[i]
+		}
+		return ex.extract(entries)
+	},
+}
+
+// layerReader reads the contents of files of a layer from the registry.
+type layerReader struct {
+	blob remote.Blob
+	sm   *spanmanager.SpanManager
+}
+
+type extractor struct {
+	ctx      context.Context
+	dir      string
+	refspec  reference.Spec
+	hosts    source.RegistryHosts
+	resolver *remote.Resolver
+
+	ztocs     map[string]*soci.Ztoc           // by layer digest
+	readers   map[string]*layerReader         // by layer digest, created on first use
+	inventory map[string]*soci.InventoryEntry // all files of the image by path
+	extracted map[string]bool                 // paths of extracted regular files
+}
+
+func (ex *extractor) extract(entries []soci.InventoryEntry) error {
+	var dirs []*soci.InventoryEntry
+	// hard links are created after all files, since their targets can come later
+	var links []*soci.InventoryEntry
+	for i := range entries {
+		e := &entries[i]
+		target, err := ex.target(e.Path)
+		if err != nil {
+			return err
+		}
+		switch e.Type {
+		case "dir":
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			// the metadata of directories is set last, so that their mode doesn't prevent
+			// creating their contents and creating their contents doesn't change their mtime
+			dirs = append(dirs, e)
+			continue
+		case "reg":
+			if err := ex.writeFile(target, e); err != nil {
+				return err
+			}
+			ex.extracted[e.Path] = true
+		case "symlink":
+			if err := os.Symlink(e.Linkname, target); err != nil {
+				return err
+			}
+		case "hardlink":
+			links = append(links, e)
+			continue
+		case "char", "block", "fifo":
+			mode := uint32(soci.GetFileMode(&e.FileMetadata).Perm())
+			switch e.Type {
+			case "char":
+				mode |= unix.S_IFCHR
+			case "block":
+				mode |= unix.S_IFBLK
+			default:
+				mode |= unix.S_IFIFO
+			}
+			if err := unix.Mknod(target, mode, int(unix.Mkdev(uint32(e.Devmajor), uint32(e.Devminor)))); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: cannot create %s: %v\n", e.Path, err)
+				continue
+			}
+		}
+		if err := setMetadata(target, e); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range links {
+		target, err := ex.target(e.Path)
+		if err != nil {
+			return err
+		}
+		linkPath := path.Clean("/" + e.Linkname)
+		if ex.extracted[linkPath] {
+			if err := os.Link(filepath.Join(ex.dir, linkPath), target); err != nil {
+				return err
+			}
+			continue
+		}
+		// the link target isn't extracted, so extract its contents in place of the link
+		l, ok := ex.inventory[linkPath]
+		if !ok || l.Type != "reg" {
+			fmt.Fprintf(os.Stderr, "warning: cannot find the target %s of hard link %s\n", linkPath, e.Path)
+			continue
+		}
+		if err := ex.writeFile(target, l); err != nil {
+			return err
+		}
+		if err := setMetadata(target, l); err != nil {
+			return err
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target, err := ex.target(dirs[i].Path)
+		if err != nil {
+			return err
+		}
+		if err := setMetadata(target, dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// target returns the path to extract the file at p in the image to. The parent directories are
+// created if needed, and must not be symlinks, so that files are never written outside of ex.dir.
+func (ex *extractor) target(p string) (string, error) {
+	cur := ex.dir
+	parts := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for _, name := range parts[:len(parts)-1] {
+		cur = filepath.Join(cur, name)
+		fi, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			if err := os.Mkdir(cur, 0755); err != nil {
+				return "", err
+			}
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if !fi.IsDir() {
+			return "", fmt.Errorf("cannot extract %s: %s is not a directory", p, cur)
+		}
+	}
+	target := filepath.Join(cur, parts[len(parts)-1])
+	if fi, err := os.Lstat(target); err == nil && !fi.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return "", err
+		}
+	}
+	return target, nil
+}
+
+func (ex *extractor) writeFile(target string, e *soci.InventoryEntry) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if e.UncompressedSize == 0 {
+		return nil
+	}
+	lr, err := ex.layerReader(e)
+	if err != nil {
+		return err
+	}
+	r, err := lr.sm.GetContents(e.UncompressedOffset, e.UncompressedOffset+e.UncompressedSize)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %w", e.Path, err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("cannot write %s: %w", e.Path, err)
+	}
+	return f.Close()
+}
+
+// layerReader returns the reader for the layer of e, resolving its blob on first use.
+func (ex *extractor) layerReader(e *soci.InventoryEntry) (*layerReader, error) {
+	layerDigest := e.LayerDigest.String()
+	if lr, ok := ex.readers[layerDigest]; ok {
+		return lr, nil
+	}
+	ztoc := ex.ztocs[layerDigest]
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    e.LayerDigest,
+		Size:      int64(ztoc.CompressedFileSize),
+	}
+	blob, err := ex.resolver.Resolve(ex.ctx, ex.hosts, ex.refspec, desc, cache.NewMemoryCache())
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve layer %s: %w", layerDigest, err)
+	}
+	sr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
+		return blob.ReadAt(p, offset)
+	}), 0, blob.Size())
+	lr := &layerReader{
+		blob: blob,
+		sm:   spanmanager.New(ztoc, sr, cache.NewMemoryCache()),
+	}
+	ex.readers[layerDigest] = lr
+	return lr, nil
+}
+
+// close closes the blobs of the layers. The span managers are closed by their finalizers.
+func (ex *extractor) close() {
+	for _, lr := range ex.readers {
+		lr.blob.Close()
+	}
+}
+
+// setMetadata sets the mode, owner, modification time and xattrs of an extracted file.
+// Owners are only set when running as root, and xattrs are set on a best effort basis.
+func setMetadata(target string, e *soci.InventoryEntry) error {
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(target, e.UID, e.GID); err != nil {
+			return err
+		}
+	}
+	for k, v := range soci.PAXXattrs(e.Xattrs) {
+		if err := unix.Lsetxattr(target, k, []byte(v), 0); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: cannot set xattr %s of %s: %v\n", k, e.Path, err)
+		}
+	}
+	if e.Type == "symlink" {
+		return unix.Lutimes(target, []unix.Timeval{unix.NsecToTimeval(e.ModTime.UnixNano()), unix.NsecToTimeval(e.ModTime.UnixNano())})
+	}
+	// chmod after chown, since chown can clear setuid and setgid bits
+	if err := os.Chmod(target, soci.GetFileMode(&e.FileMetadata)); err != nil {
+		return err
+	}
+	return os.Chtimes(target, e.ModTime, e.ModTime)
+}
+
+type readerAtFunc func([]byte, int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, offset int64) (int, error) { return f(p, offset) }
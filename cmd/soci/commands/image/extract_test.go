@@ -0,0 +1,79 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package image
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"golang.org/x/sys/unix"
+)
+
+// Tests that only the xattrs in the PAX records of an entry are set on the extracted file.
+func TestSetMetadataXattrs(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(target, nil, 0600); err != nil {
+		t.Fatalf("cannot create file: %v", err)
+	}
+	if err := unix.Lsetxattr(target, "user.probe", []byte("y"), 0); errors.Is(err, unix.ENOTSUP) {
+		t.Skip("user xattrs aren't supported in the temp dir")
+	} else if err != nil {
+		t.Fatalf("cannot set xattr: %v", err)
+	}
+	if err := unix.Lremovexattr(target, "user.probe"); err != nil {
+		t.Fatalf("cannot remove xattr: %v", err)
+	}
+
+	e := &soci.InventoryEntry{
+		Path: "/file",
+		FileMetadata: soci.FileMetadata{
+			Name:    "file",
+			Type:    "reg",
+			Mode:    0644,
+			UID:     os.Geteuid(),
+			GID:     os.Getegid(),
+			ModTime: time.Unix(1000, 0),
+			Xattrs: map[string]string{
+				"SCHILY.xattr.user.foo": "bar",
+				"path":                  "a/long/path/of/the/file",
+			},
+		},
+	}
+	if err := setMetadata(target, e); err != nil {
+		t.Fatalf("cannot set metadata: %v", err)
+	}
+
+	buf := make([]byte, 1024)
+	n, err := unix.Llistxattr(target, buf)
+	if err != nil {
+		t.Fatalf("cannot list xattrs: %v", err)
+	}
+	if names := string(buf[:n]); names != "user.foo\x00" {
+		t.Fatalf("unexpected xattrs %q", names)
+	}
+	n, err = unix.Lgetxattr(target, "user.foo", buf)
+	if err != nil {
+		t.Fatalf("cannot get xattr: %v", err)
+	}
+	if v := string(buf[:n]); v != "bar" {
+		t.Fatalf("unexpected value of user.foo %q", v)
+	}
+}
@@ -24,5 +24,9 @@ var Command = cli.Command{
 	Subcommands: []cli.Command{
 		rpullCommand,
 		listIndicesCommand,
+		lsFilesCommand,
+		findCommand,
+		diffCommand,
+		extractCommand,
 	},
 }
@@ -17,6 +17,7 @@
 package image
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/awslabs/soci-snapshotter/soci"
@@ -48,16 +49,14 @@ var listIndicesCommand = cli.Command{
 			return err
 		}
 
-		indexDescriptors, err := soci.GetIndexDescriptorCollection(ctx, cs, img)
-		if err != nil {
-			return err
-		}
-
-		if len(indexDescriptors) == 0 {
+		indexDesc, err := soci.DefaultIndexDescriptor(ctx, cs, img)
+		if errors.Is(err, soci.ErrNoSociIndex) {
 			return fmt.Errorf("could not find any soci index digests for the provided ref")
+		} else if err != nil {
+			return err
 		}
 
-		fmt.Printf("%v", indexDescriptors[len(indexDescriptors)-1].Digest)
+		fmt.Printf("%v", indexDesc.Digest)
 		return nil
 	},
 }
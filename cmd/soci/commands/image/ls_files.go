@@ -0,0 +1,126 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/urfave/cli"
+)
+
+var lsFilesCommand = cli.Command{
+	Name:      "ls-files",
+	Usage:     "list the files of an image from its ztocs, without fetching its layers",
+	ArgsUsage: "[flags] <ref>",
+	Flags: []cli.Flag{
+		sociIndexDigestFlag,
+	},
+	Action: func(cliContext *cli.Context) error {
+		return listFiles(cliContext, func(*soci.InventoryEntry) bool { return true })
+	},
+}
+
+var findCommand = cli.Command{
+	Name:  "find",
+	Usage: "find the files of an image matching a glob from its ztocs, without fetching its layers",
+	ArgsUsage: "[flags] <ref> <glob>\n\n" +
+		"A glob containing a / is matched against the absolute path of the files, otherwise against their name.",
+	Flags: []cli.Flag{
+		sociIndexDigestFlag,
+	},
+	Action: func(cliContext *cli.Context) error {
+		glob := cliContext.Args().Get(1)
+		if glob == "" {
+			return fmt.Errorf("please provide a glob")
+		}
+		// check the pattern once, so that matching errors can be ignored below
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", glob, err)
+		}
+		matchPath := strings.Contains(glob, "/")
+		return listFiles(cliContext, func(e *soci.InventoryEntry) bool {
+			name := e.Path
+			if !matchPath {
+				name = path.Base(e.Path)
+			}
+			ok, _ := path.Match(glob, name)
+			return ok
+		})
+	},
+}
+
+func listFiles(cliContext *cli.Context, filter func(*soci.InventoryEntry) bool) error {
+	ref := cliContext.Args().First()
+	if ref == "" {
+		return fmt.Errorf("please provide an image reference")
+	}
+
+	client, ctx, cancel, err := commands.NewClient(cliContext)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	layers, err := loadLayerZtocs(ctx, client, ref, cliContext.String(sociIndexDigestFlag.Name))
+	if err != nil {
+		return err
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
+	writer.Write([]byte("MODE\tUID\tGID\tSIZE\tLAYER\tSPANS\tPATH\t\n"))
+	for _, e := range soci.Inventory(layers) {
+		if filter(&e) {
+			writeInventoryEntry(writer, &e)
+		}
+	}
+	writer.Flush()
+	return nil
+}
+
+func writeInventoryEntry(w io.Writer, e *soci.InventoryEntry) {
+	spans := "-"
+	if e.Type == "reg" && e.UncompressedSize > 0 {
+		spans = fmt.Sprintf("%d", e.SpanStart)
+		if e.SpanEnd != e.SpanStart {
+			spans = fmt.Sprintf("%d-%d", e.SpanStart, e.SpanEnd)
+		}
+	}
+	name := e.Path
+	switch e.Type {
+	case "symlink":
+		name = fmt.Sprintf("%s -> %s", e.Path, e.Linkname)
+	case "hardlink":
+		name = fmt.Sprintf("%s link to %s", e.Path, path.Clean("/"+e.Linkname))
+	}
+	w.Write([]byte(fmt.Sprintf(
+		"%s\t%d\t%d\t%d\t%s\t%s\t%s\t\n",
+		soci.GetFileMode(&e.FileMetadata),
+		e.UID,
+		e.GID,
+		e.UncompressedSize,
+		e.LayerDigest,
+		spans,
+		name,
+	)))
+}
@@ -0,0 +1,110 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// sociIndexDigestFlag selects the SOCI index of an image which isn't in the local store yet.
+var sociIndexDigestFlag = cli.StringFlag{
+	Name:  "soci-index-digest",
+	Usage: "digest of the SOCI index to fetch from the registry, instead of the latest local index of the image",
+}
+
+// loadLayerZtocs returns the ztocs of the layers of an image, ordered from the lowest layer.
+// Without an index digest, it uses the latest SOCI index created for the image in containerd.
+// Otherwise it fetches the SOCI index, its ztocs and image manifest from the registry, unless they are
+// in the local stores.
+// Layers aren't fetched in either case.
+func loadLayerZtocs(ctx context.Context, client *containerd.Client, ref, indexDigest string) ([]soci.LayerZtoc, error) {
+	store, err := oci.New(config.SociContentStorePath)
+	if err != nil {
+		return nil, err
+	}
+
+	cs := client.ContentStore()
+	var (
+		index    *soci.SociIndex
+		manifest ocispec.Manifest
+	)
+	if indexDigest != "" {
+		index, err = fs.FetchSociArtifacts(ctx, ref, indexDigest, store)
+		if err != nil {
+			return nil, err
+		}
+		manifest, err = internal.FetchManifest(ctx, cs, ref, index.Subject)
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetch the manifest of SOCI index %s: %w", indexDigest, err)
+		}
+	} else {
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+		indexDesc, err := soci.DefaultIndexDescriptor(ctx, cs, img)
+		if errors.Is(err, soci.ErrNoSociIndex) {
+			return nil, fmt.Errorf("could not find any soci index for %s; use --%s", ref, sociIndexDigestFlag.Name)
+		} else if err != nil {
+			return nil, err
+		}
+		index, err = soci.ReadSociIndex(ctx, indexDesc.Digest, store)
+		if err != nil {
+			return nil, err
+		}
+		manifest, err = images.Manifest(ctx, cs, img.Target, platforms.Default())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if missing := len(manifest.Layers) - len(index.Blobs); missing > 0 {
+		fmt.Fprintf(os.Stderr, "warning: %d layers of %s have no ztoc, their files are not included\n", missing, ref)
+	}
+
+	layers := make([]soci.LayerZtoc, 0, len(index.Blobs))
+	for _, desc := range index.Blobs {
+		rc, err := store.Fetch(ctx, desc)
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetch ztoc %s: %w", desc.Digest, err)
+		}
+		ztoc, err := soci.GetZtoc(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, soci.LayerZtoc{
+			LayerDigest: digest.Digest(desc.Annotations[soci.IndexAnnotationImageLayerDigest]),
+			Ztoc:        ztoc,
+		})
+	}
+	return layers, nil
+}
@@ -28,16 +28,6 @@ import (
 	"github.com/urfave/cli"
 )
 
-func indexFilter(ae *soci.ArtifactEntry) bool {
-	return ae.Type == soci.ArtifactEntryTypeIndex
-}
-
-func originalDigestFilter(digest string) func(*soci.ArtifactEntry) bool {
-	return func(ae *soci.ArtifactEntry) bool {
-		return ae.Type == soci.ArtifactEntryTypeIndex && ae.OriginalDigest == digest
-	}
-}
-
 var listCommand = cli.Command{
 	Name:  "list",
 	Usage: "list indices",
@@ -48,10 +38,9 @@ var listCommand = cli.Command{
 		},
 	},
 	Action: func(cliContext *cli.Context) error {
-		var artifacts []*soci.ArtifactEntry
 		ref := cliContext.String("ref")
 
-		filter := indexFilter
+		var filter soci.IndexFilter
 		client, ctx, cancel, err := commands.NewClient(cliContext)
 		if err != nil {
 			return err
@@ -70,23 +59,18 @@ var listCommand = cli.Command{
 			if err != nil {
 				return err
 			}
-			filter = originalDigestFilter(desc.Digest.String())
+			filter = soci.ManifestDigestFilter(desc.Digest.String())
 		}
 
-		db, err := soci.NewDB()
+		artifacts, err := soci.ListIndices(filter)
 		if err != nil {
 			return err
 		}
-		db.Walk(func(ae *soci.ArtifactEntry) error {
-			if filter(ae) {
-				artifacts = append(artifacts, ae)
-			}
-			return nil
-		})
 
 		writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
 		writer.Write([]byte("DIGEST\tSIZE\tIMAGE REF\tPLATFORM\t\n"))
-		for _, ae := range artifacts {
+		for i := range artifacts {
+			ae := &artifacts[i]
 			imgs, _ := is.List(ctx, fmt.Sprintf("target.digest==%s", ae.ImageDigest))
 			if len(imgs) > 0 {
 				for _, img := range imgs {
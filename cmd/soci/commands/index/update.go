@@ -0,0 +1,116 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+var updateCommand = cli.Command{
+	Name:      "update",
+	Usage:     "add ztocs for more layers to an index",
+	ArgsUsage: "[flags] <index-digest>",
+	Description: `Create a new index from an existing one, reusing its ztocs and building ztocs for the layers
+which have none, or only for the ones of them given with --layers. Layers which already have
+a ztoc keep it. The new index records the index it supersedes, and is preferred over it when
+no index is chosen explicitly.
+The image of the index must be in the content store.`,
+	Flags: append([]cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "layers",
+			Usage: "digest of a layer to build a ztoc for, can be repeated. Default is all the layers without a ztoc",
+		},
+	}, internal.BuildFlags...),
+	Action: func(cliContext *cli.Context) error {
+		indexDigest, err := digest.Parse(cliContext.Args().First())
+		if err != nil {
+			return fmt.Errorf("please provide the digest of an index: %w", err)
+		}
+		opts, err := internal.BuildOptions(cliContext)
+		if err != nil {
+			return err
+		}
+		if layers := cliContext.StringSlice("layers"); len(layers) > 0 {
+			digests := make([]digest.Digest, 0, len(layers))
+			for _, l := range layers {
+				dgst, err := digest.Parse(l)
+				if err != nil {
+					return err
+				}
+				digests = append(digests, dgst)
+			}
+			opts = append(opts, soci.WithLayers(digests...))
+		}
+
+		db, err := soci.NewDB()
+		if err != nil {
+			return err
+		}
+		entry, err := db.GetArtifactEntry(indexDigest.String())
+		if err != nil {
+			return err
+		}
+		if entry.Type != soci.ArtifactEntryTypeIndex {
+			return fmt.Errorf("%s is not an index", indexDigest)
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		is := client.ImageService()
+		imgs, err := is.List(ctx, fmt.Sprintf("target.digest==%s", entry.ImageDigest))
+		if err != nil {
+			return err
+		}
+		if len(imgs) == 0 {
+			return errors.New("the image of the index is not in the content store")
+		}
+
+		blobStore, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return err
+		}
+		cs := client.ContentStore()
+		updated, err := soci.UpdateIndex(ctx, cs, imgs[0], indexDigest,
+			cliContext.Int64("span-size"), blobStore, opts...)
+		if err != nil {
+			return err
+		}
+		if err := internal.PrintZtocs(ctx, cliContext.App.Writer, cs, updated.Index); err != nil {
+			return err
+		}
+		b, err := json.Marshal(updated.Index)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cliContext.App.Writer, "index %s supersedes %s\n", digest.FromBytes(b), indexDigest)
+		return nil
+	},
+}
@@ -0,0 +1,63 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package internal
+
+import (
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/urfave/cli"
+)
+
+const (
+	// BuildToolIdentifier is the build tool recorded in the SOCI indices built by the CLI.
+	BuildToolIdentifier = "AWS SOCI CLI"
+	// BuildToolVersion is the version of BuildToolIdentifier.
+	BuildToolVersion = "0.1"
+)
+
+// BuildFlags are the flags of the commands building SOCI indices.
+var BuildFlags = []cli.Flag{
+	cli.Int64Flag{
+		Name:  "span-size",
+		Usage: "span size of index. Default is 1 MiB",
+		Value: 1 << 20,
+	},
+	cli.Int64Flag{
+		Name:  "min-layer-size",
+		Usage: "The minimum layer size in bytes to build zTOC for. Default is 0.",
+		Value: 0,
+	},
+	cli.StringFlag{
+		Name: "span-strategy",
+		Usage: `how span boundaries are placed: "fixed" starts a new span every span-size bytes, ` +
+			`"file-aligned" places them near file boundaries so that most small files are in a single span. Default is fixed`,
+		Value: string(soci.SpanStrategyFixed),
+	},
+}
+
+// BuildOptions returns the options to build SOCI indices with set by BuildFlags.
+func BuildOptions(cliContext *cli.Context) ([]soci.BuildOption, error) {
+	spanStrategy, err := soci.ParseSpanStrategy(cliContext.String("span-strategy"))
+	if err != nil {
+		return nil, err
+	}
+	return []soci.BuildOption{
+		soci.WithMinLayerSize(cliContext.Int64("min-layer-size")),
+		soci.WithSpanStrategy(spanStrategy),
+		soci.WithBuildToolIdentifier(BuildToolIdentifier),
+		soci.WithBuildToolVersion(BuildToolVersion),
+	}, nil
+}
@@ -0,0 +1,59 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+// FetchManifest returns the image manifest desc of the image ref from the content store cs,
+// or from the registry if it isn't there. cs may be nil to always fetch from the registry.
+func FetchManifest(ctx context.Context, cs content.Store, ref string, desc ocispec.Descriptor) (ocispec.Manifest, error) {
+	var manifest ocispec.Manifest
+	var b []byte
+	err := errdefs.ErrNotFound
+	if cs != nil {
+		b, err = content.ReadBlob(ctx, cs, desc)
+	}
+	if errdefs.IsNotFound(err) {
+		refspec, err := reference.Parse(ref)
+		if err != nil {
+			return manifest, err
+		}
+		repo, err := soci.NewRepository(refspec.Locator, soci.WithKeychain(dockerconfig.DockerCreds))
+		if err != nil {
+			return manifest, err
+		}
+		b, err = orascontent.FetchAll(ctx, repo, desc)
+		if err != nil {
+			return manifest, err
+		}
+	} else if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(b, &manifest)
+	return manifest, err
+}
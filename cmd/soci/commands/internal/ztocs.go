@@ -0,0 +1,53 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/content"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PrintZtocs prints the ztoc of each layer of the image of the SOCI index,
+// or that building it was skipped.
+func PrintZtocs(ctx context.Context, w io.Writer, cs content.Store, index *soci.SociIndex) error {
+	b, err := content.ReadBlob(ctx, cs, index.Subject)
+	if err != nil {
+		return err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return err
+	}
+	ztocs := make(map[string]string, len(index.Blobs))
+	for _, desc := range index.Blobs {
+		ztocs[desc.Annotations[soci.IndexAnnotationImageLayerDigest]] = desc.Digest.String()
+	}
+	for _, l := range manifest.Layers {
+		if ztoc, ok := ztocs[l.Digest.String()]; ok {
+			fmt.Fprintf(w, "layer %s -> ztoc %s\n", l.Digest, ztoc)
+		} else {
+			fmt.Fprintf(w, "layer %s -> ztoc skipped\n", l.Digest)
+		}
+	}
+	return nil
+}
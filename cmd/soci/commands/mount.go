@@ -0,0 +1,305 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/awslabs/soci-snapshotter/cmd/soci/commands/internal"
+	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+const (
+	defaultMountRoot = config.SociSnapshotterRootPath + "mount/"
+	mountStateFile   = "state.json"
+	// layerDigestLabel tells getSources which layer of the image to mount
+	layerDigestLabel = "soci.mount.layer.digest"
+)
+
+// mountState records what `soci mount` mounted, so that `soci umount` can undo it.
+type mountState struct {
+	// Pid is the process serving the FUSE file systems of the layers.
+	Pid int `json:"pid"`
+	// Mountpoint is where the layers are assembled.
+	Mountpoint string `json:"mountpoint"`
+	// Layers are the layer directories, ordered from the lowest layer.
+	Layers []mountedLayer `json:"layers"`
+}
+
+type mountedLayer struct {
+	Path string `json:"path"`
+	// Fuse is set for layers mounted lazily, and unset for layers without a ztoc,
+	// which are unpacked into their directory instead.
+	Fuse bool `json:"fuse"`
+}
+
+var mountRootFlag = cli.StringFlag{
+	Name:  "root",
+	Usage: "directory to keep the layer mounts, caches and state in",
+	Value: defaultMountRoot,
+}
+
+// MountCommand mounts an image read-only without containerd or the snapshotter.
+var MountCommand = cli.Command{
+	Name:      "mount",
+	Usage:     "mount the file system of an image lazily",
+	ArgsUsage: "[flags] <ref> <dir>",
+	Description: `Mount the file system of an image read-only at <dir>, without containerd or the snapshotter.
+
+Each layer with a ztoc in the SOCI index is mounted with FUSE, fetching its contents from the registry
+on demand, and the other layers are unpacked. The layers are assembled with overlayfs at <dir>.
+The command keeps serving the layers until the image is unmounted with "soci umount <dir>", or until
+it is interrupted.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "soci-index-digest",
+			Usage: "digest of the SOCI index of the image",
+		},
+		mountRootFlag,
+		cli.BoolFlag{
+			Name:  "background-fetch",
+			Usage: "fetch the layers in the background, in addition to fetching them on demand",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		ref := cliContext.Args().Get(0)
+		dir := cliContext.Args().Get(1)
+		if ref == "" || dir == "" {
+			return fmt.Errorf("please provide an image reference and a directory to mount it at")
+		}
+		indexDigest := cliContext.String("soci-index-digest")
+		if indexDigest == "" {
+			return fmt.Errorf("please provide the digest of the SOCI index with --soci-index-digest")
+		}
+		refspec, err := reference.Parse(ref)
+		if err != nil {
+			return fmt.Errorf("cannot parse image ref (%s): %w", ref, err)
+		}
+		mountpoint, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		stateDir := mountStateDir(cliContext.String(mountRootFlag.Name), mountpoint)
+		if _, err := os.Stat(filepath.Join(stateDir, mountStateFile)); err == nil {
+			return fmt.Errorf("%s is already mounted", mountpoint)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		store, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return fmt.Errorf("cannot create local store: %w", err)
+		}
+		index, err := fs.FetchSociArtifacts(ctx, ref, indexDigest, store)
+		if err != nil {
+			return err
+		}
+		manifest, err := internal.FetchManifest(ctx, nil, ref, index.Subject)
+		if err != nil {
+			return err
+		}
+		if len(manifest.Layers) == 0 {
+			return fmt.Errorf("image %s has no layers", ref)
+		}
+		ztocLayers := make(map[string]bool)
+		for _, desc := range index.Blobs {
+			ztocLayers[desc.Annotations[soci.IndexAnnotationImageLayerDigest]] = true
+		}
+
+		hosts := resolver.RegistryHostsFromConfig(resolver.Config{}, dockerconfig.NewDockerConfigKeychain(ctx))
+		getSources := func(labels map[string]string) ([]source.Source, error) {
+			for _, l := range manifest.Layers {
+				if l.Digest.String() == labels[layerDigestLabel] {
+					return []source.Source{{Hosts: hosts, Name: refspec, Target: l, Manifest: manifest}}, nil
+				}
+			}
+			return nil, fmt.Errorf("layer %s not found in image", labels[layerDigestLabel])
+		}
+		cfg := config.Config{}
+		cfg.NoPrometheus = true
+		cfg.NoBackgroundFetch = !cliContext.Bool("background-fetch")
+		fsys, err := fs.NewFilesystem(filepath.Join(stateDir, "fs"), cfg, fs.WithGetSources(getSources))
+		if err != nil {
+			return err
+		}
+
+		state := &mountState{Pid: os.Getpid(), Mountpoint: mountpoint}
+		unmountLayers := func() {
+			for _, l := range state.Layers {
+				if l.Fuse {
+					if err := fsys.Unmount(ctx, l.Path); err != nil {
+						fmt.Fprintf(os.Stderr, "warning: cannot unmount %s: %v\n", l.Path, err)
+					}
+				}
+			}
+			os.RemoveAll(stateDir)
+		}
+		for i, l := range manifest.Layers {
+			layerDir := filepath.Join(stateDir, "layers", strconv.Itoa(i))
+			if err := os.MkdirAll(layerDir, 0700); err != nil {
+				unmountLayers()
+				return err
+			}
+			labels := map[string]string{
+				source.TargetRefLabel:             ref,
+				source.TargetSociIndexDigestLabel: indexDigest,
+				layerDigestLabel:                  l.Digest.String(),
+			}
+			lazy := ztocLayers[l.Digest.String()]
+			if lazy {
+				err = fsys.Mount(ctx, layerDir, labels)
+			} else {
+				err = fsys.MountLocal(ctx, layerDir, labels)
+			}
+			if err != nil {
+				unmountLayers()
+				return fmt.Errorf("cannot mount layer %s: %w", l.Digest, err)
+			}
+			state.Layers = append(state.Layers, mountedLayer{Path: layerDir, Fuse: lazy})
+		}
+
+		if err := mountLayers(state.Layers, mountpoint); err != nil {
+			unmountLayers()
+			return fmt.Errorf("cannot mount %s: %w", mountpoint, err)
+		}
+		if err := writeMountState(stateDir, state); err != nil {
+			mount.UnmountAll(mountpoint, 0)
+			unmountLayers()
+			return err
+		}
+		fmt.Printf("mounted %s at %s\n", ref, mountpoint)
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		// the overlay is already unmounted when stopped by `soci umount`
+		if err := mount.UnmountAll(mountpoint, 0); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: cannot unmount %s: %v\n", mountpoint, err)
+		}
+		unmountLayers()
+		return nil
+	},
+}
+
+// UmountCommand unmounts an image mounted with MountCommand.
+var UmountCommand = cli.Command{
+	Name:      "umount",
+	Usage:     "unmount an image mounted with soci mount",
+	ArgsUsage: "[flags] <dir>",
+	Flags:     []cli.Flag{mountRootFlag},
+	Action: func(cliContext *cli.Context) error {
+		dir := cliContext.Args().First()
+		if dir == "" {
+			return fmt.Errorf("please provide the directory to unmount")
+		}
+		mountpoint, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		stateDir := mountStateDir(cliContext.String(mountRootFlag.Name), mountpoint)
+		state, err := readMountState(stateDir)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("%s is not mounted by soci", mountpoint)
+			}
+			return err
+		}
+
+		if err := mount.UnmountAll(state.Mountpoint, 0); err != nil {
+			return fmt.Errorf("cannot unmount %s: %w", state.Mountpoint, err)
+		}
+		// the mounting process unmounts the layers and cleans up when it's stopped
+		if p, err := os.FindProcess(state.Pid); err == nil && p.Signal(syscall.SIGTERM) == nil {
+			return nil
+		}
+		// otherwise it's gone already, so clean up after it
+		for _, l := range state.Layers {
+			if l.Fuse {
+				if err := mount.UnmountAll(l.Path, syscall.MNT_FORCE); err != nil {
+					return fmt.Errorf("cannot unmount layer %s: %w", l.Path, err)
+				}
+			}
+		}
+		return os.RemoveAll(stateDir)
+	},
+}
+
+// mountStateDir returns the directory to keep the layers and the state of the mount at mountpoint in.
+func mountStateDir(root, mountpoint string) string {
+	return filepath.Join(root, digest.FromString(mountpoint).Encoded())
+}
+
+func writeMountState(stateDir string, state *mountState) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(stateDir, mountStateFile), b, 0600)
+}
+
+func readMountState(stateDir string) (*mountState, error) {
+	b, err := os.ReadFile(filepath.Join(stateDir, mountStateFile))
+	if err != nil {
+		return nil, err
+	}
+	var state mountState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("cannot parse mount state of %s: %w", stateDir, err)
+	}
+	return &state, nil
+}
+
+// mountLayers mounts the layer directories read-only at mountpoint. overlayfs needs at
+// least two lower directories without an upper directory, so a single layer is bind mounted.
+func mountLayers(layers []mountedLayer, mountpoint string) error {
+	if len(layers) == 1 {
+		m := mount.Mount{Type: "bind", Source: layers[0].Path, Options: []string{"ro", "rbind"}}
+		return m.Mount(mountpoint)
+	}
+	// lowerdir lists the layers from the uppermost
+	lowerdirs := make([]string, len(layers))
+	for i, l := range layers {
+		lowerdirs[len(layers)-1-i] = l.Path
+	}
+	m := mount.Mount{
+		Type:    "overlay",
+		Source:  "overlay",
+		Options: []string{"lowerdir=" + strings.Join(lowerdirs, ":")},
+	}
+	return m.Mount(mountpoint)
+}
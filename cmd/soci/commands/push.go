@@ -18,19 +18,21 @@ package commands
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
-	oraslib "oras.land/oras-go/v2"
 	"oras.land/oras-go/v2/content/oci"
-	"oras.land/oras-go/v2/registry/remote"
-	"oras.land/oras-go/v2/registry/remote/auth"
 )
 
 // PushCommand is a command to push an image artifacts from local content store to the remote repository
@@ -39,22 +41,44 @@ var PushCommand = cli.Command{
 	Usage:     "push SOCI artifacts to a registry",
 	ArgsUsage: "[flags] <ref>",
 	Description: `Push SOCI artifacts to a registry by image reference.
-If multiple soci indices exist for the given image, the most recent one will be pushed.
+If multiple soci indices exist for the given image, the most recent one will be pushed,
+unless an index is chosen with --index-digest or all of them are pushed with --all.
 
 After pushing the soci artifacts, they should be available in the registry. Soci artifacts will be pushed only
 if they are available in the snapshotter's local content store.
+
+Credentials are taken from --user, or else from the docker config and its credential helpers.
+On registries without the Referrers API, the referrers fallback tag of the image is updated
+to list the pushed indices.
 `,
 	Flags: append(append(append(commands.RegistryFlags, commands.LabelFlag), commands.SnapshotterFlags...),
 		cli.Uint64Flag{
 			Name:  "max-concurrent-uploads",
 			Usage: "Max concurrent uploads. Default is 10",
 			Value: 10,
+		},
+		cli.StringSliceFlag{
+			Name:  "index-digest",
+			Usage: "digest of a SOCI index of the image to push, can be repeated",
+		},
+		cli.BoolFlag{
+			Name:  "all",
+			Usage: "push all SOCI indices of the image",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only print the artifacts which would be pushed",
 		}),
 	Action: func(cliContext *cli.Context) error {
 		ref := cliContext.Args().First()
 		if ref == "" {
 			return fmt.Errorf("please provide an image reference to push")
 		}
+		indexDigests := cliContext.StringSlice("index-digest")
+		all := cliContext.Bool("all")
+		if all && len(indexDigests) > 0 {
+			return fmt.Errorf("--all and --index-digest can't be used together")
+		}
 
 		client, ctx, cancel, err := commands.NewClient(cliContext)
 		if err != nil {
@@ -69,65 +93,103 @@ if they are available in the snapshotter's local content store.
 			return err
 		}
 
-		indexDescriptors, err := soci.GetIndexDescriptorCollection(ctx, cs, img)
+		indexDescriptors, err := selectIndices(ctx, cs, img, indexDigests, all)
 		if err != nil {
 			return err
 		}
 
-		if len(indexDescriptors) == 0 {
-			return fmt.Errorf("could not find any soci indices to push")
-		}
-
-		username := cliContext.String("user")
-		var secret string
-		if i := strings.IndexByte(username, ':'); i > 0 {
-			secret = username[i+1:]
-			username = username[0:i]
-		}
-
 		src, err := oci.New(config.SociContentStorePath)
 		if err != nil {
 			return fmt.Errorf("cannot create OCI local store: %w", err)
 		}
 
-		indexDesc := indexDescriptors[len(indexDescriptors)-1]
 		refspec, err := reference.Parse(ref)
 		if err != nil {
 			return err
 		}
 
-		dst, err := remote.NewRepository(refspec.Locator)
-		if err != nil {
-			return err
+		dryRun := cliContext.Bool("dry-run")
+		opts := []soci.PushOption{
+			soci.WithPlainHTTP(cliContext.Bool("plain-http")),
+			soci.WithMaxConcurrentUploads(int64(cliContext.Uint64("max-concurrent-uploads"))),
+			soci.WithDryRun(dryRun),
+			soci.WithPushProgress(func(event soci.PushEvent, desc ocispec.Descriptor) {
+				switch {
+				case event == soci.PushEventPushing:
+					fmt.Printf("pushing artifact with digest: %v\n", desc.Digest)
+				case event == soci.PushEventPushed && dryRun:
+					fmt.Printf("would push artifact with digest: %v\n", desc.Digest)
+				case event == soci.PushEventPushed:
+					fmt.Printf("successfully pushed artifact with digest: %v\n", desc.Digest)
+				case event == soci.PushEventSkipped:
+					fmt.Printf("skipped artifact with digest: %v\n", desc.Digest)
+				}
+			}),
 		}
-		authClient := auth.DefaultClient
-		authClient.Credential = func(_ context.Context, host string) (auth.Credential, error) {
-			return auth.Credential{
-				Username: username,
-				Password: secret,
-			}, nil
+		if username := cliContext.String("user"); username != "" {
+			var secret string
+			if i := strings.IndexByte(username, ':'); i > 0 {
+				secret = username[i+1:]
+				username = username[0:i]
+			}
+			opts = append(opts, soci.WithCredentials(username, secret))
+		} else {
+			opts = append(opts, soci.WithKeychain(dockerconfig.DockerCreds))
 		}
-		dst.Client = authClient
 
-		options := oraslib.DefaultCopyGraphOptions
-		options.PreCopy = func(_ context.Context, desc ocispec.Descriptor) error {
-			fmt.Printf("pushing artifact with digest: %v\n", desc.Digest)
-			return nil
+		for _, indexDesc := range indexDescriptors {
+			result, err := soci.PushIndex(ctx, src, refspec.Locator, indexDesc, opts...)
+			if err != nil {
+				return fmt.Errorf("cannot push SOCI index %s: %w", indexDesc.Digest, err)
+			}
+			if result.ReferrersTag != "" {
+				fmt.Printf("updated referrers tag %s with index %s\n", result.ReferrersTag, indexDesc.Digest)
+			}
 		}
-		options.PostCopy = func(_ context.Context, desc ocispec.Descriptor) error {
-			fmt.Printf("successfully pushed artifact with digest: %v\n", desc.Digest)
-			return nil
+		return nil
+	},
+}
+
+// selectIndices returns the descriptors of the SOCI indices of img to push: the ones with the
+// given digests, all of them, or else the default one.
+func selectIndices(ctx context.Context, cs content.Store, img images.Image, digests []string, all bool) ([]ocispec.Descriptor, error) {
+	if !all && len(digests) == 0 {
+		indexDesc, err := soci.DefaultIndexDescriptor(ctx, cs, img)
+		if errors.Is(err, soci.ErrNoSociIndex) {
+			return nil, fmt.Errorf("could not find any soci indices to push")
+		} else if err != nil {
+			return nil, err
 		}
-		options.OnCopySkipped = func(ctx context.Context, desc ocispec.Descriptor) error {
-			fmt.Printf("skipped artifact with digest: %v\n", desc.Digest)
-			return nil
+		return []ocispec.Descriptor{indexDesc}, nil
+	}
+
+	indexDescriptors, err := soci.GetIndexDescriptorCollection(ctx, cs, img)
+	if err != nil {
+		return nil, err
+	}
+	if all {
+		if len(indexDescriptors) == 0 {
+			return nil, fmt.Errorf("could not find any soci indices to push")
 		}
-
-		err = oraslib.CopyGraph(context.Background(), src, dst, indexDesc, options)
+		return indexDescriptors, nil
+	}
+	var selected []ocispec.Descriptor
+	for _, d := range digests {
+		dgst, err := digest.Parse(d)
 		if err != nil {
-			return fmt.Errorf("error pushing graph to remote: %w", err)
+			return nil, err
 		}
-
-		return nil
-	},
+		found := false
+		for _, desc := range indexDescriptors {
+			if desc.Digest == dgst {
+				selected = append(selected, desc)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("soci index %s of %s not found", dgst, img.Name)
+		}
+	}
+	return selected, nil
 }
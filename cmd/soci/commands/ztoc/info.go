@@ -52,7 +52,12 @@ var infoCommand = cli.Command{
 		if err != nil {
 			return err
 		}
+		spanStrategy := ztoc.SpanStrategy
+		if spanStrategy == "" {
+			spanStrategy = soci.SpanStrategyFixed
+		}
 		fmt.Printf("version: %s\n", ztoc.Version)
+		fmt.Printf("span strategy: %s\n", spanStrategy)
 		fmt.Printf("build tool: %s\n\n\n", ztoc.BuildToolIdentifier)
 
 		for _, v := range ztoc.Metadata {
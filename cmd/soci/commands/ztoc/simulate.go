@@ -0,0 +1,218 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// simulateCommand estimates the on-demand fetching work for a list of files read by a container,
+// e.g. at startup, so that the span size can be tuned per image.
+var simulateCommand = cli.Command{
+	Name:  "simulate",
+	Usage: "simulate on-demand fetching of the files in a trace for different span sizes",
+	ArgsUsage: "[flags] <trace>\n\n" +
+		"The trace is a file with the path of a file read from the layer on each line.",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "ztoc",
+			Usage: "digest of a ztoc in the local store to simulate with its span size",
+		},
+		cli.StringFlag{
+			Name:  "layer",
+			Usage: "path to a gzip layer to build ztocs for and simulate with each of the span sizes",
+		},
+		cli.StringFlag{
+			Name:  "span-sizes",
+			Usage: "comma separated span sizes in bytes to simulate with --layer",
+			Value: "262144,524288,1048576,2097152,4194304",
+		},
+		cli.StringFlag{
+			Name:  "span-strategy",
+			Usage: `span strategy to build ztocs with --layer, "fixed" or "file-aligned"`,
+			Value: string(soci.SpanStrategyFixed),
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		tracePath := cliContext.Args().First()
+		if tracePath == "" {
+			return errors.New("trace needs to be specified")
+		}
+		trace, err := readTrace(tracePath)
+		if err != nil {
+			return err
+		}
+
+		ztocDigest, layer := cliContext.String("ztoc"), cliContext.String("layer")
+		var ztocs []*soci.Ztoc
+		switch {
+		case ztocDigest != "" && layer != "":
+			return errors.New("only one of --ztoc and --layer can be specified")
+		case ztocDigest != "":
+			ztoc, err := fetchZtoc(cliContext, ztocDigest)
+			if err != nil {
+				return err
+			}
+			ztocs = append(ztocs, ztoc)
+		case layer != "":
+			spanStrategy, err := soci.ParseSpanStrategy(cliContext.String("span-strategy"))
+			if err != nil {
+				return err
+			}
+			spanSizes, err := parseSpanSizes(cliContext.String("span-sizes"))
+			if err != nil {
+				return err
+			}
+			for _, spanSize := range spanSizes {
+				ztoc, err := soci.BuildZtocWithOptions(layer, spanSize, soci.WithSpanStrategy(spanStrategy))
+				if err != nil {
+					return err
+				}
+				ztocs = append(ztocs, ztoc)
+			}
+		default:
+			return errors.New("either --ztoc or --layer needs to be specified")
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
+		writer.Write([]byte("SPAN SIZE\tSPANS\tZTOC SIZE\tRANGE REQUESTS\tFETCHED BYTES\tDECOMPRESSED BYTES\t\n"))
+		for i, ztoc := range ztocs {
+			ranges, missing := traceRanges(ztoc, trace)
+			if i == 0 {
+				for _, name := range missing {
+					fmt.Fprintf(os.Stderr, "warning: %s is not a regular file in the layer\n", name)
+				}
+			}
+			res, err := spanmanager.Simulate(ztoc, ranges)
+			if err != nil {
+				return err
+			}
+			_, ztocDesc, err := soci.NewZtocReader(ztoc)
+			if err != nil {
+				return err
+			}
+			spanSize, err := soci.SpanSize(ztoc)
+			if err != nil {
+				return err
+			}
+			writer.Write([]byte(fmt.Sprintf(
+				"%d\t%d\t%d\t%d\t%d\t%d\t\n",
+				spanSize,
+				ztoc.MaxSpanId+1,
+				ztocDesc.Size,
+				res.RangeRequests,
+				res.FetchedBytes,
+				res.DecompressedBytes,
+			)))
+		}
+		writer.Flush()
+		return nil
+	},
+}
+
+func fetchZtoc(cliContext *cli.Context, d string) (*soci.Ztoc, error) {
+	dgst, err := digest.Parse(d)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := oci.New(config.SociContentStorePath)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cliContext.GlobalDuration("timeout"))
+	defer cancel()
+	reader, err := storage.Fetch(ctx, v1.Descriptor{Digest: dgst})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return soci.GetZtoc(reader)
+}
+
+func parseSpanSizes(s string) ([]int64, error) {
+	var spanSizes []int64
+	for _, f := range strings.Split(s, ",") {
+		spanSize, err := strconv.ParseInt(strings.TrimSpace(f), 10, 64)
+		if err != nil || spanSize <= 0 {
+			return nil, fmt.Errorf("invalid span size %q", f)
+		}
+		spanSizes = append(spanSizes, spanSize)
+	}
+	return spanSizes, nil
+}
+
+// readTrace reads the file paths in a trace, skipping empty lines.
+func readTrace(tracePath string) ([]string, error) {
+	f, err := os.Open(tracePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var trace []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			trace = append(trace, line)
+		}
+	}
+	return trace, scanner.Err()
+}
+
+// traceRanges returns the uncompressed ranges of the files in the trace, following hard links,
+// and the names of the files that aren't regular files in the layer.
+func traceRanges(ztoc *soci.Ztoc, trace []string) ([]spanmanager.Range, []string) {
+	files := make(map[string]soci.FileMetadata, len(ztoc.Metadata))
+	for _, m := range ztoc.Metadata {
+		files[cleanPath(m.Name)] = m
+	}
+	var (
+		ranges  []spanmanager.Range
+		missing []string
+	)
+	for _, name := range trace {
+		m, ok := files[cleanPath(name)]
+		if ok && m.Type == "hardlink" {
+			m, ok = files[cleanPath(m.Linkname)]
+		}
+		if !ok || m.Type != "reg" {
+			missing = append(missing, name)
+			continue
+		}
+		ranges = append(ranges, spanmanager.Range{Start: m.UncompressedOffset, End: m.UncompressedOffset + m.UncompressedSize})
+	}
+	return ranges, missing
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
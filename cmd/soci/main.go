@@ -78,7 +78,13 @@ func main() {
 		index.Command,
 		ztoc.Command,
 		commands.CreateCommand,
+		commands.ConvertCommand,
 		commands.PushCommand,
+		commands.MountCommand,
+		commands.UmountCommand,
+		commands.FsckCommand,
+		commands.CopyCommand,
+		commands.AutoIndexCommand,
 		run.Command,
 	}
 
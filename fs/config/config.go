@@ -63,13 +63,31 @@ type Config struct {
 	MaxConcurrency      int64  `toml:"max_concurrency"`
 	NoPrometheus        bool   `toml:"no_prometheus"`
 
+	// ReadaheadSpans is the number of spans fetched ahead in the background when a file is read
+	// sequentially. Default is 8. A negative value disables readahead.
+	ReadaheadSpans int `toml:"readahead_spans"`
+
+	// GraduateFetchedLayers unpacks the layers into local directories once they're fully fetched.
+	// New containers use the directories instead of the FUSE mounts of the layers, which are
+	// unmounted once the containers using them exit. Ignored if NoBackgroundFetch is set.
+	GraduateFetchedLayers bool `toml:"graduate_fetched_layers"`
+
 	// BlobConfig is config for layer blob management.
 	BlobConfig `toml:"blob"`
 
 	// DirectoryCacheConfig is config for directory-based cache.
 	DirectoryCacheConfig `toml:"directory_cache"`
 
+	// SpanCacheConfig is config for caching the spans of the layers.
+	SpanCacheConfig `toml:"span_cache"`
+
+	// SpanRetryConfig is config for recovering from failures to fetch the spans of the layers.
+	SpanRetryConfig `toml:"span_retry"`
+
 	FuseConfig `toml:"fuse"`
+
+	// LocalZtocConfig is config for building ztocs of layers which are unpacked locally.
+	LocalZtocConfig `toml:"local_ztoc"`
 }
 
 type BlobConfig struct {
@@ -90,6 +108,37 @@ type DirectoryCacheConfig struct {
 	MaxCacheFds      int  `toml:"max_cache_fds"`
 	SyncAdd          bool `toml:"sync_add"`
 	Direct           bool `toml:"direct" default:"true"`
+
+	// MaxDiskUsage is the maximum size in bytes of the span and http caches of all layers on the disk.
+	// The least recently used contents are evicted when the caches grow larger. Default is unlimited.
+	MaxDiskUsage int64 `toml:"max_disk_usage"`
+}
+
+type SpanCacheConfig struct {
+	// Mode is how the spans are stored in the cache: "uncompressed" (default) once they're read,
+	// "compressed" to keep them compressed as they're fetched, or "zstd" to re-compress them with zstd.
+	// The compressed modes make the cache smaller, at the cost of uncompressing the spans on reads.
+	Mode string `toml:"mode"`
+
+	// HotSpans is the number of recently used spans kept uncompressed in memory with the
+	// compressed modes. Default is 16.
+	HotSpans int `toml:"hot_spans"`
+}
+
+type SpanRetryConfig struct {
+	// MaxRetries is the number of times fetching a span is retried from the registry and each
+	// of its mirrors. Default is 2. A negative value disables retries.
+	MaxRetries  int `toml:"max_retries"`
+	MinWaitMSec int `toml:"min_wait_msec"`
+	MaxWaitMSec int `toml:"max_wait_msec"`
+
+	// QuarantineFailures is the number of fetches in a row in which a span may fail verification
+	// before it's quarantined. A host failing verification isn't retried. Reads of a quarantined span fail without fetching it. Default is 3.
+	// A negative value disables quarantine.
+	QuarantineFailures int `toml:"quarantine_failures"`
+
+	// QuarantineSec is how long a span is quarantined, in seconds. Default is 300.
+	QuarantineSec int64 `toml:"quarantine_sec"`
 }
 
 type FuseConfig struct {
@@ -98,4 +147,35 @@ type FuseConfig struct {
 
 	// EntryTimeout defines TTL for directory, name lookup in seconds.
 	EntryTimeout int64 `toml:"entry_timeout"`
+
+	// NegativeTimeout defines TTL for the lookups of names which don't exist, in seconds.
+	// Default is the same as EntryTimeout. A negative value disables caching them.
+	NegativeTimeout int64 `toml:"negative_timeout"`
+
+	// DisableKeepCache makes the kernel drop the page cache of a file when it's opened.
+	// The contents of the layers never change, so the page cache is kept by default.
+	DisableKeepCache bool `toml:"disable_keep_cache"`
+
+	// MaxReadAhead is the maximum size in bytes of the kernel readahead. Default is the kernel's.
+	MaxReadAhead int `toml:"max_read_ahead"`
+
+	// MaxBackground is the maximum number of asynchronous requests, e.g. readahead, the kernel
+	// sends to the filesystem at once. Default is the kernel's.
+	MaxBackground int `toml:"max_background"`
+
+	// MaxWrite is the maximum size in bytes of a request, which also bounds the size of reads.
+	// Default is 64 KiB, and the kernel's limit caps it.
+	MaxWrite int `toml:"max_write"`
+}
+
+type LocalZtocConfig struct {
+	// Enable builds a ztoc in the background for each layer which is downloaded and unpacked
+	// because it has no ztoc, so that later mounts of the layer on this node are lazily loaded.
+	Enable bool `toml:"enable"`
+
+	// SpanSize is the span size of the built ztocs in bytes. Default is 1 MiB.
+	SpanSize int64 `toml:"span_size"`
+
+	// MinLayerSize is the minimum layer size in bytes to build a ztoc for.
+	MinLayerSize int64 `toml:"min_layer_size"`
 }
@@ -128,6 +128,11 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.F
 		entryTimeout = defaultFuseTimeout
 	}
 
+	negativeTimeout := time.Duration(cfg.FuseConfig.NegativeTimeout) * time.Second
+	if negativeTimeout == 0 {
+		negativeTimeout = entryTimeout
+	}
+
 	metadataStore := fsOpts.metadataStore
 
 	getSources := fsOpts.getSources
@@ -169,8 +174,13 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.F
 		metricsController:     c,
 		attrTimeout:           attrTimeout,
 		entryTimeout:          entryTimeout,
+		negativeTimeout:       negativeTimeout,
+		maxReadAhead:          cfg.FuseConfig.MaxReadAhead,
+		maxBackground:         cfg.FuseConfig.MaxBackground,
+		maxWrite:              cfg.FuseConfig.MaxWrite,
 		imageLayerToSociDesc:  make(map[string]ocispec.Descriptor),
 		orasStore:             store,
+		localZtoc:             cfg.LocalZtocConfig,
 	}, nil
 }
 
@@ -187,10 +197,16 @@ type filesystem struct {
 	metricsController     *layermetrics.Controller
 	attrTimeout           time.Duration
 	entryTimeout          time.Duration
+	negativeTimeout       time.Duration
+	maxReadAhead          int
+	maxBackground         int
+	maxWrite              int
 	sociIndex             *soci.SociIndex
 	imageLayerToSociDesc  map[string]ocispec.Descriptor
 	loadIndexOnce         sync.Once
 	orasStore             orascontent.Storage
+	localZtoc             config.LocalZtocConfig
+	localZtocBuilds       sync.Map // digests of the layers whose ztocs are being built
 }
 
 func (fs *filesystem) fetchSociArtifacts(ctx context.Context, imageRef, indexDigest string) error {
@@ -247,6 +263,9 @@ func (fs *filesystem) MountLocal(ctx context.Context, mountpoint string, labels
 	if err != nil {
 		return fmt.Errorf("cannot unpack the layer: %w", err)
 	}
+	if fs.localZtoc.Enable {
+		fs.buildLocalZtoc(ctx, desc)
+	}
 
 	return nil
 }
@@ -262,8 +281,9 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	defer fs.backgroundTaskManager.DonePrioritizedTask()
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mountpoint))
 
+	// Without a SOCI index, the layers can still be lazily loaded with ztocs built locally.
 	sociIndexDigest, ok := labels[source.TargetSociIndexDigestLabel]
-	if !ok {
+	if !ok && !fs.localZtoc.Enable {
 		return fmt.Errorf("unable to get soci index digest from labels")
 	}
 	imageRef, ok := labels[source.TargetRefLabel]
@@ -271,9 +291,11 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		return fmt.Errorf("unable to get image ref from labels")
 	}
 
-	err := fs.fetchSociArtifacts(ctx, imageRef, sociIndexDigest)
-	if err != nil {
-		return fmt.Errorf("unable to fetch SOCI artifacts: %w", err)
+	if sociIndexDigest != "" {
+		err := fs.fetchSociArtifacts(ctx, imageRef, sociIndexDigest)
+		if err != nil {
+			return fmt.Errorf("unable to fetch SOCI artifacts: %w", err)
+		}
 	}
 
 	// Get source information of this layer.
@@ -292,10 +314,7 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	go func() {
 		rErr := fmt.Errorf("failed to resolve target")
 		for _, s := range src {
-			sociDesc := ocispec.Descriptor{}
-			if desc, ok := fs.imageLayerToSociDesc[s.Target.Digest.String()]; ok {
-				sociDesc = desc
-			}
+			sociDesc := fs.sociDesc(ctx, s.Target.Digest.String())
 
 			l, err := fs.resolver.Resolve(ctx, s.Hosts, s.Name, s.Target, sociDesc)
 			if err == nil {
@@ -315,10 +334,7 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		go func() {
 			// Avoids to get canceled by client.
 			ctx := log.WithLogger(context.Background(), log.G(ctx).WithField("mountpoint", mountpoint))
-			sociDesc := ocispec.Descriptor{}
-			if descriptor, ok := fs.imageLayerToSociDesc[desc.Digest.String()]; ok {
-				sociDesc = descriptor
-			}
+			sociDesc := fs.sociDesc(ctx, desc.Digest.String())
 			l, err := fs.resolver.Resolve(ctx, preResolve.Hosts, preResolve.Name, desc, sociDesc)
 			if err != nil {
 				log.G(ctx).WithError(err).Debug("failed to pre-resolve")
@@ -374,15 +390,24 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 
 	// mount the node to the specified mountpoint
 	// TODO: bind mount the state directory as a read-only fs on snapshotter's side
-	rawFS := fusefs.NewNodeFS(node, &fusefs.Options{
+	fuseOpts := &fusefs.Options{
 		AttrTimeout:     &fs.attrTimeout,
 		EntryTimeout:    &fs.entryTimeout,
 		NullPermissions: true,
-	})
+	}
+	if fs.negativeTimeout > 0 {
+		fuseOpts.NegativeTimeout = &fs.negativeTimeout
+	}
+	rawFS := fusefs.NewNodeFS(node, fuseOpts)
+	// READDIRPLUS is negotiated with the kernel when it supports it, so the entries of a
+	// directory are looked up while it's read instead of with a request per entry.
 	mountOpts := &fuse.MountOptions{
-		AllowOther: true,   // allow users other than root&mounter to access fs
-		FsName:     "soci", // name this filesystem as "soci"
-		Debug:      fs.debug,
+		AllowOther:    true,   // allow users other than root&mounter to access fs
+		FsName:        "soci", // name this filesystem as "soci"
+		Debug:         fs.debug,
+		MaxReadAhead:  fs.maxReadAhead,
+		MaxBackground: fs.maxBackground,
+		MaxWrite:      fs.maxWrite,
 	}
 	if _, err := exec.LookPath(fusermountBin); err == nil {
 		mountOpts.Options = []string{"suid"} // option for fusermount; allow setuid inside container
@@ -479,6 +504,21 @@ func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 	return syscall.Unmount(mountpoint, syscall.MNT_FORCE)
 }
 
+// Graduate waits until the layer mounted at mountpoint is fully fetched, and unpacks it into dir.
+// The layers are graduated only when they're fetched in background.
+func (fs *filesystem) Graduate(ctx context.Context, mountpoint, dir string) error {
+	if fs.noBackgroundFetch {
+		return fmt.Errorf("layers aren't graduated without background fetch")
+	}
+	fs.layerMu.Lock()
+	l, ok := fs.layer[mountpoint]
+	fs.layerMu.Unlock()
+	if !ok {
+		return fmt.Errorf("specified path %q isn't a mountpoint", mountpoint)
+	}
+	return l.Graduate(ctx, dir)
+}
+
 func (fs *filesystem) backgroundFetch(ctx context.Context, l layer.Layer, start time.Time) {
 	// Fetch whole layer aggressively in background.
 	if !fs.noBackgroundFetch {
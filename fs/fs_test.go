@@ -77,8 +77,30 @@ func TestCheck(t *testing.T) {
 	}
 }
 
+func TestGraduate(t *testing.T) {
+	bl := &breakableLayer{success: true}
+	fs := &filesystem{
+		layer: map[string]layer.Layer{
+			"test": bl,
+		},
+		noBackgroundFetch: true,
+	}
+	if err := fs.Graduate(context.TODO(), "test", t.TempDir()); err == nil || bl.graduated {
+		t.Errorf("layer was graduated without background fetch")
+	}
+
+	fs.noBackgroundFetch = false
+	if err := fs.Graduate(context.TODO(), "test", t.TempDir()); err != nil || !bl.graduated {
+		t.Errorf("layer wasn't graduated: %v", err)
+	}
+	if err := fs.Graduate(context.TODO(), "unknown", t.TempDir()); err == nil {
+		t.Errorf("layer which isn't mounted was graduated")
+	}
+}
+
 type breakableLayer struct {
-	success bool
+	success   bool
+	graduated bool
 }
 
 func (l *breakableLayer) Info() layer.Info                                    { return layer.Info{} }
@@ -93,6 +115,13 @@ func (l *breakableLayer) Check() error {
 	}
 	return nil
 }
+func (l *breakableLayer) Graduate(context.Context, string) error {
+	if !l.success {
+		return fmt.Errorf("failed")
+	}
+	l.graduated = true
+	return nil
+}
 func (l *breakableLayer) Refresh(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
 	if !l.success {
 		return fmt.Errorf("failed")
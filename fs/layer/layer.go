@@ -39,6 +39,7 @@
 package layer
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"fmt"
@@ -60,8 +61,10 @@ import (
 	"github.com/awslabs/soci-snapshotter/task"
 	"github.com/awslabs/soci-snapshotter/util/lrucache"
 	"github.com/awslabs/soci-snapshotter/util/namedmutex"
+	"github.com/containerd/containerd/archive"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -72,9 +75,17 @@ import (
 
 const (
 	defaultResolveResultEntry = 30
+	defaultReadaheadSpans     = 8
+	defaultHotSpans           = 16
+	defaultSpanMaxRetries     = 2
+	defaultSpanMinWaitMSec    = 100
+	defaultSpanMaxWaitMSec    = 1000
+	defaultQuarantineFailures = 3
+	defaultQuarantineSec      = 300
 	defaultMaxLRUCacheEntry   = 10
 	defaultMaxCacheFds        = 10
 	memoryCacheType           = "memory"
+	graduateBufferSize        = 1 << 20
 )
 
 // Layer represents a layer.
@@ -106,6 +117,10 @@ type Layer interface {
 	// Fetching contents is done as a background task.
 	BackgroundFetch() error
 
+	// Graduate waits until the entire layer contents are fetched by BackgroundFetch, and unpacks
+	// them into dir, so that the directory can be used instead of mounting this layer.
+	Graduate(ctx context.Context, dir string) error
+
 	// Done releases the reference to this layer. The resources related to this layer will be
 	// discarded sooner or later. Queries after calling this function won't be serviced.
 	Done()
@@ -132,6 +147,7 @@ type Resolver struct {
 	config                config.Config
 	metadataStore         metadata.Store
 	artifactStore         content.Storage
+	cacheQuota            *cache.DiskQuota
 }
 
 // NewResolver returns a new layer resolver.
@@ -167,6 +183,22 @@ func NewResolver(root string, backgroundTaskManager *task.BackgroundTaskManager,
 		return nil, err
 	}
 
+	switch spanmanager.CacheMode(cfg.SpanCacheConfig.Mode) {
+	case "", spanmanager.CacheUncompressed, spanmanager.CacheCompressed, spanmanager.CacheZstd:
+	default:
+		return nil, fmt.Errorf("unknown span cache mode %q", cfg.SpanCacheConfig.Mode)
+	}
+
+	// cacheQuota bounds the size of the span caches of all layers on the disk.
+	cacheQuota := cache.NewDiskQuota(cfg.DirectoryCacheConfig.MaxDiskUsage)
+	cacheQuota.OnUsage = commonmetrics.SetCacheUsage
+	cacheQuota.OnEvicted = func(path string, size int64) {
+		commonmetrics.AddCacheEvictedBytes(size)
+	}
+	if err := cleanupCaches(context.Background(), root, cacheQuota, artifactStore); err != nil {
+		return nil, err
+	}
+
 	return &Resolver{
 		rootDir:               root,
 		resolver:              remote.NewResolver(cfg.BlobConfig, resolveHandlers),
@@ -177,14 +209,86 @@ func NewResolver(root string, backgroundTaskManager *task.BackgroundTaskManager,
 		resolveLock:           new(namedmutex.NamedMutex),
 		metadataStore:         metadataStore,
 		artifactStore:         artifactStore,
+		cacheQuota:            cacheQuota,
 	}, nil
 }
 
-func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache, error) {
+// cleanupCaches removes the caches left by the previous runs which can't be used anymore, and
+// accounts the span caches kept across restarts in the quota.
+func cleanupCaches(ctx context.Context, root string, quota *cache.DiskQuota, artifactStore content.Storage) error {
+	// http caches were created in unique directories, which are orphaned after a restart.
+	if err := os.RemoveAll(filepath.Join(root, "httpcache")); err != nil {
+		return errors.Wrapf(err, "failed to clean up http caches")
+	}
+	if err := pruneSpanCaches(ctx, filepath.Join(root, "spancache"), artifactStore); err != nil {
+		return errors.Wrapf(err, "failed to clean up span caches")
+	}
+	if err := quota.Load(filepath.Join(root, "spancache")); err != nil {
+		return errors.Wrapf(err, "failed to load span caches")
+	}
+	return nil
+}
+
+// pruneSpanCaches removes the span caches in root, which are kept in `<layer>/<ztoc>/<mode>`
+// directories, whose ztocs aren't in the artifact store anymore. The layers of these ztocs
+// can't be mounted with them, so their caches would never be used again.
+func pruneSpanCaches(ctx context.Context, root string, artifactStore content.Storage) error {
+	layers, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, l := range layers {
+		layerDir := filepath.Join(root, l.Name())
+		if !l.IsDir() {
+			if err := os.Remove(layerDir); err != nil {
+				return err
+			}
+			continue
+		}
+		ztocs, err := os.ReadDir(layerDir)
+		if err != nil {
+			return err
+		}
+		orphaned := 0
+		for _, z := range ztocs {
+			dgst := digest.NewDigestFromEncoded(digest.SHA256, z.Name())
+			if dgst.Validate() == nil {
+				exists, err := artifactStore.Exists(ctx, ocispec.Descriptor{Digest: dgst})
+				if err != nil {
+					return err
+				}
+				if exists {
+					continue
+				}
+			}
+			if err := os.RemoveAll(filepath.Join(layerDir, z.Name())); err != nil {
+				return err
+			}
+			log.G(ctx).WithField("layer", l.Name()).WithField("ztoc", z.Name()).Debug("removed orphaned span cache")
+			orphaned++
+		}
+		if orphaned == len(ztocs) {
+			if err := os.Remove(layerDir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newSpanCache creates the cache of the spans of a layer, which is kept in the directory
+// cachePath across restarts for directory caches.
+func newSpanCache(cachePath string, cacheType string, cfg config.Config, quota *cache.DiskQuota) (cache.BlobCache, error) {
 	if cacheType == memoryCacheType {
 		return cache.NewMemoryCache(), nil
 	}
+	return newDirectoryCache(cachePath, cfg, true, quota)
+}
 
+func newDirectoryCache(cachePath string, cfg config.Config, persistent bool, quota *cache.DiskQuota) (cache.BlobCache, error) {
 	dcc := cfg.DirectoryCacheConfig
 	maxDataEntry := dcc.MaxLRUCacheEntry
 	if maxDataEntry == 0 {
@@ -208,29 +312,82 @@ func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache
 	fCache.OnEvicted = func(key string, value interface{}) {
 		value.(*os.File).Close()
 	}
-	// create a cache on an unique directory
-	if err := os.MkdirAll(root, 0700); err != nil {
-		return nil, err
-	}
-	cachePath, err := os.MkdirTemp(root, "")
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to initialize directory cache")
-	}
 	return cache.NewDirectoryCache(
 		cachePath,
 		cache.DirectoryCacheConfig{
-			SyncAdd:   dcc.SyncAdd,
-			DataCache: dCache,
-			FdCache:   fCache,
-			BufPool:   bufPool,
-			Direct:    dcc.Direct,
+			SyncAdd:    dcc.SyncAdd,
+			DataCache:  dCache,
+			FdCache:    fCache,
+			BufPool:    bufPool,
+			Direct:     dcc.Direct,
+			Persistent: persistent,
+			Quota:      quota,
 		},
 	)
 }
 
+// spanManagerOptions returns the options of the span managers of the layers.
+func spanManagerOptions(cfg config.SpanCacheConfig) []spanmanager.Option {
+	opts := []spanmanager.Option{spanmanager.WithCacheOpts(cache.Direct())}
+	if cfg.Mode != "" {
+		hotSpans := cfg.HotSpans
+		if hotSpans == 0 {
+			hotSpans = defaultHotSpans
+		}
+		opts = append(opts, spanmanager.WithCacheMode(spanmanager.CacheMode(cfg.Mode), hotSpans))
+	}
+	return opts
+}
+
+// spanRetryOptions returns the options of the span manager of the layer dgst, to recover from
+// failures to fetch its spans.
+func spanRetryOptions(cfg config.SpanRetryConfig, dgst digest.Digest) []spanmanager.Option {
+	maxRetries := cfg.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultSpanMaxRetries
+	} else if maxRetries < 0 {
+		maxRetries = 0
+	}
+	minWait := cfg.MinWaitMSec
+	if minWait == 0 {
+		minWait = defaultSpanMinWaitMSec
+	}
+	maxWait := cfg.MaxWaitMSec
+	if maxWait == 0 {
+		maxWait = defaultSpanMaxWaitMSec
+	}
+	quarantineFailures := cfg.QuarantineFailures
+	if quarantineFailures == 0 {
+		quarantineFailures = defaultQuarantineFailures
+	}
+	quarantineSec := cfg.QuarantineSec
+	if quarantineSec == 0 {
+		quarantineSec = defaultQuarantineSec
+	}
+	opts := []spanmanager.Option{
+		spanmanager.WithRetries(maxRetries, time.Duration(minWait)*time.Millisecond, time.Duration(maxWait)*time.Millisecond),
+		spanmanager.WithFailureHandler(func(spanId soci.SpanId, err error) {
+			if errors.Is(err, spanmanager.ErrSpanQuarantined) {
+				commonmetrics.IncOperationCount(commonmetrics.SpanQuarantineCount, dgst)
+				log.L.WithField("digest", dgst).Warnf("quarantined span %d", spanId)
+				return
+			}
+			commonmetrics.IncOperationCount(commonmetrics.SpanFetchFailureCount, dgst)
+			log.L.WithField("digest", dgst).WithError(err).Debugf("failed to fetch span %d", spanId)
+		}),
+	}
+	if quarantineFailures > 0 {
+		opts = append(opts, spanmanager.WithQuarantine(quarantineFailures, time.Duration(quarantineSec)*time.Second))
+	}
+	return opts
+}
+
 // Resolve resolves a layer based on the passed layer blob information.
+// Layers are keyed by their content and ztoc, so that a layer referenced by several images is
+// resolved once, and shares its metadata and caches across the references. The layer fetches
+// its contents with the registry hosts and credentials of the reference which resolved it last.
 func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc, sociDesc ocispec.Descriptor, metadataOpts ...metadata.Option) (_ Layer, retErr error) {
-	name := refspec.String() + "/" + desc.Digest.String()
+	name := desc.Digest.String() + "/" + sociDesc.Digest.String()
 
 	// Wait if resolving this layer is already running. The result
 	// can hopefully get from the LRU cache.
@@ -246,6 +403,14 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	if ok {
 		if l := c.(*layer); l.Check() == nil {
 			log.G(ctx).Debugf("hit layer cache %q", name)
+			if err := l.blob.Blob.(*sharedBlob).use(ctx, hosts, refspec, desc); err != nil {
+				done()
+				return nil, errors.Wrapf(err, "failed to use the layer with %q", refspec)
+			}
+			if err := l.addMirrors(hosts, refspec); err != nil {
+				done()
+				return nil, errors.Wrap(err, "failed to resolve the mirrors")
+			}
 			return &layerRef{l, done}, nil
 		}
 		// Cached layer is invalid
@@ -268,7 +433,13 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 		}
 	}()
 
-	spanCache, err := newCache(filepath.Join(r.rootDir, "spancache"), r.config.FSCacheType, r.config)
+	// The spans are cached by layer and ztoc, since the spans of a layer depend on its ztoc,
+	// and by cache mode, since the spans are encoded differently with each mode.
+	spanCacheMode := r.config.SpanCacheConfig.Mode
+	if spanCacheMode == "" {
+		spanCacheMode = string(spanmanager.CacheUncompressed)
+	}
+	spanCache, err := newSpanCache(filepath.Join(r.rootDir, "spancache", desc.Digest.Encoded(), sociDesc.Digest.Encoded(), spanCacheMode), r.config.FSCacheType, r.config, r.cacheQuota)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create span manager cache")
 	}
@@ -313,10 +484,12 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	// Each file's read operation is a prioritized task and all background tasks
 	// will be stopped during the execution so this can avoid being disturbed for
 	// NW traffic by background tasks.
+	// The spans are read as a whole and cached by the span manager, so they aren't
+	// fetched in chunks nor cached by the blob.
 	sr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (n int, err error) {
 		r.backgroundTaskManager.DoPrioritizedTask()
 		defer r.backgroundTaskManager.DonePrioritizedTask()
-		return blobR.ReadAt(p, offset)
+		return blobR.ReadAt(p, offset, remote.WithoutCache())
 	}), 0, blobR.Size())
 	// define telemetry hooks to measure latency metrics for the metadata store
 	telemetry := metadata.Telemetry{
@@ -330,8 +503,27 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	}
 	log.G(ctx).Debugf("[Resolver.Resolve]Initialized metadata store for layer sha=%v", desc.Digest)
 
-	spanManager := spanmanager.New(ztoc, sr, spanCache, cache.Direct())
-	vr, err := reader.NewReader(meta, desc.Digest, spanManager)
+	// The spans which can't be fetched from the registry are fetched from its mirrors,
+	// i.e. the other hosts of the references which use the layer.
+	mirrors, err := r.resolveMirrors(hosts, refspec, desc)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to resolve the mirrors")
+	}
+	var mirrorReaders []*io.SectionReader
+	for _, m := range mirrors {
+		mirrorReaders = append(mirrorReaders, io.NewSectionReader(m, 0, blobR.Size()))
+	}
+	spanManagerOpts := append(spanManagerOptions(r.config.SpanCacheConfig), spanRetryOptions(r.config.SpanRetryConfig, desc.Digest)...)
+	spanManagerOpts = append(spanManagerOpts, spanmanager.WithMirrors(mirrorReaders...))
+	spanManager := spanmanager.New(ztoc, sr, spanCache, spanManagerOpts...)
+	if n := spanManager.Restore(); n > 0 {
+		log.G(ctx).Debugf("restored %d spans from the span cache", n)
+	}
+	readaheadSpans := r.config.ReadaheadSpans
+	if readaheadSpans == 0 {
+		readaheadSpans = defaultReadaheadSpans
+	}
+	vr, err := reader.NewReader(meta, desc.Digest, spanManager, reader.WithReadahead(readaheadSpans))
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to read layer")
 	}
@@ -340,7 +532,7 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	prefetcher := newPrefetcher(pr, spanManager)
 
 	// Combine layer information together and cache it.
-	l := newLayer(r, desc, blobR, vr, prefetcher)
+	l := newLayer(r, desc, blobR, vr, prefetcher, mirrors)
 	r.layerCacheMu.Lock()
 	cachedL, done2, added := r.layerCache.Add(name, l)
 	r.layerCacheMu.Unlock()
@@ -353,15 +545,20 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 }
 
 // resolveBlob resolves a blob based on the passed layer blob information.
-func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (_ *blobRef, retErr error) {
-	name := refspec.String() + "/" + desc.Digest.String()
+// Blobs are keyed by their content, and shared across the references to them.
+func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (*blobRef, error) {
+	name := desc.Digest.String()
 
 	// Try to retrieve the blob from the underlying LRU cache.
 	r.blobCacheMu.Lock()
 	c, done, ok := r.blobCache.Get(name)
 	r.blobCacheMu.Unlock()
 	if ok {
-		if blob := c.(remote.Blob); blob.Check() == nil {
+		if blob := c.(*sharedBlob); blob.Check() == nil {
+			if err := blob.use(ctx, hosts, refspec, desc); err != nil {
+				done()
+				return nil, err
+			}
 			return &blobRef{blob, done}, nil
 		}
 		// invalid blob. discard this.
@@ -371,28 +568,163 @@ func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts,
 		r.blobCacheMu.Unlock()
 	}
 
-	httpCache, err := newCache(filepath.Join(r.rootDir, "httpcache"), r.config.HTTPCacheType, r.config)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to create http cache")
-	}
-	defer func() {
-		if retErr != nil {
-			httpCache.Close()
-		}
-	}()
-
-	// Resolve the blob and cache the result.
-	b, err := r.resolver.Resolve(ctx, hosts, refspec, desc, httpCache)
+	// Resolve the blob and cache the result. The blob isn't given a chunk cache because
+	// its spans are only read without it, and cached by the span manager.
+	b, err := r.resolver.Resolve(ctx, hosts, refspec, desc, cache.NewNopCache())
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to resolve the source")
 	}
 	r.blobCacheMu.Lock()
-	cachedB, done, added := r.blobCache.Add(name, b)
+	cachedB, done, added := r.blobCache.Add(name, newSharedBlob(b, hosts, refspec, desc))
 	r.blobCacheMu.Unlock()
 	if !added {
 		b.Close() // blob already exists in the cache. discard this.
 	}
-	return &blobRef{cachedB.(remote.Blob), done}, nil
+	return &blobRef{cachedB.(*sharedBlob), done}, nil
+}
+
+// resolveMirrors returns the blobs of desc on the hosts of refspec other than the first one.
+func (r *Resolver) resolveMirrors(hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) ([]*mirrorBlob, error) {
+	regHosts, err := hosts(refspec)
+	if err != nil {
+		return nil, err
+	}
+	var mirrors []*mirrorBlob
+	for i := 1; i < len(regHosts); i++ {
+		mirrors = append(mirrors, &mirrorBlob{resolver: r.resolver, host: regHosts[i], refspec: refspec, desc: desc})
+	}
+	return mirrors, nil
+}
+
+// mirrorBlob is a blob on a single registry host. The blob is resolved on the first read, so
+// the host is only contacted once fetching from the other hosts failed. The reads bypass
+// the chunk cache of the blob.
+type mirrorBlob struct {
+	resolver *remote.Resolver
+	host     docker.RegistryHost
+	refspec  reference.Spec
+	desc     ocispec.Descriptor
+
+	blob   remote.Blob
+	blobMu sync.Mutex
+}
+
+func (m *mirrorBlob) ReadAt(p []byte, offset int64) (int, error) {
+	m.blobMu.Lock()
+	if m.blob == nil {
+		hosts := func(reference.Spec) ([]docker.RegistryHost, error) {
+			return []docker.RegistryHost{m.host}, nil
+		}
+		b, err := m.resolver.Resolve(context.Background(), hosts, m.refspec, m.desc, cache.NewNopCache())
+		if err != nil {
+			m.blobMu.Unlock()
+			return 0, errors.Wrapf(err, "failed to resolve the blob on %q", m.host.Host)
+		}
+		m.blob = b
+	}
+	b := m.blob
+	m.blobMu.Unlock()
+	return b.ReadAt(p, offset, remote.WithoutCache())
+}
+
+// key identifies the repository of the blob on the host.
+func (m *mirrorBlob) key() string {
+	return m.host.Host + "/" + m.refspec.Locator
+}
+
+func (m *mirrorBlob) close() error {
+	m.blobMu.Lock()
+	defer m.blobMu.Unlock()
+	if m.blob == nil {
+		return nil
+	}
+	return m.blob.Close()
+}
+
+// sharedBlob is a blob shared by the references to the same content. It fetches the content
+// with the registry hosts and credentials of one of the references, and falls back to the
+// other references when fetching fails, e.g. once the credentials of the reference expire.
+type sharedBlob struct {
+	remote.Blob
+	refspec   string
+	sources   []blobSource
+	refspecMu sync.Mutex
+}
+
+// blobSource is a reference which the blob was used with.
+type blobSource struct {
+	hosts   source.RegistryHosts
+	refspec reference.Spec
+	desc    ocispec.Descriptor
+}
+
+func newSharedBlob(b remote.Blob, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) *sharedBlob {
+	return &sharedBlob{
+		Blob:    b,
+		refspec: refspec.String(),
+		sources: []blobSource{{hosts, refspec, desc}},
+	}
+}
+
+func (b *sharedBlob) Refresh(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
+	b.refspecMu.Lock()
+	defer b.refspecMu.Unlock()
+	if err := b.Blob.Refresh(ctx, hosts, refspec, desc); err != nil {
+		return err
+	}
+	b.refspec = refspec.String()
+	for _, s := range b.sources {
+		if s.refspec.String() == b.refspec {
+			return nil
+		}
+	}
+	b.sources = append(b.sources, blobSource{hosts, refspec, desc})
+	return nil
+}
+
+// use adds refspec to the references the blob can fetch its content with, if it wasn't used
+// with refspec yet. This also checks that the content can be accessed with refspec.
+func (b *sharedBlob) use(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
+	b.refspecMu.Lock()
+	for _, s := range b.sources {
+		if s.refspec.String() == refspec.String() {
+			b.refspecMu.Unlock()
+			return nil
+		}
+	}
+	b.refspecMu.Unlock()
+	return b.Refresh(ctx, hosts, refspec, desc)
+}
+
+// ReadAt reads the blob with the reference it currently uses, and then with the other references.
+func (b *sharedBlob) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
+	n, err := b.Blob.ReadAt(p, offset, opts...)
+	if err == nil {
+		return n, nil
+	}
+	for _, s := range b.fallbacks() {
+		if rerr := b.Refresh(context.Background(), s.hosts, s.refspec, s.desc); rerr != nil {
+			log.L.WithError(rerr).Debugf("failed to fall back to %q", s.refspec)
+			continue
+		}
+		if n, err = b.Blob.ReadAt(p, offset, opts...); err == nil {
+			return n, nil
+		}
+	}
+	return n, err
+}
+
+// fallbacks returns the references other than the one the blob currently uses.
+func (b *sharedBlob) fallbacks() []blobSource {
+	b.refspecMu.Lock()
+	defer b.refspecMu.Unlock()
+	var sources []blobSource
+	for _, s := range b.sources {
+		if s.refspec.String() != b.refspec {
+			sources = append(sources, s)
+		}
+	}
+	return sources
 }
 
 func newLayer(
@@ -401,13 +733,16 @@ func newLayer(
 	blob *blobRef,
 	vr *reader.VerifiableReader,
 	prefetcher *prefetcher,
+	mirrors []*mirrorBlob,
 ) *layer {
 	return &layer{
-		resolver:         resolver,
-		desc:             desc,
-		blob:             blob,
-		verifiableReader: vr,
-		prefetcher:       prefetcher,
+		resolver:          resolver,
+		desc:              desc,
+		blob:              blob,
+		verifiableReader:  vr,
+		prefetcher:        prefetcher,
+		mirrors:           mirrors,
+		backgroundFetched: make(chan struct{}),
 	}
 }
 
@@ -417,6 +752,8 @@ type layer struct {
 	desc             ocispec.Descriptor
 	blob             *blobRef
 	verifiableReader *reader.VerifiableReader
+	mirrors          []*mirrorBlob
+	mirrorsMu        sync.Mutex
 
 	r reader.Reader
 
@@ -424,6 +761,35 @@ type layer struct {
 	closedMu sync.Mutex
 
 	backgroundFetchOnce sync.Once
+	backgroundFetched   chan struct{}
+}
+
+// addMirrors adds the hosts of refspec other than the first one to the mirrors of the layer,
+// unless the layer already uses them.
+func (l *layer) addMirrors(hosts source.RegistryHosts, refspec reference.Spec) error {
+	mirrors, err := l.resolver.resolveMirrors(hosts, refspec, l.desc)
+	if err != nil {
+		return err
+	}
+	l.mirrorsMu.Lock()
+	defer l.mirrorsMu.Unlock()
+	used := make(map[string]struct{})
+	for _, m := range l.mirrors {
+		used[m.key()] = struct{}{}
+	}
+	var readers []*io.SectionReader
+	for _, m := range mirrors {
+		if _, ok := used[m.key()]; ok {
+			continue
+		}
+		used[m.key()] = struct{}{}
+		l.mirrors = append(l.mirrors, m)
+		readers = append(readers, io.NewSectionReader(m, 0, l.blob.Size()))
+	}
+	if len(readers) > 0 {
+		l.prefetcher.spanManager.AddMirrors(readers...)
+	}
+	return nil
 }
 
 func (l *layer) Info() Info {
@@ -473,6 +839,7 @@ func (l *layer) SkipVerify() {
 
 func (l *layer) BackgroundFetch() (err error) {
 	l.backgroundFetchOnce.Do(func() {
+		defer close(l.backgroundFetched)
 		ctx := context.Background()
 		err = l.backgroundFetch(ctx)
 		if err != nil {
@@ -484,6 +851,28 @@ func (l *layer) BackgroundFetch() (err error) {
 	return
 }
 
+func (l *layer) Graduate(ctx context.Context, dir string) error {
+	if l.isClosed() {
+		return fmt.Errorf("layer is already closed")
+	}
+	if l.r == nil {
+		return fmt.Errorf("layer hasn't been verified yet")
+	}
+	// The layer isn't fetched for graduation, so this waits until it's fetched in background.
+	// The spans which couldn't be fetched in background are fetched while the layer is unpacked.
+	select {
+	case <-l.backgroundFetched:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	r := bufio.NewReaderSize(l.prefetcher.spanManager.ArchiveReader(), graduateBufferSize)
+	if _, err := archive.Apply(ctx, dir, r, archive.WithConvertWhiteout(archive.OverlayConvertWhiteout)); err != nil {
+		return errors.Wrapf(err, "failed to unpack layer %v", l.desc.Digest)
+	}
+	log.G(ctx).Debugf("unpacked layer %v into %q", l.desc.Digest, dir)
+	return nil
+}
+
 func (l *layer) backgroundFetch(ctx context.Context) error {
 	defer commonmetrics.WriteLatencyLogValue(ctx, l.desc.Digest, commonmetrics.BackgroundFetchTotal, time.Now())
 	if l.isClosed() {
@@ -505,8 +894,8 @@ func newPrefetcherReader(resolver *Resolver, blob *blobRef, digest digest.Digest
 			retN, retErr = blob.ReadAt(
 				p,
 				offset,
-				remote.WithContext(ctx),              // Make cancellable
-				remote.WithCacheOpts(cache.Direct()), // Do not pollute mem cache
+				remote.WithContext(ctx), // Make cancellable
+				remote.WithoutCache(),   // The span manager caches the spans
 			)
 		}, 120*time.Second)
 		return
@@ -521,7 +910,7 @@ func (l *layer) RootNode(baseInode uint32) (fusefs.InodeEmbedder, error) {
 	if l.r == nil {
 		return nil, fmt.Errorf("layer hasn't been verified yet")
 	}
-	return newNode(l.desc.Digest, l.r, l.blob, baseInode)
+	return newNode(l.desc.Digest, l.r, l.blob, baseInode, !l.resolver.config.FuseConfig.DisableKeepCache)
 }
 
 func (l *layer) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
@@ -537,6 +926,11 @@ func (l *layer) close() error {
 	l.closed = true
 	defer l.blob.done() // Close reader first, then close the blob
 	l.verifiableReader.Close()
+	l.mirrorsMu.Lock()
+	for _, m := range l.mirrors {
+		m.close()
+	}
+	l.mirrorsMu.Unlock()
 	if l.r != nil {
 		return l.r.Close()
 	}
@@ -39,10 +39,29 @@
 package layer
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/fs/remote"
+	"github.com/awslabs/soci-snapshotter/fs/source"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
 	"github.com/awslabs/soci-snapshotter/metadata/db"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
 )
 
 func TestLayer(t *testing.T) {
@@ -75,3 +94,191 @@ func TestWaiter(t *testing.T) {
 		t.Errorf("wait time is too short: %v; want %v", doneTime.Sub(startTime), waitTime)
 	}
 }
+
+type refreshCountingBlob struct {
+	testBlobState
+	refreshed []string
+	current   string
+
+	// readable are the references which the blob can be read with.
+	readable map[string]bool
+}
+
+func (b *refreshCountingBlob) Refresh(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
+	b.refreshed = append(b.refreshed, refspec.String())
+	b.current = refspec.String()
+	return nil
+}
+
+func (b *refreshCountingBlob) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
+	if !b.readable[b.current] {
+		return 0, fmt.Errorf("cannot read with %q", b.current)
+	}
+	return len(p), nil
+}
+
+func TestSharedBlobUse(t *testing.T) {
+	ctx := context.Background()
+	parse := func(ref string) reference.Spec {
+		refspec, err := reference.Parse(ref)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %v", ref, err)
+		}
+		return refspec
+	}
+	b := &refreshCountingBlob{current: "example.com/a:latest"}
+	shared := newSharedBlob(b, nil, parse("example.com/a:latest"), ocispec.Descriptor{})
+
+	// the blob is refreshed only with the references it wasn't used with
+	for _, ref := range []string{"example.com/a:latest", "example.com/b:latest", "example.com/b:latest", "example.com/a:latest"} {
+		if err := shared.use(ctx, nil, parse(ref), ocispec.Descriptor{}); err != nil {
+			t.Fatalf("cannot use blob with %q: %v", ref, err)
+		}
+	}
+	if len(b.refreshed) != 1 || b.refreshed[0] != "example.com/b:latest" {
+		t.Fatalf("blob was refreshed with unexpected references: %v", b.refreshed)
+	}
+
+	// the blob falls back to the other references when it can't be read with the current one
+	b.readable = map[string]bool{"example.com/a:latest": true}
+	if _, err := shared.ReadAt(make([]byte, 1), 0); err != nil {
+		t.Fatalf("blob wasn't read with the other reference: %v", err)
+	}
+	if b.current != "example.com/a:latest" {
+		t.Fatalf("blob is read with %q after falling back", b.current)
+	}
+	b.readable = nil
+	if _, err := shared.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Fatalf("blob was read without a readable reference")
+	}
+}
+
+func TestLayerAddMirrors(t *testing.T) {
+	ztoc, r, err := soci.BuildZtocReader([]testutil.TarEntry{testutil.File("file", "file")}, gzip.BestCompression, 65536)
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	spanManager := spanmanager.New(ztoc, r, cache.NewMemoryCache())
+	l := newLayer(&Resolver{}, ocispec.Descriptor{}, &blobRef{&testBlobState{}, func() {}}, nil, newPrefetcher(r, spanManager), nil)
+	hosts := func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+		var regHosts []docker.RegistryHost
+		for _, h := range []string{"registry.example.com", "mirror1.example.com", "mirror2.example.com"} {
+			if h != "mirror1.example.com" || refspec.Locator == "example.com/a" {
+				regHosts = append(regHosts, docker.RegistryHost{Host: h})
+			}
+		}
+		return regHosts, nil
+	}
+
+	// the mirrors of all the references using the layer are used once
+	var mirrors []string
+	for _, ref := range []string{"example.com/a:latest", "example.com/a:v1", "example.com/b:latest"} {
+		refspec, err := reference.Parse(ref)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %v", ref, err)
+		}
+		if err := l.addMirrors(hosts, refspec); err != nil {
+			t.Fatalf("failed to add mirrors of %q: %v", ref, err)
+		}
+	}
+	for _, m := range l.mirrors {
+		mirrors = append(mirrors, m.key())
+	}
+	expected := []string{"mirror1.example.com/example.com/a", "mirror2.example.com/example.com/a", "mirror2.example.com/example.com/b"}
+	if !reflect.DeepEqual(mirrors, expected) {
+		t.Fatalf("unexpected mirrors %v; want %v", mirrors, expected)
+	}
+}
+
+func TestLayerGraduate(t *testing.T) {
+	tarEntries := []testutil.TarEntry{
+		testutil.File("file1.txt", string(genRandomByteData(100000))),
+		testutil.Dir("dir/"),
+		testutil.File("dir/file2.txt", "file2"),
+	}
+	ztoc, r, err := soci.BuildZtocReader(tarEntries, gzip.BestCompression, 65536)
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	spanManager := spanmanager.New(ztoc, r, cache.NewMemoryCache())
+	l := newLayer(nil, ocispec.Descriptor{}, nil, nil, newPrefetcher(r, spanManager), nil)
+	l.r = &testReader{}
+
+	// the layer isn't graduated until it's fetched in background
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := l.Graduate(ctx, t.TempDir()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("layer was graduated before it was fetched: %v", err)
+	}
+
+	if err := l.BackgroundFetch(); err != nil {
+		t.Fatalf("failed to fetch layer: %v", err)
+	}
+	dir := t.TempDir()
+	if err := l.Graduate(context.Background(), dir); err != nil {
+		t.Fatalf("failed to graduate layer: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "dir", "file2.txt"))
+	if err != nil {
+		t.Fatalf("failed to read file in the graduated layer: %v", err)
+	}
+	if string(data) != "file2" {
+		t.Fatalf("unexpected contents of file in the graduated layer: %q", data)
+	}
+	if st, err := os.Stat(filepath.Join(dir, "file1.txt")); err != nil || st.Size() != 100000 {
+		t.Fatalf("unexpected file in the graduated layer: %v, %v", st, err)
+	}
+}
+
+func TestCleanupCaches(t *testing.T) {
+	ctx := context.Background()
+	store, err := oci.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create artifact store: %v", err)
+	}
+	ztoc := []byte("ztoc")
+	ztocDesc := ocispec.Descriptor{
+		MediaType: soci.SociLayerMediaType,
+		Digest:    digest.FromBytes(ztoc),
+		Size:      int64(len(ztoc)),
+	}
+	if err := store.Push(ctx, ztocDesc, bytes.NewReader(ztoc)); err != nil {
+		t.Fatalf("failed to push ztoc: %v", err)
+	}
+
+	root := t.TempDir()
+	layer := digest.FromString("layer").Encoded()
+	orphanedLayer := digest.FromString("orphaned").Encoded()
+	kept := filepath.Join(root, "spancache", layer, ztocDesc.Digest.Encoded(), "uncompressed")
+	orphaned := []string{
+		filepath.Join(root, "spancache", layer, digest.FromString("removed").Encoded(), "uncompressed"),
+		filepath.Join(root, "spancache", orphanedLayer, digest.FromString("removed").Encoded(), "uncompressed"),
+	}
+	for _, dir := range append(orphaned, kept) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "span"), []byte("span"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	quota := cache.NewDiskQuota(0)
+	if err := cleanupCaches(ctx, root, quota, store); err != nil {
+		t.Fatalf("failed to clean up caches: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(kept, "span")); err != nil {
+		t.Fatalf("span cache of existing ztoc was removed: %v", err)
+	}
+	for _, dir := range orphaned {
+		if _, err := os.Stat(filepath.Dir(dir)); !os.IsNotExist(err) {
+			t.Fatalf("orphaned span cache %q wasn't removed: %v", dir, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "spancache", orphanedLayer)); !os.IsNotExist(err) {
+		t.Fatalf("directory of layer without span caches wasn't removed: %v", err)
+	}
+	if usage := quota.Usage(); usage != int64(len("span")) {
+		t.Fatalf("expected usage %d of the remaining span cache but got %d", len("span"), usage)
+	}
+}
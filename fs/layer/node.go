@@ -56,6 +56,7 @@ import (
 	"github.com/awslabs/soci-snapshotter/fs/reader"
 	"github.com/awslabs/soci-snapshotter/fs/remote"
 	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/log"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -74,9 +75,7 @@ const (
 	stateDirMode      = syscall.S_IFDIR | 0500 // dr-x------
 )
 
-var opaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
-
-func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseInode uint32) (fusefs.InodeEmbedder, error) {
+func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseInode uint32, keepCache bool) (fusefs.InodeEmbedder, error) {
 	rootID := r.Metadata().RootID()
 	rootAttr, err := r.Metadata().GetAttr(rootID)
 	if err != nil {
@@ -87,6 +86,7 @@ func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, baseIno
 		layerDigest: layerDgst,
 		baseInode:   baseInode,
 		rootID:      rootID,
+		keepCache:   keepCache,
 	}
 	ffs.s = ffs.newState(layerDgst, blob)
 	return &node{
@@ -103,6 +103,9 @@ type fs struct {
 	layerDigest digest.Digest
 	baseInode   uint32
 	rootID      uint32
+
+	// keepCache keeps the page cache of the files in the kernel when they're opened.
+	keepCache bool
 }
 
 func (fs *fs) inodeOfState() uint64 {
@@ -315,10 +318,13 @@ func (n *node) Open(ctx context.Context, flags uint32) (fh fusefs.FileHandle, fu
 		n.fs.s.report(fmt.Errorf("node.Open: %v", err))
 		return nil, 0, syscall.EIO
 	}
+	if n.fs.keepCache {
+		fuseFlags |= fuse.FOPEN_KEEP_CACHE
+	}
 	return &file{
 		n:  n,
 		ra: ra,
-	}, fuse.FOPEN_KEEP_CACHE, 0
+	}, fuseFlags, 0
 }
 
 var _ = (fusefs.NodeGetattrer)((*node)(nil))
@@ -338,7 +344,7 @@ var _ = (fusefs.NodeGetxattrer)((*node)(nil))
 func (n *node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
 	ent := n.attr
 	opq := n.isOpaque()
-	for _, opaqueXattr := range opaqueXattrs {
+	for _, opaqueXattr := range soci.OpaqueXattrs {
 		if attr == opaqueXattr && opq {
 			// This node is an opaque directory so give overlayfs-compliant indicator.
 			if len(dest) < len(opaqueXattrValue) {
@@ -364,7 +370,7 @@ func (n *node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errn
 	var attrs []byte
 	if opq {
 		// This node is an opaque directory so add overlayfs-compliant indicator.
-		for _, opaqueXattr := range opaqueXattrs {
+		for _, opaqueXattr := range soci.OpaqueXattrs {
 			attrs = append(attrs, []byte(opaqueXattr+"\x00")...)
 		}
 	}
@@ -526,6 +532,10 @@ type statJSON struct {
 	Size           int64   `json:"size"`
 	FetchedSize    int64   `json:"fetchedSize"`
 	FetchedPercent float64 `json:"fetchedPercent"` // Fetched / Size * 100.0
+	// SpanFetchFailures is the number of failed attempts to fetch the spans of the layer.
+	SpanFetchFailures int64 `json:"spanFetchFailures,omitempty"`
+	// QuarantinedSpans are the spans which failed verification repeatedly, and aren't fetched for a while.
+	QuarantinedSpans []soci.SpanId `json:"quarantinedSpans,omitempty"`
 }
 
 // statFile is a file which contain something to be reported from this layer.
@@ -610,6 +620,9 @@ func (sf *statFile) attr(out *fuse.Attr) (fusefs.StableAttr, syscall.Errno) {
 func (sf *statFile) updateStatUnlocked() ([]byte, error) {
 	sf.statJSON.FetchedSize = sf.blob.FetchedSize()
 	sf.statJSON.FetchedPercent = float64(sf.statJSON.FetchedSize) / float64(sf.statJSON.Size) * 100.0
+	spanStats := sf.fs.r.SpanStats()
+	sf.statJSON.SpanFetchFailures = spanStats.FetchFailures
+	sf.statJSON.QuarantinedSpans = spanStats.QuarantinedSpans
 	j, err := json.Marshal(&sf.statJSON)
 	if err != nil {
 		return nil, err
@@ -44,7 +44,8 @@ func (p *prefetcher) prefetch() error {
 		if errors.Is(err, spanmanager.ErrExceedMaxSpan) {
 			break
 		}
-		if err != nil {
+		// A quarantined span is fetched on demand once its quarantine expires.
+		if err != nil && !errors.Is(err, spanmanager.ErrSpanQuarantined) {
 			return err
 		}
 		spanID++
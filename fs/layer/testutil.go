@@ -190,11 +190,15 @@ func makeNodeReader(t *testing.T, contents []byte, spanSize int64, factory metad
 		vr.Close()
 		t.Fatalf("failed to lookup test node; errno: %v", errno)
 	}
-	f, _, errno := inode.Operations().(fusefs.NodeOpener).Open(context.Background(), 0)
+	f, fuseFlags, errno := inode.Operations().(fusefs.NodeOpener).Open(context.Background(), 0)
 	if errno != 0 {
 		vr.Close()
 		t.Fatalf("failed to open test file; errno: %v", errno)
 	}
+	if fuseFlags&fuse.FOPEN_KEEP_CACHE == 0 {
+		vr.Close()
+		t.Fatalf("test file was opened without keeping the page cache")
+	}
 	return f.(*file), vr.Close
 }
 
@@ -235,8 +239,8 @@ func testExistence(t *testing.T, factory metadata.Store) {
 				testutil.File("foo/.wh..wh..opq", ""),
 			},
 			want: []check{
-				hasNodeXattrs("foo/", opaqueXattrs[0], opaqueXattrValue),
-				hasNodeXattrs("foo/", opaqueXattrs[1], opaqueXattrValue),
+				hasNodeXattrs("foo/", soci.OpaqueXattrs[0], opaqueXattrValue),
+				hasNodeXattrs("foo/", soci.OpaqueXattrs[1], opaqueXattrValue),
 				fileNotExist("foo/.wh..wh..opq"),
 			},
 		},
@@ -248,8 +252,8 @@ func testExistence(t *testing.T, factory metadata.Store) {
 				testutil.File("foo/bar.txt", "test"),
 			},
 			want: []check{
-				hasNodeXattrs("foo/", opaqueXattrs[0], opaqueXattrValue),
-				hasNodeXattrs("foo/", opaqueXattrs[1], opaqueXattrValue),
+				hasNodeXattrs("foo/", soci.OpaqueXattrs[0], opaqueXattrValue),
+				hasNodeXattrs("foo/", soci.OpaqueXattrs[1], opaqueXattrValue),
 				hasFileDigest("foo/bar.txt", digestFor("test")),
 				fileNotExist("foo/.wh..wh..opq"),
 			},
@@ -261,8 +265,8 @@ func testExistence(t *testing.T, factory metadata.Store) {
 				testutil.File("foo/.wh..wh..opq", ""),
 			},
 			want: []check{
-				hasNodeXattrs("foo/", opaqueXattrs[0], opaqueXattrValue),
-				hasNodeXattrs("foo/", opaqueXattrs[1], opaqueXattrValue),
+				hasNodeXattrs("foo/", soci.OpaqueXattrs[0], opaqueXattrValue),
+				hasNodeXattrs("foo/", soci.OpaqueXattrs[1], opaqueXattrValue),
 				hasNodeXattrs("foo/", "SCHILY.xattr.foo", "bar"),
 				fileNotExist("foo/.wh..wh..opq"),
 			},
@@ -336,7 +340,7 @@ func testExistence(t *testing.T, factory metadata.Store) {
 }
 
 func getRootNode(t *testing.T, r reader.Reader) *node {
-	rootNode, err := newNode(testStateLayerDigest, &testReader{r}, &testBlobState{10, 5}, 100)
+	rootNode, err := newNode(testStateLayerDigest, &testReader{r}, &testBlobState{10, 5}, 100, true)
 	if err != nil {
 		t.Fatalf("failed to get root node: %v", err)
 	}
@@ -353,6 +357,7 @@ func (tr *testReader) Metadata() metadata.Reader               { return tr.r.Met
 func (tr *testReader) Cache(opts ...reader.CacheOption) error  { return nil }
 func (tr *testReader) Close() error                            { return nil }
 func (tr *testReader) LastOnDemandReadTime() time.Time         { return time.Now() }
+func (tr *testReader) SpanStats() spanmanager.Stats            { return tr.r.SpanStats() }
 
 type testBlobState struct {
 	size        int64
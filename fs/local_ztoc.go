@@ -0,0 +1,89 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const defaultLocalZtocSpanSize = 1 << 20
+
+// sociDesc returns the descriptor of the ztoc of the layer with the given digest, from the SOCI
+// index of the image or else, when building ztocs locally, from the local content store.
+// It returns an empty descriptor if there is none.
+func (fs *filesystem) sociDesc(ctx context.Context, layerDigest string) ocispec.Descriptor {
+	if desc, ok := fs.imageLayerToSociDesc[layerDigest]; ok {
+		return desc
+	}
+	if !fs.localZtoc.Enable {
+		return ocispec.Descriptor{}
+	}
+	dgst, err := digest.Parse(layerDigest)
+	if err != nil {
+		return ocispec.Descriptor{}
+	}
+	desc, err := soci.LayerZtocDescriptor(dgst)
+	if err != nil {
+		log.G(ctx).WithError(err).Debug("no local ztoc")
+		return ocispec.Descriptor{}
+	}
+	return desc
+}
+
+// buildLocalZtoc builds the ztoc of the layer desc in the background,
+// from the layer blob in the local content store, unless there is one already.
+func (fs *filesystem) buildLocalZtoc(ctx context.Context, desc ocispec.Descriptor) {
+	// ztocs can only be built for gzip compressed layers
+	if !strings.HasSuffix(desc.MediaType, "gzip") {
+		return
+	}
+	if _, building := fs.localZtocBuilds.LoadOrStore(desc.Digest, struct{}{}); building {
+		return
+	}
+	ctx = log.WithLogger(context.Background(), log.G(ctx).WithField("layer", desc.Digest))
+	go func() {
+		defer fs.localZtocBuilds.Delete(desc.Digest)
+		if _, err := soci.LayerZtocDescriptor(desc.Digest); err == nil {
+			return
+		}
+		rc, err := fs.orasStore.Fetch(ctx, desc)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("cannot read layer to build a ztoc")
+			return
+		}
+		defer rc.Close()
+		spanSize := fs.localZtoc.SpanSize
+		if spanSize == 0 {
+			spanSize = defaultLocalZtocSpanSize
+		}
+		ztocDesc, err := soci.BuildLayerZtoc(ctx, rc, desc, spanSize, fs.orasStore,
+			soci.WithMinLayerSize(fs.localZtoc.MinLayerSize))
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("cannot build ztoc")
+			return
+		} else if ztocDesc == nil {
+			return
+		}
+		log.G(ctx).WithField("ztoc", ztocDesc.Digest).Info("built ztoc of locally unpacked layer")
+	}()
+}
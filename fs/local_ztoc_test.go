@@ -0,0 +1,116 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	ctdtestutil "github.com/containerd/containerd/pkg/testutil"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+func TestSociDesc(t *testing.T) {
+	ctx := context.Background()
+	layerDigest := digest.FromString("layer").String()
+	indexDesc := ocispec.Descriptor{Digest: digest.FromString("ztoc")}
+	fs := &filesystem{
+		imageLayerToSociDesc: map[string]ocispec.Descriptor{layerDigest: indexDesc},
+	}
+	if desc := fs.sociDesc(ctx, layerDigest); desc.Digest != indexDesc.Digest {
+		t.Fatalf("unexpected ztoc of the index: %v", desc)
+	}
+	// without local ztocs, only the ztocs of the index are used
+	if desc := fs.sociDesc(ctx, digest.FromString("other layer").String()); desc.Digest != "" {
+		t.Fatalf("unexpected ztoc of a layer without one: %v", desc)
+	}
+}
+
+// Tests that the ztoc of a locally unpacked layer is built in the background and
+// is found by the layer digest afterwards. It writes to the artifacts db, so it's run as root only.
+func TestBuildLocalZtoc(t *testing.T) {
+	ctdtestutil.RequiresRoot(t)
+	if err := os.MkdirAll(config.SociSnapshotterRootPath, 0711); err != nil {
+		t.Fatalf("cannot create the snapshotter root: %v", err)
+	}
+	ctx := context.Background()
+	store := memory.New()
+	fs := &filesystem{
+		imageLayerToSociDesc: make(map[string]ocispec.Descriptor),
+		orasStore:            store,
+		localZtoc:            config.LocalZtocConfig{Enable: true, SpanSize: 1 << 10},
+	}
+
+	// the layer must be new to the artifacts db, which outlives the test
+	contents := fmt.Sprintf("%d", time.Now().UnixNano())
+	b, err := io.ReadAll(testutil.BuildTarGz([]testutil.TarEntry{
+		testutil.File("foo", contents),
+	}, gzip.BestCompression))
+	if err != nil {
+		t.Fatalf("cannot build the layer: %v", err)
+	}
+	layer := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	if err := store.Push(ctx, layer, bytes.NewReader(b)); err != nil {
+		t.Fatalf("cannot push the layer: %v", err)
+	}
+	if desc := fs.sociDesc(ctx, layer.Digest.String()); desc.Digest != "" {
+		t.Fatalf("unexpected ztoc before building it: %v", desc)
+	}
+
+	// layers which aren't gzip compressed are skipped
+	fs.buildLocalZtoc(ctx, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayer, Digest: layer.Digest})
+	if _, building := fs.localZtocBuilds.Load(layer.Digest); building {
+		t.Fatalf("ztoc of an uncompressed layer is being built")
+	}
+
+	fs.buildLocalZtoc(ctx, layer)
+	for {
+		if _, building := fs.localZtocBuilds.Load(layer.Digest); !building {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	desc := fs.sociDesc(ctx, layer.Digest.String())
+	if desc.Digest == "" || desc.Annotations[soci.IndexAnnotationImageLayerDigest] != layer.Digest.String() {
+		t.Fatalf("unexpected ztoc after building it: %v", desc)
+	}
+	// the ztoc is pushed without a media type
+	if exists, err := store.Exists(ctx, ocispec.Descriptor{Digest: desc.Digest, Size: desc.Size}); err != nil || !exists {
+		t.Fatalf("ztoc %s is not in the store: %v", desc.Digest, err)
+	}
+
+	// local ztocs aren't used unless enabled
+	fs.localZtoc.Enable = false
+	if desc := fs.sociDesc(ctx, layer.Digest.String()); desc.Digest != "" {
+		t.Fatalf("unexpected ztoc with local ztocs disabled: %v", desc)
+	}
+}
@@ -55,6 +55,12 @@ const (
 	// BytesServedKey is the key for any metric related to counting bytes served as the part of specific operation.
 	BytesServedKey = "bytes_served"
 
+	// CacheUsageKey is the key for the size of the contents of the caches on the disk.
+	CacheUsageKey = "cache_usage_bytes"
+
+	// CacheEvictedKey is the key for the size of the contents evicted from the caches on the disk.
+	CacheEvictedKey = "cache_evicted_bytes"
+
 	// Keep namespace as soci and subsystem as fs.
 	namespace = "soci"
 	subsystem = "fs"
@@ -74,6 +80,8 @@ const (
 	OnDemandRemoteRegistryFetchCount = "on_demand_remote_registry_fetch_count"
 	OnDemandBytesServed              = "on_demand_bytes_served"
 	OnDemandBytesFetched             = "on_demand_bytes_fetched"
+	SpanFetchFailureCount            = "span_fetch_failure_count"
+	SpanQuarantineCount              = "span_quarantine_count"
 
 	// logs metrics
 	BackgroundFetchTotal      = "background_fetch_total"
@@ -134,6 +142,26 @@ var (
 		},
 		[]string{"operation_type", "layer"},
 	)
+
+	// cacheUsage reflects the size of the contents of the span and http caches on the disk.
+	cacheUsage = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      CacheUsageKey,
+			Help:      "The size in bytes of the contents of the soci snapshotter caches on the disk.",
+		},
+	)
+
+	// cacheEvicted collects the size of the contents evicted from the caches on the disk.
+	cacheEvicted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      CacheEvictedKey,
+			Help:      "The size in bytes of the contents evicted from the soci snapshotter caches on the disk.",
+		},
+	)
 )
 
 var register sync.Once
@@ -159,6 +187,8 @@ func Register() {
 		prometheus.MustRegister(operationLatencyMicroseconds)
 		prometheus.MustRegister(operationCount)
 		prometheus.MustRegister(bytesCount)
+		prometheus.MustRegister(cacheUsage)
+		prometheus.MustRegister(cacheEvicted)
 	})
 }
 
@@ -190,6 +220,16 @@ func AddBytesCount(operation string, layer digest.Digest, bytes int64) {
 	bytesCount.WithLabelValues(operation, layer.String()).Add(float64(bytes))
 }
 
+// SetCacheUsage sets the size in bytes of the contents of the caches on the disk.
+func SetCacheUsage(bytes int64) {
+	cacheUsage.Set(float64(bytes))
+}
+
+// AddCacheEvictedBytes adds to the size in bytes of the contents evicted from the caches on the disk.
+func AddCacheEvictedBytes(bytes int64) {
+	cacheEvicted.Add(float64(bytes))
+}
+
 // WriteLatencyLogValue wraps writing the log info record for latency in milliseconds. The log record breaks down by operation and layer digest.
 func WriteLatencyLogValue(ctx context.Context, layer digest.Digest, operation string, start time.Time) {
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("metrics", "latency").WithField("operation", operation).WithField("layer_sha", layer.String()))
@@ -50,6 +50,7 @@ import (
 	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
 	"github.com/awslabs/soci-snapshotter/metadata"
 	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/log"
 	"github.com/hashicorp/go-multierror"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
@@ -60,6 +61,7 @@ type Reader interface {
 	Metadata() metadata.Reader
 	Close() error
 	LastOnDemandReadTime() time.Time
+	SpanStats() spanmanager.Stats
 }
 
 // VerifiableReader produces a Reader with a given verifier.
@@ -122,16 +124,30 @@ func (vr *VerifiableReader) isClosed() bool {
 	return closed
 }
 
+// Option is an option of a Reader.
+type Option func(*reader)
+
+// WithReadahead makes the reader fetch the next spans spans of a file in the background
+// when the file is read sequentially.
+func WithReadahead(spans int) Option {
+	return func(gr *reader) {
+		gr.readaheadSpans = spans
+	}
+}
+
 // NewReader creates a Reader based on the given soci blob and Span Manager.
 // It returns VerifiableReader so the caller must provide a metadata.ChunkVerifier
 // to use for verifying file or chunk contained in this stargz blob.
-func NewReader(r metadata.Reader, layerSha digest.Digest, spanManager *spanmanager.SpanManager) (*VerifiableReader, error) {
+func NewReader(r metadata.Reader, layerSha digest.Digest, spanManager *spanmanager.SpanManager, opts ...Option) (*VerifiableReader, error) {
 	vr := &reader{
 		spanManager: spanManager,
 		r:           r,
 		layerSha:    layerSha,
 		verifier:    digestVerifier,
 	}
+	for _, o := range opts {
+		o(vr)
+	}
 	return &VerifiableReader{r: vr, verifier: digestVerifier}, nil
 }
 
@@ -140,6 +156,9 @@ type reader struct {
 	r           metadata.Reader
 	layerSha    digest.Digest
 
+	// readaheadSpans is the number of spans to read ahead on sequential reads. 0 disables readahead.
+	readaheadSpans int
+
 	lastReadTime   time.Time
 	lastReadTimeMu sync.Mutex
 
@@ -167,6 +186,10 @@ func (gr *reader) LastOnDemandReadTime() time.Time {
 	return t
 }
 
+func (gr *reader) SpanStats() spanmanager.Stats {
+	return gr.spanManager.Stats()
+}
+
 func (gr *reader) OpenFile(id uint32) (io.ReaderAt, error) {
 	if gr.isClosed() {
 		return nil, fmt.Errorf("reader is already closed")
@@ -207,6 +230,12 @@ type file struct {
 	id uint32
 	fr metadata.File
 	gr *reader
+
+	// nextOffset is the offset following the last read, to detect sequential reads.
+	// readaheadEnd is the last span which was read ahead.
+	nextOffset   int64
+	readaheadEnd soci.SpanId
+	readaheadMu  sync.Mutex
 }
 
 // ReadAt reads the file when the file is requested by the container
@@ -221,7 +250,7 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 	}
 	fileOffsetStart := sf.fr.GetUncompressedOffset() + soci.FileSize(offset)
 	fileOffsetEnd := fileOffsetStart + expectedSize
-	r, err := sf.gr.spanManager.GetContents(fileOffsetStart, fileOffsetEnd)
+	n, err := sf.gr.spanManager.ReadContents(p, fileOffsetStart, fileOffsetEnd)
 	if err != nil {
 		return 0, errors.Wrap(err, "failed to read the file")
 	}
@@ -229,19 +258,55 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 	commonmetrics.IncOperationCount(commonmetrics.OnDemandRemoteRegistryFetchCount, sf.gr.layerSha) // increment the number of on demand file fetches from remote registry
 	sf.gr.setLastReadTime(time.Now())
 
-	contents, err := io.ReadAll(r)
-	if err != nil && err != io.EOF {
-		return 0, err
-	}
-	n := copy(p, contents)
 	if soci.FileSize(n) != expectedSize {
 		return 0, fmt.Errorf("unexpected copied data size for on-demand fetch. read = %d, expected = %d", n, expectedSize)
 	}
 	commonmetrics.AddBytesCount(commonmetrics.OnDemandBytesServed, sf.gr.layerSha, int64(n)) // measure the number of on demand bytes served
 
+	sf.readahead(offset, fileOffsetEnd)
 	return n, nil
 }
 
+// readahead fetches the spans following the read ending at fileOffsetEnd in the background,
+// if the file is read sequentially. The spans are read ahead again when half of them are read.
+func (sf *file) readahead(offset int64, fileOffsetEnd soci.FileSize) {
+	if sf.gr.readaheadSpans <= 0 {
+		return
+	}
+	sf.readaheadMu.Lock()
+	defer sf.readaheadMu.Unlock()
+	sequential := offset > 0 && offset == sf.nextOffset
+	sf.nextOffset = int64(fileOffsetEnd - sf.fr.GetUncompressedOffset())
+	if !sequential {
+		return
+	}
+	fileEnd := sf.fr.GetUncompressedOffset() + sf.fr.GetUncompressedFileSize()
+	if fileOffsetEnd >= fileEnd {
+		return
+	}
+	last := sf.gr.spanManager.SpanID(fileOffsetEnd - 1)
+	if sf.readaheadEnd > last && int(sf.readaheadEnd-last) > sf.gr.readaheadSpans/2 {
+		return
+	}
+	start := last + 1
+	if sf.readaheadEnd >= start {
+		start = sf.readaheadEnd + 1
+	}
+	end := last + soci.SpanId(sf.gr.readaheadSpans)
+	if fileLast := sf.gr.spanManager.SpanID(fileEnd - 1); end > fileLast {
+		end = fileLast
+	}
+	if start > end {
+		return
+	}
+	sf.readaheadEnd = end
+	go func() {
+		if err := sf.gr.spanManager.FetchSpans(start, end); err != nil {
+			log.L.WithError(err).Debugf("failed to read ahead spans %d-%d of layer %s", start, end, sf.gr.layerSha)
+		}
+	}()
+}
+
 type CacheOption func(*cacheOptions)
 
 type cacheOptions struct {
@@ -245,10 +245,6 @@ func (b *blob) ReadAt(p []byte, offset int64, opts ...Option) (int, error) {
 		return 0, nil
 	}
 
-	// Make the buffer chunk aligned
-	allRegion := region{floor(offset, b.chunkSize), ceil(offset+int64(len(p))-1, b.chunkSize) - 1}
-	allData := make(map[region]io.Writer)
-
 	var readAtOpts options
 	for _, o := range opts {
 		o(&readAtOpts)
@@ -260,6 +256,14 @@ func (b *blob) ReadAt(p []byte, offset int64, opts ...Option) (int, error) {
 	fr := b.fetcher
 	b.fetcherMu.Unlock()
 
+	if readAtOpts.uncached {
+		return b.readAtUncached(p, offset, fr, &readAtOpts)
+	}
+
+	// Make the buffer chunk aligned
+	allRegion := region{floor(offset, b.chunkSize), ceil(offset+int64(len(p))-1, b.chunkSize) - 1}
+	allData := make(map[region]io.Writer)
+
 	b.walkChunks(allRegion, func(chunk region) error {
 		var (
 			base         = positive(chunk.b - offset)
@@ -301,6 +305,59 @@ func (b *blob) ReadAt(p []byte, offset int64, opts ...Option) (int, error) {
 	return len(p), nil
 }
 
+// readAtUncached fetches exactly the region of p at offset from the remote blob, without
+// the chunks in the cache.
+func (b *blob) readAtUncached(p []byte, offset int64, fr fetcher, opts *options) (int, error) {
+	// Adjust the buffer size according to the blob size
+	if remain := b.size - offset; int64(len(p)) >= remain {
+		p = p[:remain]
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	reg := region{offset, offset + int64(len(p)) - 1}
+
+	fetchCtx, cancel := context.WithTimeout(context.Background(), b.fetchTimeout)
+	defer cancel()
+	if opts.ctx != nil {
+		fetchCtx = opts.ctx
+	}
+	mr, err := fr.fetch(fetchCtx, []region{reg}, true)
+	if err != nil {
+		return 0, err
+	}
+	defer mr.Close()
+
+	// Update the check timer because we succeeded to access the blob
+	b.lastCheckMu.Lock()
+	b.lastCheck = time.Now()
+	b.lastCheckMu.Unlock()
+
+	// The registry may respond with a larger region, e.g. the whole blob.
+	for {
+		part, r, err := mr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, errors.Wrapf(err, "failed to read multipart resp")
+		}
+		if part.b > reg.b || part.e < reg.e {
+			continue
+		}
+		if _, err := io.CopyN(io.Discard, r, reg.b-part.b); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(r, p); err != nil {
+			return 0, err
+		}
+		b.fetchedRegionSetMu.Lock()
+		b.fetchedRegionSet.add(reg)
+		b.fetchedRegionSetMu.Unlock()
+		return len(p), nil
+	}
+	return 0, fmt.Errorf("failed to fetch region %v", reg)
+}
+
 // fetchRegions fetches all specified chunks from remote blob and puts it in the local cache.
 // It must be called from within fetchRange and need to ensure that it is inside the singleflight `Do` operation.
 func (b *blob) fetchRegions(allData map[region]io.Writer, fetched map[region]bool, opts *options) error {
@@ -265,6 +265,32 @@ func checkAllCached(t *testing.T, r *blob, offset, size int64) {
 	}
 }
 
+// Tests ReadAt method reading exact regions without the chunk cache.
+func TestReadAtWithoutCache(t *testing.T) {
+	for _, multiRange := range []bool{true, false} {
+		var ranges []string
+		tr := multiRoundTripper(t, []byte(sampleData1), allowMultiRange(multiRange))
+		b := makeTestBlob(t, int64(len(sampleData1)), sampleChunkSize, func(req *http.Request) *http.Response {
+			ranges = append(ranges, req.Header.Get("Range"))
+			return tr(req)
+		})
+		for _, reg := range []region{{1, 5}, {sampleChunkSize - 1, 2*sampleChunkSize + 1}, {0, int64(len(sampleData1)) - 1}} {
+			ranges = nil
+			p := make([]byte, reg.size())
+			n, err := b.ReadAt(p, reg.b, WithoutCache())
+			if err != nil || int64(n) != reg.size() || string(p) != sampleData1[reg.b:reg.e+1] {
+				t.Fatalf("unexpected read of %v: n=%d, err=%v", reg, n, err)
+			}
+			if want := fmt.Sprintf("%s%d-%d", rangeHeaderPrefix, reg.b, reg.e); len(ranges) != 1 || ranges[0] != want {
+				t.Fatalf("region %v was fetched with %v, expected %q", reg, ranges, want)
+			}
+		}
+		if cached := b.cache.(*cache.MemoryCache).Membuf; len(cached) != 0 {
+			t.Fatalf("regions read without cache were cached: %d chunks", len(cached))
+		}
+	}
+}
+
 // Tests ReadAt method for failure cases.
 func TestFailReadAt(t *testing.T) {
 
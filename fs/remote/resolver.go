@@ -664,6 +664,7 @@ type Option func(*options)
 type options struct {
 	ctx       context.Context
 	cacheOpts []cache.Option
+	uncached  bool
 }
 
 func WithContext(ctx context.Context) Option {
@@ -678,6 +679,15 @@ func WithCacheOpts(cacheOpts ...cache.Option) Option {
 	}
 }
 
+// WithoutCache makes ReadAt fetch exactly the requested region from the registry, without
+// aligning it to chunks nor caching it. This is for the readers which cache the contents
+// themselves, e.g. the span manager which reads and caches whole spans.
+func WithoutCache() Option {
+	return func(opts *options) {
+		opts.uncached = true
+	}
+}
+
 // NOTE: ported from https://github.com/containerd/containerd/blob/v1.5.2/remotes/docker/scope.go#L29-L42
 // TODO: import this from containerd package once we drop support to continerd v1.4.x
 //
@@ -0,0 +1,86 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+// #cgo CFLAGS: -I${SRCDIR}/../../c/
+// #cgo LDFLAGS: -L${SRCDIR}/../../out -lindexer -lz
+// #include "indexer.h"
+// #include <stdlib.h>
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+)
+
+// Range is a range of uncompressed offsets of a layer, e.g. the contents of a file read by a container.
+type Range struct {
+	Start soci.FileSize
+	End   soci.FileSize
+}
+
+// SimulationResult is the work needed to read a list of ranges from a layer on demand.
+type SimulationResult struct {
+	// RangeRequests is the number of range requests for compressed data, one per fetched span.
+	RangeRequests int
+	// FetchedBytes is the number of compressed bytes fetched.
+	FetchedBytes soci.FileSize
+	// DecompressedBytes is the number of bytes decompressed, i.e. the uncompressed size of the fetched spans.
+	DecompressedBytes soci.FileSize
+}
+
+// Simulate returns the work a SpanManager for ztoc does to read ranges, without fetching anything.
+// It uses the same span math as GetContents, and every span is fetched and decompressed at most once,
+// as if the spans stayed in the cache.
+func Simulate(ztoc *soci.Ztoc, ranges []Range) (SimulationResult, error) {
+	var res SimulationResult
+	if len(ztoc.IndexByteData) == 0 {
+		return res, errors.New("ztoc has no index")
+	}
+	index := C.blob_to_index(unsafe.Pointer(&ztoc.IndexByteData[0]))
+	if index == nil {
+		return res, errors.New("cannot convert blob to gzip_index")
+	}
+	defer C.free_index(index)
+	m := &SpanManager{
+		index: index,
+		spans: make([]*span, ztoc.MaxSpanId+1),
+		ztoc:  ztoc,
+	}
+	m.buildAllSpans()
+
+	fetched := make(map[soci.SpanId]struct{})
+	for _, r := range ranges {
+		if r.End <= r.Start {
+			continue
+		}
+		si := m.getSpanInfo(r.Start, r.End)
+		for id := si.spanStart; id <= si.spanEnd; id++ {
+			if _, ok := fetched[id]; ok {
+				continue
+			}
+			fetched[id] = struct{}{}
+			s := m.spans[id]
+			res.RangeRequests++
+			res.FetchedBytes += s.endCompOffset - s.startCompOffset
+			res.DecompressedBytes += s.endUncompOffset - s.startUncompOffset
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,116 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+)
+
+func TestSimulate(t *testing.T) {
+	var spanSize soci.FileSize = 65536 // 64 KiB
+	var tarEntries []testutil.TarEntry
+	for i := 0; i < 20; i++ {
+		size := spanSize / 8
+		if i%5 == 0 {
+			size = 3 * spanSize
+		}
+		tarEntries = append(tarEntries, testutil.File(fmt.Sprintf("file%d", i), string(genRandomByteData(size))))
+	}
+	ztoc, r, err := soci.BuildZtocReader(tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+
+	testCases := []struct {
+		name  string
+		files []string
+	}{
+		{
+			name: "no files",
+		},
+		{
+			name:  "a small file",
+			files: []string{"file1"},
+		},
+		{
+			name:  "a large file",
+			files: []string{"file5"},
+		},
+		{
+			name:  "files sharing spans",
+			files: []string{"file1", "file2", "file3", "file2", "file10", "file11"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var ranges []Range
+			for _, name := range tc.files {
+				for _, m := range ztoc.Metadata {
+					if m.Name == name {
+						ranges = append(ranges, Range{Start: m.UncompressedOffset, End: m.UncompressedOffset + m.UncompressedSize})
+					}
+				}
+			}
+			res, err := Simulate(ztoc, ranges)
+			if err != nil {
+				t.Fatalf("failed to simulate: %v", err)
+			}
+
+			// read the same ranges with a SpanManager and compare with what it fetched
+			var (
+				mu       sync.Mutex
+				requests int
+				fetched  soci.FileSize
+			)
+			countingReader := io.NewSectionReader(readerFn(func(b []byte, off int64) (int, error) {
+				mu.Lock()
+				requests++
+				fetched += soci.FileSize(len(b))
+				mu.Unlock()
+				return r.ReadAt(b, off)
+			}), 0, r.Size())
+			cache := cache.NewMemoryCache()
+			defer cache.Close()
+			m := New(ztoc, countingReader, cache)
+			for _, rng := range ranges {
+				rdr, err := m.GetContents(rng.Start, rng.End)
+				if err != nil {
+					t.Fatalf("failed to get contents: %v", err)
+				}
+				if _, err := io.ReadAll(rdr); err != nil {
+					t.Fatalf("failed to read contents: %v", err)
+				}
+			}
+
+			if res.RangeRequests != requests {
+				t.Fatalf("unexpected range requests; expected %d, got %d", requests, res.RangeRequests)
+			}
+			if res.FetchedBytes != fetched {
+				t.Fatalf("unexpected fetched bytes; expected %d, got %d", fetched, res.FetchedBytes)
+			}
+		})
+	}
+}
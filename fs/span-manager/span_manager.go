@@ -29,14 +29,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"runtime"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/awslabs/soci-snapshotter/cache"
 	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/util/lrucache"
+	"github.com/klauspost/compress/zstd"
 	"github.com/opencontainers/go-digest"
 	"golang.org/x/sync/errgroup"
 )
@@ -52,21 +56,29 @@ const (
 	fetched
 	// A span is in Uncompressed state when it's uncompressed and its uncompressed content is cached.
 	uncompressed
+	// A span is in Quarantined state when it failed verification repeatedly. It isn't fetched
+	// until the quarantine expires.
+	quarantined
 )
 
 // map of valid span transtions. Key is the current state and value is valid new states.
+// Fetched and Uncompressed spans become Unrequested when their contents are evicted from the cache.
+// Requested spans become Unrequested when fetching them fails, so that they're fetched again later.
 var stateTransitionMap = map[spanState][]spanState{
 	unrequested:  {unrequested, requested},
-	requested:    {requested, fetched},
-	fetched:      {fetched, uncompressed},
-	uncompressed: {uncompressed},
+	requested:    {requested, fetched, unrequested, quarantined},
+	fetched:      {fetched, uncompressed, unrequested},
+	uncompressed: {uncompressed, unrequested},
+	quarantined:  {quarantined, unrequested},
 }
 
 var (
 	ErrSpanNotAvailable           = errors.New("span not available in cache")
 	ErrIncorrectSpanDigest        = errors.New("span digests do not match")
 	ErrExceedMaxSpan              = errors.New("span id larger than max span id")
+	ErrSpanQuarantined            = errors.New("span is quarantined after failing verification repeatedly")
 	errInvalidSpanStateTransition = errors.New("invalid span state transition")
+	errSpanFetched                = errors.New("span was fetched by another reader")
 )
 
 type span struct {
@@ -77,6 +89,11 @@ type span struct {
 	endUncompOffset   soci.FileSize
 	state             atomic.Value
 	mu                sync.Mutex
+
+	// failures is the number of verification failures in a row, and quarantinedUntil is when
+	// the quarantine of the span expires. They're guarded by mu.
+	failures         int
+	quarantinedUntil time.Time
 }
 
 func (s *span) setState(state spanState) error {
@@ -98,13 +115,104 @@ func (s *span) validateStateTransition(newState spanState) error {
 	return errInvalidSpanStateTransition
 }
 
+// CacheMode is how the spans are stored in the cache.
+type CacheMode string
+
+const (
+	// CacheUncompressed stores the spans uncompressed once they're read.
+	CacheUncompressed CacheMode = "uncompressed"
+	// CacheCompressed keeps the spans compressed as they're fetched.
+	CacheCompressed CacheMode = "compressed"
+	// CacheZstd stores the spans re-compressed with zstd once they're read.
+	CacheZstd CacheMode = "zstd"
+)
+
+// zstdMagic is the magic number at the beginning of zstd frames.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
 type SpanManager struct {
-	cache    cache.BlobCache
-	cacheOpt []cache.Option
-	index    *C.struct_gzip_index
-	r        *io.SectionReader // reader for contents of the spans managed by SpanManager
-	spans    []*span
-	ztoc     *soci.Ztoc
+	cache     cache.BlobCache
+	cacheOpt  []cache.Option
+	cacheMode CacheMode
+	hotSpans  *lrucache.Cache // recently used uncompressed spans, with the compressed cache modes
+	index     *C.struct_gzip_index
+	r         *io.SectionReader // reader for contents of the spans managed by SpanManager
+	spans     []*span
+	ztoc      *soci.Ztoc
+
+	mirrors            []*io.SectionReader
+	mirrorsMu          sync.Mutex
+	maxRetries         int
+	minWait            time.Duration
+	maxWait            time.Duration
+	quarantineFailures int
+	quarantineDuration time.Duration
+	onFailure          func(soci.SpanId, error)
+	fetchFailures      int64
+}
+
+// Stats are the statistics of the failures to fetch the spans.
+type Stats struct {
+	// FetchFailures is the number of failed attempts to fetch the spans.
+	FetchFailures int64
+	// QuarantinedSpans are the spans which are quarantined.
+	QuarantinedSpans []soci.SpanId
+}
+
+// Option is an option of a SpanManager.
+type Option func(*SpanManager)
+
+// WithCacheOpts sets the options to add the spans to the cache.
+func WithCacheOpts(cacheOpt ...cache.Option) Option {
+	return func(m *SpanManager) {
+		m.cacheOpt = cacheOpt
+	}
+}
+
+// WithRetries makes the span manager retry fetching a span up to maxRetries times from each
+// reader, waiting exponentially from minWait up to maxWait between the attempts.
+func WithRetries(maxRetries int, minWait, maxWait time.Duration) Option {
+	return func(m *SpanManager) {
+		m.maxRetries = maxRetries
+		m.minWait = minWait
+		m.maxWait = maxWait
+	}
+}
+
+// WithMirrors makes the span manager fall back to fetching the spans from the mirrors, in order,
+// when fetching them fails.
+func WithMirrors(mirrors ...*io.SectionReader) Option {
+	return func(m *SpanManager) {
+		m.mirrors = mirrors
+	}
+}
+
+// WithQuarantine makes the span manager quarantine a span for d after it fails verification
+// on failures fetches in a row. Fetching a quarantined span fails with ErrSpanQuarantined.
+func WithQuarantine(failures int, d time.Duration) Option {
+	return func(m *SpanManager) {
+		m.quarantineFailures = failures
+		m.quarantineDuration = d
+	}
+}
+
+// WithFailureHandler sets the function called with each failure to fetch a span.
+func WithFailureHandler(onFailure func(spanId soci.SpanId, err error)) Option {
+	return func(m *SpanManager) {
+		m.onFailure = onFailure
+	}
+}
+
+// WithCacheMode sets how the spans are stored in the cache. With the compressed modes, up to
+// hotSpans recently used spans are kept uncompressed in memory. The spans are restored only
+// from a cache which holds the spans stored with the same mode.
+func WithCacheMode(mode CacheMode, hotSpans int) Option {
+	return func(m *SpanManager) {
+		m.cacheMode = mode
+		if mode != CacheUncompressed && hotSpans > 0 {
+			m.hotSpans = lrucache.New(hotSpans)
+		}
+	}
 }
 
 type spanInfo struct {
@@ -120,16 +228,19 @@ type spanInfo struct {
 	spanIndexInBuf []soci.FileSize
 }
 
-func New(ztoc *soci.Ztoc, r *io.SectionReader, cache cache.BlobCache, cacheOpt ...cache.Option) *SpanManager {
+func New(ztoc *soci.Ztoc, r *io.SectionReader, cache cache.BlobCache, opts ...Option) *SpanManager {
 	index := C.blob_to_index(unsafe.Pointer(&ztoc.IndexByteData[0]))
 	spans := make([]*span, ztoc.MaxSpanId+1)
 	m := &SpanManager{
-		cache:    cache,
-		cacheOpt: cacheOpt,
-		index:    index,
-		r:        r,
-		spans:    spans,
-		ztoc:     ztoc,
+		cache:     cache,
+		cacheMode: CacheUncompressed,
+		index:     index,
+		r:         r,
+		spans:     spans,
+		ztoc:      ztoc,
+	}
+	for _, o := range opts {
+		o(m)
 	}
 	m.buildAllSpans()
 	runtime.SetFinalizer(m, func(m *SpanManager) {
@@ -166,6 +277,75 @@ func (m *SpanManager) buildAllSpans() {
 	}
 }
 
+// Restore rebuilds the states of the spans from the contents of the cache, e.g. a persistent
+// cache which was filled before a restart, and returns the number of restored spans.
+// A cached span matching its compressed digest is fetched, and one of its uncompressed size is
+// uncompressed. With the zstd cache mode, a cached span compressed with zstd is uncompressed,
+// and spans cached uncompressed are fetched again. The cache must hold the spans stored with
+// the cache mode of the span manager.
+func (m *SpanManager) Restore() int {
+	restored := 0
+	for _, s := range m.spans {
+		if state, ok := m.cachedState(s); ok {
+			s.state.Store(state)
+			restored++
+		}
+	}
+	return restored
+}
+
+// cachedState returns the state of the span s from its contents in the cache.
+func (m *SpanManager) cachedState(s *span) (spanState, bool) {
+	r, err := m.cache.Get(strconv.Itoa(int(s.id)), m.cacheOpt...)
+	if err != nil {
+		return unrequested, false
+	}
+	defer r.Close()
+	compressedSize := s.endCompOffset - s.startCompOffset
+	uncompressedSize := s.endUncompOffset - s.startUncompOffset
+	switch {
+	case hasSize(r, compressedSize) && m.verifyCachedSpan(r, s) == nil:
+		// The compressed contents are verified, in case they were corrupted on the disk.
+		return fetched, true
+	case m.cacheMode == CacheZstd:
+		// The cache of the zstd mode only holds the spans compressed with gzip or zstd.
+		if hasPrefix(r, zstdMagic) {
+			return uncompressed, true
+		}
+	case hasSize(r, uncompressedSize):
+		return uncompressed, true
+	}
+	return unrequested, false
+}
+
+// verifyCachedSpan verifies the compressed contents of the span s read from r.
+func (m *SpanManager) verifyCachedSpan(r io.ReaderAt, s *span) error {
+	buf := make([]byte, s.endCompOffset-s.startCompOffset)
+	if _, err := r.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return err
+	}
+	return m.verifySpanContents(buf, s.id)
+}
+
+// hasPrefix returns whether the contents of r begin with prefix.
+func hasPrefix(r io.ReaderAt, prefix []byte) bool {
+	b := make([]byte, len(prefix))
+	n, _ := r.ReadAt(b, 0)
+	return n == len(prefix) && bytes.Equal(b, prefix)
+}
+
+// hasSize returns whether the contents of r are size bytes long.
+func hasSize(r io.ReaderAt, size soci.FileSize) bool {
+	b := make([]byte, 1)
+	if size > 0 {
+		if n, _ := r.ReadAt(b, int64(size-1)); n != 1 {
+			return false
+		}
+	}
+	n, err := r.ReadAt(b, int64(size))
+	return n == 0 && err == io.EOF
+}
+
 func (m *SpanManager) ResolveSpan(spanId soci.SpanId, r *io.SectionReader) error {
 	if spanId > m.ztoc.MaxSpanId {
 		return ErrExceedMaxSpan
@@ -176,24 +356,107 @@ func (m *SpanManager) ResolveSpan(spanId soci.SpanId, r *io.SectionReader) error
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	state := s.state.Load().(spanState)
-	if state == uncompressed {
+	if state == fetched || state == uncompressed {
 		id := strconv.Itoa(int(spanId))
-		_, err := m.cache.Get(id)
+		r, err := m.cache.Get(id)
 		if err == nil {
 			// The span is already in cache.
+			r.Close()
 			return nil
 		}
+		// The span was evicted from the cache.
+		if err := s.setState(unrequested); err != nil {
+			return err
+		}
 	}
 
 	// The span is not available in cache. Fetch the span and add it to cache
 	_, err := m.fetchAndCacheSpan(spanId, r, true)
-	if err != nil {
+	if err != nil && !errors.Is(err, errSpanFetched) {
 		return err
 	}
 
 	return nil
 }
 
+// SpanID returns the id of the span containing the uncompressed offset.
+func (m *SpanManager) SpanID(offset soci.FileSize) soci.SpanId {
+	return soci.SpanId(C.pt_index_from_ucmp_offset(m.index, C.long(offset)))
+}
+
+// FetchSpans fetches the spans from start to end which haven't been requested yet, and caches them.
+// Each run of adjacent spans is fetched with a single range request, which is split back into the
+// spans to verify and cache them.
+func (m *SpanManager) FetchSpans(start, end soci.SpanId) error {
+	if end > m.ztoc.MaxSpanId {
+		end = m.ztoc.MaxSpanId
+	}
+	var run []*span
+	fetchRun := func() error {
+		if len(run) == 0 {
+			return nil
+		}
+		defer func() {
+			for _, s := range run {
+				s.mu.Unlock()
+			}
+			run = nil
+		}()
+		return m.fetchAndCacheSpans(run)
+	}
+	for id := start; id <= end; id++ {
+		s := m.spans[id]
+		s.mu.Lock()
+		if s.state.Load().(spanState) == unrequested {
+			run = append(run, s)
+			continue
+		}
+		s.mu.Unlock()
+		if err := fetchRun(); err != nil {
+			return err
+		}
+	}
+	return fetchRun()
+}
+
+// fetchAndCacheSpans fetches the adjacent spans with a single read, and caches them compressed.
+// The spans must be locked by the caller.
+func (m *SpanManager) fetchAndCacheSpans(spans []*span) error {
+	first, last := spans[0], spans[len(spans)-1]
+	for _, s := range spans {
+		if err := s.setState(requested); err != nil {
+			return err
+		}
+	}
+	// The spans which aren't fetched are fetched again on demand, with retries.
+	defer func() {
+		for _, s := range spans {
+			if s.state.Load().(spanState) == requested {
+				s.setState(unrequested)
+			}
+		}
+	}()
+	buf := make([]byte, last.endCompOffset-first.startCompOffset)
+	n, err := m.r.ReadAt(buf, int64(first.startCompOffset))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n != len(buf) {
+		return fmt.Errorf("unexpected data size for reading compressed spans. read = %d, expected = %d", n, len(buf))
+	}
+	for _, s := range spans {
+		compressedBuf := buf[s.startCompOffset-first.startCompOffset : s.endCompOffset-first.startCompOffset]
+		if err := m.verifySpanContents(compressedBuf, s.id); err != nil {
+			return err
+		}
+		m.addSpanToCache(strconv.Itoa(int(s.id)), compressedBuf, m.cacheOpt...)
+		if err := s.setState(fetched); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // GetContents returns a reader for the requested contents.
 // offsetStart and offsetEnd are start and end uncompressed offsets of the file.
 func (m *SpanManager) GetContents(offsetStart, offsetEnd soci.FileSize) (io.Reader, error) {
@@ -223,6 +486,101 @@ func (m *SpanManager) GetContents(offsetStart, offsetEnd soci.FileSize) (io.Read
 	return io.MultiReader(spanReaders...), nil
 }
 
+// ReadContents reads the contents between the uncompressed offsets offsetStart and offsetEnd of the file
+// into p, and returns the number of bytes read. The contents of the spans kept uncompressed are copied
+// from the cache or from memory into p, without intermediate buffers.
+func (m *SpanManager) ReadContents(p []byte, offsetStart, offsetEnd soci.FileSize) (int, error) {
+	si := m.getSpanInfo(offsetStart, offsetEnd)
+	numSpans := si.spanEnd - si.spanStart + 1
+	size := si.spanIndexInBuf[numSpans-1] + si.endOffInSpan[numSpans-1] - si.startOffInSpan[numSpans-1]
+	if soci.FileSize(len(p)) < size {
+		return 0, fmt.Errorf("buffer of %d bytes is too small for %d bytes of contents", len(p), size)
+	}
+
+	eg, _ := errgroup.WithContext(context.Background())
+	var i soci.SpanId
+	for i = 0; i < numSpans; i++ {
+		j := i
+		eg.Go(func() error {
+			start := si.spanIndexInBuf[j]
+			end := start + si.endOffInSpan[j] - si.startOffInSpan[j]
+			return m.readSpanContent(j+si.spanStart, p[start:end], si.startOffInSpan[j])
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return 0, err
+	}
+	return int(size), nil
+}
+
+// ArchiveReader returns a reader of the whole uncompressed archive, which reads the spans in order.
+func (m *SpanManager) ArchiveReader() io.Reader {
+	return &archiveReader{m: m}
+}
+
+type archiveReader struct {
+	m      *SpanManager
+	offset soci.FileSize
+}
+
+func (r *archiveReader) Read(p []byte) (int, error) {
+	size := r.m.ztoc.UncompressedFileSize
+	if r.offset >= size {
+		return 0, io.EOF
+	}
+	end := r.offset + soci.FileSize(len(p))
+	if end > size {
+		end = size
+	}
+	n, err := r.m.ReadContents(p, r.offset, end)
+	r.offset += soci.FileSize(n)
+	return n, err
+}
+
+// readSpanContent reads the uncompressed contents of the span at offsetStart within the span into p.
+func (m *SpanManager) readSpanContent(spanId soci.SpanId, p []byte, offsetStart soci.FileSize) error {
+	if len(p) == 0 {
+		return nil
+	}
+	err := m.readSpanFromCache(m.spans[spanId], p, offsetStart)
+	if err == nil || !errors.Is(err, ErrSpanNotAvailable) {
+		return err
+	}
+	size := soci.FileSize(len(p))
+	r, err := m.GetSpanContent(spanId, offsetStart, offsetStart+size, size)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(r, p)
+	return err
+}
+
+// readSpanFromCache reads the uncompressed contents of the span at offset within the span into p,
+// if the span is kept uncompressed in memory or in the cache. Otherwise ErrSpanNotAvailable is returned.
+func (m *SpanManager) readSpanFromCache(s *span, p []byte, offset soci.FileSize) error {
+	id := strconv.Itoa(int(s.id))
+	if b, ok := m.getHotSpan(id); ok {
+		copy(p, b[offset:])
+		return nil
+	}
+	if s.state.Load().(spanState) != uncompressed || m.cacheMode == CacheZstd {
+		return ErrSpanNotAvailable
+	}
+	r, err := m.cache.Get(id)
+	if err != nil {
+		return ErrSpanNotAvailable
+	}
+	defer r.Close()
+	n, err := r.ReadAt(p, int64(offset))
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = fmt.Errorf("unexpected data size for reading cached span %d. read = %d, expected = %d", s.id, n, len(p))
+	}
+	return err
+}
+
 // getSpanInfo returns spanInfo from the offsets of the requested file
 func (m *SpanManager) getSpanInfo(offsetStart, offsetEnd soci.FileSize) *spanInfo {
 	spanStart := soci.SpanId(C.pt_index_from_ucmp_offset(m.index, C.long(offsetStart)))
@@ -279,8 +637,16 @@ func (m *SpanManager) GetSpanContent(spanId soci.SpanId, offsetStart, offsetEnd,
 		// if the span exists in the cache but resolveSpanFromCache fails, return the error to caller
 		return nil, err
 	}
+	if state := s.state.Load().(spanState); state == fetched || state == uncompressed {
+		// The span was evicted from the cache.
+		if err := s.setState(unrequested); err != nil {
+			return nil, err
+		}
+	}
 	uncompBuf, err := m.fetchAndCacheSpan(spanId, m.r, false)
-	if err != nil {
+	if errors.Is(err, errSpanFetched) {
+		return m.resolveSpanFromCache(s, offsetStart, size)
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -325,12 +691,36 @@ func (m *SpanManager) addSpanToCache(spanId string, contents []byte, opts ...cac
 
 // resolveSpanFromCache resolves the span (in Fetched/Uncompressed state) from the cache.
 // This method returns the reader for the uncompressed span.
-// For Uncompressed span, directly return the reader from the cache.
+// For a span kept uncompressed in memory, return the reader from memory.
+// For Uncompressed span, directly return the reader from the cache, or uncompress it with zstd.
 // For Fetched span, get the compressed span from the cache, uncompress it, cache the uncompressed span and
 // returns the reader for the uncompressed span.
 func (m *SpanManager) resolveSpanFromCache(s *span, offsetStart, size soci.FileSize) (io.Reader, error) {
 	id := fmt.Sprintf("%d", s.id)
+	if b, ok := m.getHotSpan(id); ok {
+		return bytes.NewReader(b[offsetStart : offsetStart+size]), nil
+	}
 	state := s.state.Load().(spanState)
+	if state == uncompressed && m.cacheMode == CacheZstd {
+		// the size of the span compressed with zstd isn't recorded, so read the whole contents.
+		r, err := m.getSpanFromCache(id, 0, math.MaxInt64)
+		if err != nil {
+			return nil, err
+		}
+		zstdBuf, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		uncompSpanBuf, err := zstdDecoder().DecodeAll(zstdBuf, nil)
+		if err != nil {
+			return nil, err
+		}
+		if soci.FileSize(len(uncompSpanBuf)) != s.endUncompOffset-s.startUncompOffset {
+			return nil, fmt.Errorf("unexpected size of span %d uncompressed with zstd: %d", s.id, len(uncompSpanBuf))
+		}
+		m.addHotSpan(id, uncompSpanBuf)
+		return bytes.NewReader(uncompSpanBuf[offsetStart : offsetStart+size]), nil
+	}
 	if state == uncompressed {
 		r, err := m.getSpanFromCache(id, offsetStart, size)
 		if err != nil {
@@ -347,42 +737,234 @@ func (m *SpanManager) resolveSpanFromCache(s *span, offsetStart, size soci.FileS
 		}
 
 		// read the compressed span
-		compressedBuf, err := io.ReadAll(r)
-		if err != nil {
+		compressedBuf := getCompressedBuf(compressedSize)
+		defer compressedBufPool.Put(compressedBuf)
+		if _, err := io.ReadFull(r, *compressedBuf); err != nil {
 			return nil, err
 		}
 
 		// uncompress the span
-		uncompSpanBuf, err := m.uncompressSpan(s, compressedBuf)
+		uncompSpanBuf, err := m.uncompressSpan(s, *compressedBuf)
 		if err != nil {
 			return nil, err
 		}
 
 		// cache the uncompressed span
-		m.addSpanToCache(id, uncompSpanBuf, m.cacheOpt...)
-		err = s.setState(uncompressed)
-		if err != nil {
+		if err := m.cacheUncompressedSpan(s, uncompSpanBuf); err != nil {
 			return nil, err
 		}
-		return bytes.NewReader(uncompSpanBuf[offsetStart:]), nil
+		return bytes.NewReader(uncompSpanBuf[offsetStart : offsetStart+size]), nil
 	}
 	return nil, ErrSpanNotAvailable
 }
 
+// cacheUncompressedSpan caches the uncompressed contents of the span s according to the cache mode.
+// With the compressed cache mode, the span is kept compressed in the cache.
+func (m *SpanManager) cacheUncompressedSpan(s *span, uncompSpanBuf []byte) error {
+	id := strconv.Itoa(int(s.id))
+	switch m.cacheMode {
+	case CacheCompressed:
+		m.addHotSpan(id, uncompSpanBuf)
+		return nil
+	case CacheZstd:
+		m.addSpanToCache(id, zstdEncoder().EncodeAll(uncompSpanBuf, nil), m.cacheOpt...)
+		m.addHotSpan(id, uncompSpanBuf)
+	default:
+		m.addSpanToCache(id, uncompSpanBuf, m.cacheOpt...)
+	}
+	return s.setState(uncompressed)
+}
+
+// getHotSpan returns the uncompressed contents of the span kept in memory.
+func (m *SpanManager) getHotSpan(spanId string) ([]byte, bool) {
+	if m.hotSpans == nil {
+		return nil, false
+	}
+	b, done, ok := m.hotSpans.Get(spanId)
+	if !ok {
+		return nil, false
+	}
+	done() // the contents aren't reused when they're evicted
+	return b.([]byte), true
+}
+
+// addHotSpan keeps the uncompressed contents of the span in memory.
+func (m *SpanManager) addHotSpan(spanId string, uncompSpanBuf []byte) {
+	if m.hotSpans == nil {
+		return
+	}
+	_, done, _ := m.hotSpans.Add(spanId, uncompSpanBuf)
+	done()
+}
+
+// compressedBufPool pools the buffers of the compressed spans, which are only used
+// until the spans are cached and uncompressed.
+var compressedBufPool = sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+// getCompressedBuf returns a buffer of size from the pool.
+func getCompressedBuf(size soci.FileSize) *[]byte {
+	b := compressedBufPool.Get().(*[]byte)
+	if soci.FileSize(cap(*b)) < size {
+		*b = make([]byte, size)
+	}
+	*b = (*b)[:size]
+	return b
+}
+
+var (
+	zstdEncoderOnce sync.Once
+	zstdEncoderVal  *zstd.Encoder
+	zstdDecoderOnce sync.Once
+	zstdDecoderVal  *zstd.Decoder
+)
+
+// zstdEncoder returns the encoder shared to compress the spans with zstd.
+func zstdEncoder() *zstd.Encoder {
+	zstdEncoderOnce.Do(func() {
+		zstdEncoderVal, _ = zstd.NewWriter(nil)
+	})
+	return zstdEncoderVal
+}
+
+// zstdDecoder returns the decoder shared to uncompress the spans compressed with zstd.
+func zstdDecoder() *zstd.Decoder {
+	zstdDecoderOnce.Do(func() {
+		zstdDecoderVal, _ = zstd.NewReader(nil)
+	})
+	return zstdDecoderVal
+}
+
+// fetchSpan fetches the compressed span into buf from r and verifies it. Failed reads are
+// retried with backoff, and then with the mirrors in order. A host failing verification is
+// skipped for the next one, and a span failing verification on quarantineFailures passes over
+// all the hosts is quarantined. The span must be locked by the caller, and is unlocked while
+// waiting to retry so that its other readers aren't blocked. errSpanFetched is returned if one
+// of them fetched the span meanwhile.
 func (m *SpanManager) fetchSpan(buf []byte, spanId soci.SpanId, r *io.SectionReader) error {
 	s := m.spans[spanId]
+	if err := m.checkQuarantine(s); err != nil {
+		return err
+	}
 	err := s.setState(requested)
 	if err != nil {
 		return err
 	}
+	m.mirrorsMu.Lock()
+	readers := append([]*io.SectionReader{r}, m.mirrors...)
+	m.mirrorsMu.Unlock()
+	verifyFailed := false
+	for _, sr := range readers {
+		for attempt := 0; attempt <= m.maxRetries; attempt++ {
+			if attempt > 0 {
+				s.mu.Unlock()
+				time.Sleep(m.backoff(attempt))
+				s.mu.Lock()
+				switch s.state.Load().(spanState) {
+				case fetched, uncompressed:
+					return errSpanFetched
+				case quarantined:
+					return ErrSpanQuarantined
+				}
+				if err := s.setState(requested); err != nil {
+					return err
+				}
+			}
+			if err = m.readSpan(buf, s, sr); err == nil {
+				s.failures = 0
+				return nil
+			}
+			m.reportFailure(s.id, err)
+			// A host serving corrupted contents isn't retried.
+			if errors.Is(err, ErrIncorrectSpanDigest) {
+				verifyFailed = true
+				break
+			}
+		}
+	}
+	if verifyFailed {
+		s.failures++
+		if m.quarantineFailures > 0 && s.failures >= m.quarantineFailures {
+			s.failures = 0
+			s.quarantinedUntil = time.Now().Add(m.quarantineDuration)
+			if err := s.setState(quarantined); err != nil {
+				return err
+			}
+			m.reportFailure(s.id, ErrSpanQuarantined)
+			return ErrSpanQuarantined
+		}
+	}
+	// The span is fetched again on the next request.
+	if err := s.setState(unrequested); err != nil {
+		return err
+	}
+	return err
+}
+
+// readSpan reads the compressed span s into buf from r and verifies it.
+func (m *SpanManager) readSpan(buf []byte, s *span, r *io.SectionReader) error {
 	n, err := r.ReadAt(buf, int64(s.startCompOffset))
-	if err != nil {
+	if err != nil && err != io.EOF {
 		return err
 	}
-	if n != len(buf) {
+	if err == nil && n != len(buf) {
 		return fmt.Errorf("unexpected data size for reading compressed span. read = %d, expected = %d", n, len(buf))
 	}
-	return nil
+	return m.verifySpanContents(buf, s.id)
+}
+
+// checkQuarantine returns ErrSpanQuarantined if the span is quarantined, and makes the span
+// Unrequested when its quarantine expired. The span must be locked by the caller.
+func (m *SpanManager) checkQuarantine(s *span) error {
+	if s.state.Load().(spanState) != quarantined {
+		return nil
+	}
+	if time.Now().Before(s.quarantinedUntil) {
+		return ErrSpanQuarantined
+	}
+	return s.setState(unrequested)
+}
+
+// backoff returns the delay before the attempt to fetch a span, which doubles from minWait up to maxWait.
+func (m *SpanManager) backoff(attempt int) time.Duration {
+	d := m.minWait
+	for i := 1; i < attempt && d < m.maxWait; i++ {
+		d *= 2
+	}
+	if d > m.maxWait {
+		d = m.maxWait
+	}
+	return d
+}
+
+func (m *SpanManager) reportFailure(spanId soci.SpanId, err error) {
+	if !errors.Is(err, ErrSpanQuarantined) {
+		atomic.AddInt64(&m.fetchFailures, 1)
+	}
+	if m.onFailure != nil {
+		m.onFailure(spanId, err)
+	}
+}
+
+// AddMirrors adds the mirrors which the spans are fetched from after the mirrors added before.
+func (m *SpanManager) AddMirrors(mirrors ...*io.SectionReader) {
+	m.mirrorsMu.Lock()
+	defer m.mirrorsMu.Unlock()
+	m.mirrors = append(m.mirrors, mirrors...)
+}
+
+// Stats returns the statistics of the failures to fetch the spans.
+func (m *SpanManager) Stats() Stats {
+	stats := Stats{FetchFailures: atomic.LoadInt64(&m.fetchFailures)}
+	for _, s := range m.spans {
+		if s.state.Load().(spanState) == quarantined {
+			stats.QuarantinedSpans = append(stats.QuarantinedSpans, s.id)
+		}
+	}
+	return stats
 }
 
 func (m *SpanManager) uncompressSpan(s *span, compressedBuf []byte) ([]byte, error) {
@@ -404,13 +986,11 @@ func (m *SpanManager) uncompressSpan(s *span, compressedBuf []byte) ([]byte, err
 func (m *SpanManager) fetchAndCacheSpan(spanId soci.SpanId, r *io.SectionReader, isPrefetch bool) ([]byte, error) {
 	s := m.spans[spanId]
 	compressedSize := s.endCompOffset - s.startCompOffset
-	compressedBuf := make([]byte, compressedSize)
+	pooledBuf := getCompressedBuf(compressedSize)
+	defer compressedBufPool.Put(pooledBuf)
+	compressedBuf := *pooledBuf
 	err := m.fetchSpan(compressedBuf, spanId, r)
-	if err != nil && err != io.EOF {
-		return nil, err
-	}
-
-	if err := m.verifySpanContents(compressedBuf, spanId); err != nil {
+	if err != nil {
 		return nil, err
 	}
 	err = s.setState(fetched)
@@ -421,25 +1001,21 @@ func (m *SpanManager) fetchAndCacheSpan(spanId soci.SpanId, r *io.SectionReader,
 	id := strconv.Itoa(int(spanId))
 	if isPrefetch {
 		m.addSpanToCache(id, compressedBuf, m.cacheOpt...)
-		if err != nil {
-			return nil, err
-		} else {
-			return nil, nil
-		}
-	} else {
-		uncompSpanBuf, err := m.uncompressSpan(s, compressedBuf)
-		if err != nil {
-			return nil, err
-		}
+		return nil, nil
+	}
+	if m.cacheMode == CacheCompressed {
+		m.addSpanToCache(id, compressedBuf, m.cacheOpt...)
+	}
+	uncompSpanBuf, err := m.uncompressSpan(s, compressedBuf)
+	if err != nil {
+		return nil, err
+	}
 
-		// Cache the content of the whole span
-		m.addSpanToCache(id, uncompSpanBuf, m.cacheOpt...)
-		err = s.setState(uncompressed)
-		if err != nil {
-			return nil, err
-		}
-		return uncompSpanBuf, nil
+	// Cache the content of the whole span
+	if err := m.cacheUncompressedSpan(s, uncompSpanBuf); err != nil {
+		return nil, err
 	}
+	return uncompSpanBuf, nil
 }
 
 func (m *SpanManager) getEndCompressedOffset(spanId soci.SpanId) soci.FileSize {
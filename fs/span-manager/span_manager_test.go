@@ -23,7 +23,12 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/cache"
 	"github.com/awslabs/soci-snapshotter/soci"
@@ -169,6 +174,446 @@ func TestSpanManagerCache(t *testing.T) {
 	}
 }
 
+func TestSpanManagerRestore(t *testing.T) {
+	var spanSize soci.FileSize = 65536 // 64 KiB
+	fileName := "span-manager-restore-test"
+	fileContent := []byte{}
+	for i := 0; i < 10; i++ {
+		fileContent = append(fileContent, genRandomByteData(spanSize)...)
+	}
+	tarEntries := []testutil.TarEntry{
+		testutil.File(fileName, string(fileContent)),
+	}
+	ztoc, r, err := soci.BuildZtocReader(tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	dir := t.TempDir()
+	newCache := func() cache.BlobCache {
+		c, err := cache.NewDirectoryCache(dir, cache.DirectoryCacheConfig{SyncAdd: true, Persistent: true})
+		if err != nil {
+			t.Fatalf("failed to create cache: %v", err)
+		}
+		return c
+	}
+
+	// cache half of the spans compressed and the other half uncompressed
+	c := newCache()
+	m := New(ztoc, r, c)
+	var i soci.SpanId
+	for i = 0; i <= ztoc.MaxSpanId; i++ {
+		if i%2 == 0 {
+			err = m.ResolveSpan(i, r)
+		} else {
+			_, err = m.GetSpanContent(i, 0, 0, 0)
+		}
+		if err != nil {
+			t.Fatalf("error resolving span %d: %v", i, err)
+		}
+	}
+	c.Close()
+
+	// the spans are restored from the cache, so they aren't read again
+	c = newCache()
+	failing := io.NewSectionReader(readerFn(func([]byte, int64) (int, error) {
+		return 0, errors.New("span was read again")
+	}), 0, r.Size())
+	m = New(ztoc, failing, c)
+	if restored := m.Restore(); restored != len(m.spans) {
+		t.Fatalf("restored %d spans, expected %d", restored, len(m.spans))
+	}
+	for i = 0; i <= ztoc.MaxSpanId; i++ {
+		expected := uncompressed
+		if i%2 == 0 {
+			expected = fetched
+		}
+		if state := m.spans[i].state.Load().(spanState); state != expected {
+			t.Fatalf("span %d restored in state %v, expected %v", i, state, expected)
+		}
+	}
+	fileContentFromSpans, err := getFileContentFromSpans(m, ztoc, fileName)
+	if err != nil {
+		t.Fatalf("failed to read restored spans: %v", err)
+	}
+	if !bytes.Equal(fileContent, fileContentFromSpans) {
+		t.Fatalf("file contents are not the same as restored span contents")
+	}
+	c.Close()
+
+	// the compressed spans are verified, so corrupted spans aren't restored
+	dir = t.TempDir()
+	c = newCache()
+	if err := New(ztoc, r, c).ResolveSpan(0, r); err != nil {
+		t.Fatalf("error resolving span 0: %v", err)
+	}
+	c.Close()
+	f, err := os.OpenFile(filepath.Join(dir, "0"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("failed to open cached span: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("corrupted"), 0); err != nil {
+		t.Fatalf("failed to corrupt cached span: %v", err)
+	}
+	f.Close()
+	c = newCache()
+	defer c.Close()
+	m = New(ztoc, failing, c)
+	if restored := m.Restore(); restored != 0 {
+		t.Fatalf("restored %d corrupted spans", restored)
+	}
+	if state := m.spans[0].state.Load().(spanState); state != unrequested {
+		t.Fatalf("corrupted span restored in state %v", state)
+	}
+}
+
+func TestSpanManagerEviction(t *testing.T) {
+	var spanSize soci.FileSize = 65536 // 64 KiB
+	fileName := "span-manager-eviction-test"
+	fileContent := []byte{}
+	for i := 0; i < 10; i++ {
+		fileContent = append(fileContent, genRandomByteData(spanSize)...)
+	}
+	tarEntries := []testutil.TarEntry{
+		testutil.File(fileName, string(fileContent)),
+	}
+	ztoc, r, err := soci.BuildZtocReader(tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+
+	// the quota holds only a few spans, so that the spans are evicted and fetched again
+	quota := cache.NewDiskQuota(int64(3 * spanSize))
+	var evicted int64
+	quota.OnEvicted = func(string, int64) { atomic.AddInt64(&evicted, 1) }
+	c, err := cache.NewDirectoryCache(t.TempDir(), cache.DirectoryCacheConfig{SyncAdd: true, Direct: true, Quota: quota})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer c.Close()
+	m := New(ztoc, r, c, WithCacheOpts(cache.Direct()))
+	for i := 0; i < 2; i++ {
+		fileContentFromSpans, err := getFileContentFromSpans(m, ztoc, fileName)
+		if err != nil {
+			t.Fatalf("failed to read spans: %v", err)
+		}
+		if !bytes.Equal(fileContent, fileContentFromSpans) {
+			t.Fatalf("file contents are not the same as span contents")
+		}
+	}
+	if atomic.LoadInt64(&evicted) == 0 {
+		t.Fatalf("no span was evicted")
+	}
+}
+
+func TestFetchSpans(t *testing.T) {
+	var spanSize soci.FileSize = 65536 // 64 KiB
+	fileName := "fetch-spans-test"
+	fileContent := []byte{}
+	for i := 0; i < 10; i++ {
+		fileContent = append(fileContent, genRandomByteData(spanSize)...)
+	}
+	tarEntries := []testutil.TarEntry{
+		testutil.File(fileName, string(fileContent)),
+	}
+	ztoc, r, err := soci.BuildZtocReader(tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	var reads, failing int64
+	countingReader := io.NewSectionReader(readerFn(func(b []byte, off int64) (int, error) {
+		if atomic.LoadInt64(&failing) == 1 {
+			return 0, errors.New("read failed")
+		}
+		atomic.AddInt64(&reads, 1)
+		return r.ReadAt(b, off)
+	}), 0, r.Size())
+	m := New(ztoc, countingReader, cache.NewMemoryCache())
+
+	// spans which fail to be fetched can be requested again
+	atomic.StoreInt64(&failing, 1)
+	if err := m.FetchSpans(0, ztoc.MaxSpanId+1); err == nil {
+		t.Fatalf("fetching spans from a failing reader succeeded")
+	}
+	for _, s := range m.spans {
+		if state := s.state.Load().(spanState); state != unrequested {
+			t.Fatalf("span %d is in state %v after a failed fetch, expected %v", s.id, state, unrequested)
+		}
+	}
+	atomic.StoreInt64(&failing, 0)
+
+	// the span in the middle is fetched on its own, which splits the other spans into two runs
+	middle := ztoc.MaxSpanId / 2
+	if _, err := m.GetSpanContent(middle, 0, 0, 0); err != nil {
+		t.Fatalf("failed to get span %d: %v", middle, err)
+	}
+	if err := m.FetchSpans(0, ztoc.MaxSpanId+1); err != nil {
+		t.Fatalf("failed to fetch spans: %v", err)
+	}
+	if reads := atomic.LoadInt64(&reads); reads != 3 {
+		t.Fatalf("spans were fetched with %d reads, expected 3", reads)
+	}
+	for _, s := range m.spans {
+		expected := fetched
+		if s.id == middle {
+			expected = uncompressed
+		}
+		if state := s.state.Load().(spanState); state != expected {
+			t.Fatalf("span %d is in state %v, expected %v", s.id, state, expected)
+		}
+	}
+
+	// the fetched spans are read from the cache
+	fileContentFromSpans, err := getFileContentFromSpans(m, ztoc, fileName)
+	if err != nil {
+		t.Fatalf("failed to read spans: %v", err)
+	}
+	if !bytes.Equal(fileContent, fileContentFromSpans) {
+		t.Fatalf("file contents are not the same as span contents")
+	}
+	if reads := atomic.LoadInt64(&reads); reads != 3 {
+		t.Fatalf("fetched spans were read again")
+	}
+}
+
+func TestSpanManagerCacheModes(t *testing.T) {
+	var spanSize soci.FileSize = 65536 // 64 KiB
+	fileName := "span-manager-cache-modes-test"
+	fileContent := []byte{}
+	for i := 0; i < 10; i++ {
+		// half random and half repeated data, so that the spans are compressible
+		fileContent = append(fileContent, genRandomByteData(spanSize/2)...)
+		fileContent = append(fileContent, bytes.Repeat([]byte{byte(i)}, int(spanSize/2))...)
+	}
+	tarEntries := []testutil.TarEntry{
+		testutil.File(fileName, string(fileContent)),
+	}
+	ztoc, r, err := soci.BuildZtocReader(tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+
+	for _, mode := range []CacheMode{CacheCompressed, CacheZstd} {
+		t.Run(string(mode), func(t *testing.T) {
+			c := cache.NewMemoryCache().(*cache.MemoryCache)
+			m := New(ztoc, r, c, WithCacheMode(mode, 2))
+			fileContentFromSpans, err := getFileContentFromSpans(m, ztoc, fileName)
+			if err != nil {
+				t.Fatalf("failed to read spans: %v", err)
+			}
+			if !bytes.Equal(fileContent, fileContentFromSpans) {
+				t.Fatalf("file contents are not the same as span contents")
+			}
+			for _, s := range m.spans {
+				b, ok := c.Membuf[strconv.Itoa(int(s.id))]
+				if !ok {
+					t.Fatalf("span %d wasn't cached", s.id)
+				}
+				if size := soci.FileSize(b.Len()); size >= s.endUncompOffset-s.startUncompOffset {
+					t.Fatalf("span %d was cached with %d bytes, expected it compressed", s.id, size)
+				}
+			}
+
+			// the spans are read again from the cache, and uncompressed
+			failing := io.NewSectionReader(readerFn(func([]byte, int64) (int, error) {
+				return 0, errors.New("span was read again")
+			}), 0, r.Size())
+			m = New(ztoc, failing, c, WithCacheMode(mode, 2))
+			if restored := m.Restore(); restored != len(m.spans) {
+				t.Fatalf("restored %d spans, expected %d", restored, len(m.spans))
+			}
+			fileContentFromSpans, err = getFileContentFromSpans(m, ztoc, fileName)
+			if err != nil {
+				t.Fatalf("failed to read restored spans: %v", err)
+			}
+			if !bytes.Equal(fileContent, fileContentFromSpans) {
+				t.Fatalf("file contents are not the same as restored span contents")
+			}
+		})
+	}
+}
+
+func TestReadContents(t *testing.T) {
+	var spanSize soci.FileSize = 65536 // 64 KiB
+	fileName := "span-manager-read-contents-test"
+	fileContent := genRandomByteData(10 * spanSize)
+	tarEntries := []testutil.TarEntry{
+		testutil.File(fileName, string(fileContent)),
+	}
+	ztoc, r, err := soci.BuildZtocReader(tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	metadata, err := soci.GetMetadataEntry(ztoc, fileName)
+	if err != nil {
+		t.Fatalf("failed to get metadata: %v", err)
+	}
+	c, err := cache.NewDirectoryCache(t.TempDir(), cache.DirectoryCacheConfig{SyncAdd: true})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer c.Close()
+
+	read := func(m *SpanManager, start, end soci.FileSize) {
+		p := make([]byte, end-start+10)
+		n, err := m.ReadContents(p, metadata.UncompressedOffset+start, metadata.UncompressedOffset+end)
+		if err != nil {
+			t.Fatalf("failed to read contents: %v", err)
+		}
+		if !bytes.Equal(p[:n], fileContent[start:end]) {
+			t.Fatalf("contents between %d and %d aren't expected", start, end)
+		}
+	}
+	m := New(ztoc, r, c, WithCacheOpts(cache.Direct()))
+	read(m, 1000, 3*spanSize+1000)
+
+	// the spans are read from the cache
+	failing := io.NewSectionReader(readerFn(func([]byte, int64) (int, error) {
+		return 0, errors.New("span was read again")
+	}), 0, r.Size())
+	m = New(ztoc, failing, c, WithCacheOpts(cache.Direct()))
+	if restored := m.Restore(); restored == 0 {
+		t.Fatalf("no spans were restored")
+	}
+	read(m, 2000, 2*spanSize+2000)
+}
+
+func TestSpanRecovery(t *testing.T) {
+	var spanSize soci.FileSize = 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("span-recovery-test", string(genRandomByteData(4*spanSize))),
+	}
+	ztoc, r, err := soci.BuildZtocReader(tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	// failingReader fails the first failures reads, by returning an error or corrupted contents.
+	failingReader := func(failures int64, corrupt bool) *io.SectionReader {
+		var reads int64
+		return io.NewSectionReader(readerFn(func(b []byte, off int64) (int, error) {
+			if atomic.AddInt64(&reads, 1) > failures {
+				return r.ReadAt(b, off)
+			}
+			if corrupt {
+				copy(b, genRandomByteData(soci.FileSize(len(b))))
+				return len(b), nil
+			}
+			return 0, errors.New("failed to read")
+		}), 0, r.Size())
+	}
+	get := func(m *SpanManager) error {
+		_, err := m.GetSpanContent(0, 0, 0, 0)
+		return err
+	}
+
+	t.Run("retry", func(t *testing.T) {
+		m := New(ztoc, failingReader(2, false), cache.NewMemoryCache(), WithRetries(2, time.Millisecond, 2*time.Millisecond))
+		if err := get(m); err != nil {
+			t.Fatalf("span wasn't fetched with retries: %v", err)
+		}
+		if failures := m.Stats().FetchFailures; failures != 2 {
+			t.Fatalf("unexpected number of failures %d", failures)
+		}
+	})
+
+	t.Run("span isn't locked during backoff", func(t *testing.T) {
+		const backoff = time.Second
+		m := New(ztoc, failingReader(1, false), cache.NewMemoryCache(), WithRetries(1, backoff, backoff))
+		errc := make(chan error, 1)
+		go func() { errc <- get(m) }()
+		for m.Stats().FetchFailures == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		start := time.Now()
+		if err := get(m); err != nil {
+			t.Fatalf("span wasn't fetched while another reader was waiting to retry: %v", err)
+		}
+		if d := time.Since(start); d >= backoff/2 {
+			t.Fatalf("reader was blocked for %v by the backoff of another reader", d)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("span fetched by another reader wasn't read from the cache: %v", err)
+		}
+	})
+
+	t.Run("fetch again after failure", func(t *testing.T) {
+		m := New(ztoc, failingReader(1, false), cache.NewMemoryCache())
+		if err := get(m); err == nil {
+			t.Fatalf("span was fetched without retries")
+		}
+		if err := get(m); err != nil {
+			t.Fatalf("span wasn't fetched again after failure: %v", err)
+		}
+	})
+
+	t.Run("mirror", func(t *testing.T) {
+		var reported []error
+		m := New(ztoc, failingReader(1, true), cache.NewMemoryCache(),
+			WithMirrors(r),
+			WithFailureHandler(func(_ soci.SpanId, err error) { reported = append(reported, err) }))
+		if err := get(m); err != nil {
+			t.Fatalf("span wasn't fetched from the mirror: %v", err)
+		}
+		if len(reported) != 1 || !errors.Is(reported[0], ErrIncorrectSpanDigest) {
+			t.Fatalf("unexpected failures reported: %v", reported)
+		}
+	})
+
+	t.Run("mirror with default retries", func(t *testing.T) {
+		var reads int64
+		corrupted := io.NewSectionReader(readerFn(func(b []byte, off int64) (int, error) {
+			atomic.AddInt64(&reads, 1)
+			copy(b, genRandomByteData(soci.FileSize(len(b))))
+			return len(b), nil
+		}), 0, r.Size())
+		m := New(ztoc, corrupted, cache.NewMemoryCache(),
+			WithMirrors(r),
+			WithRetries(2, time.Millisecond, time.Millisecond),
+			WithQuarantine(3, time.Hour))
+		for i := soci.SpanId(0); i <= ztoc.MaxSpanId; i++ {
+			if _, err := m.GetSpanContent(i, 0, 0, 0); err != nil {
+				t.Fatalf("span %d wasn't fetched from the mirror: %v", i, err)
+			}
+		}
+		if reads := atomic.LoadInt64(&reads); reads != int64(ztoc.MaxSpanId)+1 {
+			t.Fatalf("corrupted spans were read %d times, expected %d", reads, ztoc.MaxSpanId+1)
+		}
+		if stats := m.Stats(); len(stats.QuarantinedSpans) != 0 {
+			t.Fatalf("spans were quarantined: %+v", stats)
+		}
+	})
+
+	t.Run("quarantine", func(t *testing.T) {
+		m := New(ztoc, failingReader(2, true), cache.NewMemoryCache(),
+			WithRetries(1, time.Millisecond, time.Millisecond),
+			WithQuarantine(2, time.Hour))
+		// a fetch fails verification once, however many times the host is retried
+		if err := get(m); !errors.Is(err, ErrIncorrectSpanDigest) {
+			t.Fatalf("unexpected error fetching corrupted span: %v", err)
+		}
+		if stats := m.Stats(); len(stats.QuarantinedSpans) != 0 {
+			t.Fatalf("span was quarantined after one failed fetch: %+v", stats)
+		}
+		if err := get(m); !errors.Is(err, ErrSpanQuarantined) {
+			t.Fatalf("span wasn't quarantined: %v", err)
+		}
+		if stats := m.Stats(); len(stats.QuarantinedSpans) != 1 || stats.QuarantinedSpans[0] != 0 {
+			t.Fatalf("quarantined span wasn't reported: %+v", stats)
+		}
+		if err := get(m); !errors.Is(err, ErrSpanQuarantined) {
+			t.Fatalf("quarantined span was fetched: %v", err)
+		}
+
+		// the span is fetched again once the quarantine expires
+		m.spans[0].quarantinedUntil = time.Now()
+		if err := get(m); err != nil {
+			t.Fatalf("span wasn't fetched after the quarantine: %v", err)
+		}
+		if stats := m.Stats(); len(stats.QuarantinedSpans) != 0 {
+			t.Fatalf("span is still quarantined: %+v", stats)
+		}
+	})
+}
+
 func TestStateTransition(t *testing.T) {
 	var spanSize soci.FileSize = 65536 // 64 KiB
 	content := genRandomByteData(spanSize)
@@ -266,31 +711,31 @@ func TestValidateState(t *testing.T) {
 		{
 			name:         "span in Requested state with valid new state",
 			currentState: requested,
-			newState:     []spanState{requested, fetched},
+			newState:     []spanState{requested, fetched, unrequested, quarantined},
 			expectedErr:  nil,
 		},
 		{
 			name:         "span in Requested state with invalid new state",
 			currentState: requested,
-			newState:     []spanState{unrequested},
+			newState:     []spanState{uncompressed},
 			expectedErr:  errInvalidSpanStateTransition,
 		},
 		{
 			name:         "span in Fetched state with valid new state",
 			currentState: fetched,
-			newState:     []spanState{uncompressed, fetched},
+			newState:     []spanState{uncompressed, fetched, unrequested},
 			expectedErr:  nil,
 		},
 		{
 			name:         "span in Fetched state with invalid new state",
 			currentState: fetched,
-			newState:     []spanState{unrequested},
+			newState:     []spanState{requested},
 			expectedErr:  errInvalidSpanStateTransition,
 		},
 		{
 			name:         "span in Uncompressed state with valid new state",
 			currentState: uncompressed,
-			newState:     []spanState{uncompressed},
+			newState:     []spanState{uncompressed, unrequested},
 			expectedErr:  nil,
 		},
 		{
@@ -299,6 +744,18 @@ func TestValidateState(t *testing.T) {
 			newState:     []spanState{fetched},
 			expectedErr:  errInvalidSpanStateTransition,
 		},
+		{
+			name:         "span in Quarantined state with valid new state",
+			currentState: quarantined,
+			newState:     []spanState{quarantined, unrequested},
+			expectedErr:  nil,
+		},
+		{
+			name:         "span in Quarantined state with invalid new state",
+			currentState: quarantined,
+			newState:     []spanState{requested, fetched},
+			expectedErr:  errInvalidSpanStateTransition,
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -0,0 +1,54 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package dockerconfig
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Tests that DockerCreds gets the credentials of a registry host from its credential helper.
+func TestDockerCredsHelper(t *testing.T) {
+	dir := t.TempDir()
+	config := `{"credHelpers": {"registry.example.com": "soci-test"}}`
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600); err != nil {
+		t.Fatalf("cannot write docker config: %v", err)
+	}
+	helper := `#!/bin/sh
+read host
+echo "{\"ServerURL\": \"$host\", \"Username\": \"user\", \"Secret\": \"secret of $host\"}"
+`
+	if err := os.WriteFile(filepath.Join(dir, "docker-credential-soci-test"), []byte(helper), 0700); err != nil {
+		t.Fatalf("cannot write credential helper: %v", err)
+	}
+	t.Setenv("DOCKER_CONFIG", dir)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	username, secret, err := DockerCreds("registry.example.com")
+	if err != nil {
+		t.Fatalf("cannot get credentials: %v", err)
+	}
+	if username != "user" || secret != "secret of registry.example.com" {
+		t.Fatalf("unexpected credentials %q:%q", username, secret)
+	}
+	// hosts without a credential helper have no credentials
+	username, secret, err = DockerCreds("other.example.com")
+	if err != nil || username != "" || secret != "" {
+		t.Fatalf("unexpected credentials %q:%q: %v", username, secret, err)
+	}
+}
@@ -100,7 +100,11 @@ func NewSociSnapshotterService(ctx context.Context, root string, config *Config,
 
 	var snapshotter snapshots.Snapshotter
 
-	snapshotter, err = snbase.NewSnapshotter(ctx, snapshotterRoot(root), fs, snbase.AsynchronousRemove)
+	snOpts := []snbase.Opt{snbase.AsynchronousRemove}
+	if config.GraduateFetchedLayers && !config.NoBackgroundFetch {
+		snOpts = append(snOpts, snbase.GraduateFetchedLayers)
+	}
+	snapshotter, err = snbase.NewSnapshotter(ctx, snapshotterRoot(root), fs, snOpts...)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to create new snapshotter")
 	}
@@ -38,6 +38,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/awslabs/soci-snapshotter/snapshot/overlayutils"
@@ -90,9 +91,16 @@ type FileSystem interface {
 	MountLocal(ctx context.Context, mountpoint string, labels map[string]string) error
 }
 
+// Graduator is a FileSystem which can unpack the layers it mounts into local directories.
+type Graduator interface {
+	// Graduate waits until the layer mounted at mountpoint is fully fetched, and unpacks it into dir.
+	Graduate(ctx context.Context, mountpoint, dir string) error
+}
+
 // SnapshotterConfig is used to configure the remote snapshotter instance
 type SnapshotterConfig struct {
 	asyncRemove bool
+	graduate    bool
 }
 
 // Opt is an option to configure the remote snapshotter
@@ -107,14 +115,39 @@ func AsynchronousRemove(config *SnapshotterConfig) error {
 	return nil
 }
 
+// GraduateFetchedLayers unpacks remote snapshots into local directories once their layers
+// are fully fetched, if the filesystem is a Graduator. The new mounts use the directories
+// instead of the remote snapshots, which are unmounted once the mounts using them are gone.
+func GraduateFetchedLayers(config *SnapshotterConfig) error {
+	config.graduate = true
+	return nil
+}
+
 type snapshotter struct {
 	root        string
 	ms          *storage.MetaStore
 	asyncRemove bool
+	graduate    bool
 
 	// fs is a filesystem that this snapshotter recognizes.
 	fs        FileSystem
 	userxattr bool // whether to enable "userxattr" mount option
+
+	// remoteMounts are the remote snapshots being graduated, or graduated and still used.
+	remoteMounts   map[string]*remoteMount
+	remoteMountsMu sync.Mutex
+}
+
+// remoteMount is a remote snapshot which is graduated to a local directory once its layer is fetched.
+type remoteMount struct {
+	graduated bool
+
+	// cancel cancels the graduation of the remote snapshot once it's removed.
+	cancel context.CancelFunc
+
+	// refs are the IDs of the snapshots prepared with the mount of the remote snapshot.
+	// The mount is unmounted once it's graduated and isn't referenced anymore.
+	refs map[string]struct{}
 }
 
 // NewSnapshotter returns a Snapshotter which can use unpacked remote layers
@@ -158,11 +191,13 @@ func NewSnapshotter(ctx context.Context, root string, targetFs FileSystem, opts
 	}
 
 	o := &snapshotter{
-		root:        root,
-		ms:          ms,
-		asyncRemove: config.asyncRemove,
-		fs:          targetFs,
-		userxattr:   userxattr,
+		root:         root,
+		ms:           ms,
+		asyncRemove:  config.asyncRemove,
+		graduate:     config.graduate,
+		fs:           targetFs,
+		userxattr:    userxattr,
+		remoteMounts: make(map[string]*remoteMount),
 	}
 
 	if err := o.restoreRemoteSnapshot(ctx); err != nil {
@@ -365,7 +400,11 @@ func (o *snapshotter) commit(ctx context.Context, isRemote bool, name, key strin
 		return errors.Wrap(err, "failed to commit snapshot")
 	}
 
-	return t.Commit()
+	if err = t.Commit(); err != nil {
+		return err
+	}
+	o.releaseRemoteMounts(ctx, id)
+	return nil
 }
 
 // Remove abandons the snapshot identified by key. The snapshot will
@@ -384,10 +423,21 @@ func (o *snapshotter) Remove(ctx context.Context, key string) (err error) {
 		}
 	}()
 
-	_, _, err = storage.Remove(ctx, key)
+	id, _, err := storage.Remove(ctx, key)
 	if err != nil {
 		return errors.Wrap(err, "failed to remove")
 	}
+	defer func() {
+		if err == nil {
+			o.remoteMountsMu.Lock()
+			if m, ok := o.remoteMounts[id]; ok {
+				m.cancel()
+				delete(o.remoteMounts, id)
+			}
+			o.remoteMountsMu.Unlock()
+			o.releaseRemoteMounts(ctx, id)
+		}
+	}()
 
 	if !o.asyncRemove {
 		var removals []string
@@ -552,7 +602,7 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 	}
 
 	if len(s.ParentIDs) > 0 {
-		st, err := os.Stat(o.upperPath(s.ParentIDs[0]))
+		st, err := os.Stat(o.lowerPath(s.ParentIDs[0], s.ID))
 		if err != nil {
 			return storage.Snapshot{}, errors.Wrap(err, "failed to stat parent")
 		}
@@ -577,6 +627,7 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 	if err = t.Commit(); err != nil {
 		return storage.Snapshot{}, errors.Wrap(err, "commit failed")
 	}
+	o.useRemoteMounts(s)
 
 	return s, nil
 }
@@ -635,7 +686,7 @@ func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey s
 	} else if len(s.ParentIDs) == 1 {
 		return []mount.Mount{
 			{
-				Source: o.upperPath(s.ParentIDs[0]),
+				Source: o.lowerPath(s.ParentIDs[0], s.ID),
 				Type:   "bind",
 				Options: []string{
 					"ro",
@@ -647,7 +698,7 @@ func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey s
 
 	parentPaths := make([]string, len(s.ParentIDs))
 	for i := range s.ParentIDs {
-		parentPaths[i] = o.upperPath(s.ParentIDs[i])
+		parentPaths[i] = o.lowerPath(s.ParentIDs[i], s.ID)
 	}
 
 	options = append(options, fmt.Sprintf("lowerdir=%s", strings.Join(parentPaths, ":")))
@@ -672,6 +723,32 @@ func (o *snapshotter) workPath(id string) string {
 	return filepath.Join(o.root, "snapshots", id, "work")
 }
 
+// localPath is the directory a remote snapshot is unpacked into once its layer is fully fetched.
+func (o *snapshotter) localPath(id string) string {
+	return filepath.Join(o.root, "snapshots", id, "local")
+}
+
+// lowerPath returns the directory of the snapshot id to use as a lower directory of the
+// snapshot refID. The snapshots prepared with the mount of a remote snapshot keep using it.
+func (o *snapshotter) lowerPath(id, refID string) string {
+	o.remoteMountsMu.Lock()
+	defer o.remoteMountsMu.Unlock()
+	if m, ok := o.remoteMounts[id]; ok {
+		if _, ok := m.refs[refID]; ok || !m.graduated {
+			return o.upperPath(id)
+		}
+	}
+	if o.isGraduated(id) {
+		return o.localPath(id)
+	}
+	return o.upperPath(id)
+}
+
+func (o *snapshotter) isGraduated(id string) bool {
+	_, err := os.Stat(o.localPath(id))
+	return err == nil
+}
+
 // Close closes the snapshotter
 func (o *snapshotter) Close() error {
 	// unmount all mounts including Committed
@@ -712,10 +789,118 @@ func (o *snapshotter) prepareRemoteSnapshot(ctx context.Context, key string, lab
 		return err
 	}
 
+	// A graduated snapshot, e.g. restored after a restart, isn't mounted anymore.
+	if o.isGraduated(id) {
+		return nil
+	}
+
 	mountpoint := o.upperPath(id)
 	log.G(ctx).Infof("preparing filesystem mount at mountpoint=%v", mountpoint)
 
-	return o.fs.Mount(ctx, mountpoint, labels)
+	if err := o.fs.Mount(ctx, mountpoint, labels); err != nil {
+		return err
+	}
+	if g, ok := o.fs.(Graduator); ok && o.graduate {
+		gctx, cancel := context.WithCancel(log.WithLogger(context.Background(), log.G(ctx)))
+		o.remoteMountsMu.Lock()
+		o.remoteMounts[id] = &remoteMount{cancel: cancel, refs: make(map[string]struct{})}
+		o.remoteMountsMu.Unlock()
+		go o.graduateSnapshot(gctx, g, id)
+	}
+	return nil
+}
+
+// useRemoteMounts makes the snapshot s reference the mounts of its parents which aren't graduated yet.
+func (o *snapshotter) useRemoteMounts(s storage.Snapshot) {
+	o.remoteMountsMu.Lock()
+	defer o.remoteMountsMu.Unlock()
+	for _, id := range s.ParentIDs {
+		if m, ok := o.remoteMounts[id]; ok && !m.graduated {
+			m.refs[s.ID] = struct{}{}
+		}
+	}
+}
+
+// releaseRemoteMounts releases the references of the snapshot id to the remote mounts, and
+// unmounts the graduated ones which aren't referenced anymore.
+func (o *snapshotter) releaseRemoteMounts(ctx context.Context, id string) {
+	var unused []string
+	o.remoteMountsMu.Lock()
+	for rid, m := range o.remoteMounts {
+		if _, ok := m.refs[id]; !ok {
+			continue
+		}
+		delete(m.refs, id)
+		if m.graduated && len(m.refs) == 0 {
+			m.cancel()
+			delete(o.remoteMounts, rid)
+			unused = append(unused, rid)
+		}
+	}
+	o.remoteMountsMu.Unlock()
+	for _, rid := range unused {
+		o.unmountGraduated(ctx, rid)
+	}
+}
+
+func (o *snapshotter) unmountGraduated(ctx context.Context, id string) {
+	mountpoint := o.upperPath(id)
+	if err := o.fs.Unmount(ctx, mountpoint); err != nil {
+		log.G(ctx).WithError(err).WithField("mount-point", mountpoint).Warn("failed to unmount graduated snapshot")
+		return
+	}
+	log.G(ctx).Debugf("unmounted graduated snapshot at mountpoint=%v", mountpoint)
+}
+
+// graduateSnapshot unpacks the remote snapshot id into its local directory once its layer is
+// fully fetched. The remote snapshot is unmounted once the snapshots prepared with it are
+// committed or removed.
+func (o *snapshotter) graduateSnapshot(ctx context.Context, g Graduator, id string) {
+	mountpoint := o.upperPath(id)
+	// Remove the directories left by the graduations interrupted before a restart.
+	if stale, err := filepath.Glob(filepath.Join(o.root, "snapshots", id, "local-*")); err == nil {
+		for _, dir := range stale {
+			os.RemoveAll(dir)
+		}
+	}
+	tmp, err := os.MkdirTemp(filepath.Join(o.root, "snapshots", id), "local-")
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to create directory to graduate snapshot")
+		return
+	}
+	if err := g.Graduate(ctx, mountpoint, tmp); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to graduate snapshot")
+		os.RemoveAll(tmp)
+		return
+	}
+
+	// The snapshot may have been removed while it was unpacked, so its directory may be
+	// being deleted. The mount is re-checked under the lock Remove takes to release it.
+	o.remoteMountsMu.Lock()
+	m, ok := o.remoteMounts[id]
+	if !ok || ctx.Err() != nil {
+		o.remoteMountsMu.Unlock()
+		log.G(ctx).Debugf("snapshot at mountpoint=%v was removed while graduated", mountpoint)
+		os.RemoveAll(tmp)
+		return
+	}
+	if err := os.Rename(tmp, o.localPath(id)); err != nil {
+		o.remoteMountsMu.Unlock()
+		log.G(ctx).WithError(err).Warn("failed to graduate snapshot")
+		os.RemoveAll(tmp)
+		return
+	}
+	m.graduated = true
+	unused := len(m.refs) == 0
+	if unused {
+		m.cancel()
+		delete(o.remoteMounts, id)
+	}
+	o.remoteMountsMu.Unlock()
+	log.G(ctx).Infof("graduated snapshot at mountpoint=%v", mountpoint)
+	if unused {
+		o.unmountGraduated(ctx, id)
+	}
 }
 
 // checkAvailability checks avaiability of the specified layer and all lower
@@ -740,7 +925,9 @@ func (o *snapshotter) checkAvailability(ctx context.Context, key string) bool {
 		}
 		mp := o.upperPath(id)
 		lCtx := log.WithLogger(ctx, log.G(ctx).WithField("mount-point", mp))
-		if _, ok := info.Labels[remoteLabel]; ok {
+		if _, ok := info.Labels[remoteLabel]; ok && o.isGraduated(id) {
+			log.G(lCtx).Debug("layer is graduated remote snapshot")
+		} else if ok {
 			eg.Go(func() error {
 				log.G(lCtx).Debug("checking mount point")
 				if err := o.fs.Check(egCtx, mp, info.Labels); err != nil {
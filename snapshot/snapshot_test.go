@@ -35,11 +35,13 @@ package snapshot
 import (
 	"context"
 	_ "crypto/sha256"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/mount"
@@ -47,6 +49,7 @@ import (
 	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/containerd/snapshots/storage"
 	"github.com/containerd/containerd/snapshots/testsuite"
+	"github.com/moby/sys/mountinfo"
 )
 
 const (
@@ -177,6 +180,118 @@ func TestRemoteOverlay(t *testing.T) {
 	}
 }
 
+func TestRemoteGraduation(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := os.MkdirTemp("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	bfs := bindFileSystem(t).(*bindFs)
+	bfs.graduate = make(chan struct{})
+	sn, err := NewSnapshotter(context.TODO(), root, bfs, GraduateFetchedLayers)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+
+	// Prepare a layer based on a remote snapshot, which is graduated in background.
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	defer sn.Remove(ctx, target)
+	pKey := "/tmp/test"
+	if _, err := sn.Prepare(ctx, pKey, target); err != nil {
+		t.Fatalf("faild to prepare using lower remote layer: %v", err)
+	}
+	remote := getParents(ctx, sn, root, pKey)[0]
+	local := filepath.Join(filepath.Dir(remote), "local")
+	close(bfs.graduate)
+	for i := 0; ; i++ {
+		if _, err := os.Stat(local); err == nil {
+			break
+		} else if i == 100 {
+			t.Fatalf("remote snapshot wasn't graduated: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// New layers based on the remote snapshot use the graduated directory.
+	mounts, err := sn.Prepare(ctx, "/tmp/test2", target)
+	if err != nil {
+		t.Fatalf("faild to prepare using lower graduated layer: %v", err)
+	}
+	if lower := "lowerdir=" + local; len(mounts) != 1 || mounts[0].Options[2] != lower {
+		t.Fatalf("expected mount with %q but received %v", lower, mounts)
+	}
+	data, err := os.ReadFile(filepath.Join(local, remoteSampleFile))
+	if err != nil {
+		t.Fatalf("failed to read a file in the graduated snapshot: %v", err)
+	}
+	if e := string(data); e != remoteSampleFileContents {
+		t.Fatalf("expected file contents %q but got %q", remoteSampleFileContents, e)
+	}
+
+	// The layer prepared before keeps using the remote snapshot, which is unmounted once
+	// the layer is removed.
+	mounts, err = sn.Mounts(ctx, pKey)
+	if err != nil {
+		t.Fatalf("failed to get mounts of layer prepared before graduation: %v", err)
+	}
+	if lower := "lowerdir=" + remote; len(mounts) != 1 || mounts[0].Options[2] != lower {
+		t.Fatalf("expected mount with %q but received %v", lower, mounts)
+	}
+	if mounted, err := mountinfo.Mounted(remote); err != nil || !mounted {
+		t.Fatalf("used remote snapshot isn't mounted: %v", err)
+	}
+	if err := sn.Remove(ctx, pKey); err != nil {
+		t.Fatalf("failed to remove layer: %v", err)
+	}
+	if mounted, err := mountinfo.Mounted(remote); err != nil || mounted {
+		t.Fatalf("unused graduated snapshot is still mounted: %v", err)
+	}
+}
+
+func TestRemoteGraduationRemoved(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := os.MkdirTemp("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	bfs := bindFileSystem(t).(*bindFs)
+	bfs.graduate = make(chan struct{})
+	bfs.graduated = make(chan error, 1)
+	sn, err := NewSnapshotter(context.TODO(), root, bfs, GraduateFetchedLayers)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+
+	// Removing the remote snapshot cancels its graduation.
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	for i := 0; ; i++ {
+		if tmp, err := filepath.Glob(filepath.Join(root, "snapshots", "*", "local-*")); err == nil && len(tmp) > 0 {
+			break
+		} else if i == 100 {
+			t.Fatalf("remote snapshot isn't graduated: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := sn.Remove(ctx, target); err != nil {
+		t.Fatalf("failed to remove remote snapshot: %v", err)
+	}
+	select {
+	case err := <-bfs.graduated:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected graduation to be canceled but got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("graduation of removed snapshot wasn't canceled")
+	}
+	if local, err := filepath.Glob(filepath.Join(root, "snapshots", "*", "local*")); err != nil || len(local) != 0 {
+		t.Fatalf("removed snapshot was graduated into %v: %v", local, err)
+	}
+}
+
 func TestRemoteCommit(t *testing.T) {
 	testutil.RequiresRoot(t)
 	ctx := context.TODO()
@@ -409,6 +524,11 @@ type bindFs struct {
 	root         string
 	checkFailure bool
 	broken       map[string]bool
+
+	// graduate blocks graduation until it's closed, if it isn't nil.
+	graduate chan struct{}
+	// graduated receives the result of the graduations, if it isn't nil.
+	graduated chan error
 }
 
 func (fs *bindFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
@@ -434,6 +554,20 @@ func (fs *bindFs) Unmount(ctx context.Context, mountpoint string) error {
 	return syscall.Unmount(mountpoint, 0)
 }
 
+func (fs *bindFs) Graduate(ctx context.Context, mountpoint, dir string) (err error) {
+	if fs.graduated != nil {
+		defer func() { fs.graduated <- err }()
+	}
+	if fs.graduate != nil {
+		select {
+		case <-fs.graduate:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return os.WriteFile(filepath.Join(dir, remoteSampleFile), []byte(remoteSampleFileContents), 0660)
+}
+
 func (fs *bindFs) MountLocal(ctx context.Context, mountpoint string, labels map[string]string) error {
 	if _, ok := labels[brokenLabel]; ok {
 		fs.broken[mountpoint] = true
@@ -18,6 +18,7 @@ package soci
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path"
@@ -27,6 +28,8 @@ import (
 	"github.com/awslabs/soci-snapshotter/util/dbutil"
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -40,6 +43,7 @@ import (
 //         - platform: <string>         : the platform for the index
 //         - location: <string>         : the location of the artifact
 //         - type: <string>             : the type of the artifact (can be either "soci_index" or "soci_layer")
+//         - supersedes: <string>       : the digest of the index which an updated index supersedes
 
 // ArtifactsDB is a store for SOCI artifact metadata
 type ArtifactsDb struct {
@@ -57,6 +61,7 @@ var (
 	bucketKeyPlatform       = []byte("platform")
 	bucketKeyLocation       = []byte("location")
 	bucketKeyType           = []byte("type")
+	bucketKeySupersedes     = []byte("supersedes")
 
 	artifactsDbName = "artifacts.db"
 	// ArtifactEntryTypeIndex indicates that an ArtifactEntry is a SOCI index artifact
@@ -86,6 +91,8 @@ type ArtifactEntry struct {
 	Location string
 	// Type is the type of SOCI artifact.
 	Type ArtifactEntryType
+	// Supersedes is the digest of the SOCI index which a SOCI index was updated from, if any.
+	Supersedes string
 }
 
 func getIndexArtifactEntries(indexDigest string) ([]ArtifactEntry, error) {
@@ -112,6 +119,35 @@ func writeArtifactEntry(entry *ArtifactEntry) error {
 	return artifacts.WriteArtifactEntry(entry)
 }
 
+// LayerZtocDescriptor returns the Descriptor of a ztoc of the image layer with the given digest
+// in the local content store, or errdefs.ErrNotFound if there is none.
+func LayerZtocDescriptor(layerDigest digest.Digest) (ocispec.Descriptor, error) {
+	artifacts, err := NewDB()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return artifacts.LayerZtocDescriptor(layerDigest)
+}
+
+// IndexFilter selects the SOCI index ArtifactEntries returned by ListIndices.
+type IndexFilter func(*ArtifactEntry) bool
+
+// ManifestDigestFilter selects the SOCI indices of the image manifest with the given digest.
+func ManifestDigestFilter(manifestDigest string) IndexFilter {
+	return func(ae *ArtifactEntry) bool {
+		return ae.OriginalDigest == manifestDigest
+	}
+}
+
+// ListIndices returns the SOCI index ArtifactEntries selected by filter, or all of them if filter is nil.
+func ListIndices(filter IndexFilter) ([]ArtifactEntry, error) {
+	artifacts, err := NewDB()
+	if err != nil {
+		return nil, err
+	}
+	return artifacts.ListIndices(filter)
+}
+
 // NewDB returns an instance of an ArtifactsDB
 func NewDB() (*ArtifactsDb, error) {
 	once.Do(func() {
@@ -138,16 +174,19 @@ func NewDB() (*ArtifactsDb, error) {
 }
 
 func (db *ArtifactsDb) getIndexArtifactEntries(indexDigest string) ([]ArtifactEntry, error) {
+	return db.ListIndices(ManifestDigestFilter(indexDigest))
+}
+
+// ListIndices returns the SOCI index ArtifactEntries selected by filter, or all of them if filter is nil.
+func (db *ArtifactsDb) ListIndices(filter IndexFilter) ([]ArtifactEntry, error) {
 	artifactEntries := []ArtifactEntry{}
 	err := db.Walk(func(ae *ArtifactEntry) error {
-		if ae.Type == ArtifactEntryTypeIndex && ae.OriginalDigest == indexDigest {
+		if ae.Type == ArtifactEntryTypeIndex && (filter == nil || filter(ae)) {
 			artifactEntries = append(artifactEntries, *ae)
 		}
 		return nil
 	})
-
 	return artifactEntries, err
-
 }
 
 // Walk applys a function to all ArtifactEntries in the ArtifactsDB
@@ -174,6 +213,29 @@ func (db *ArtifactsDb) Walk(f func(*ArtifactEntry) error) error {
 	return err
 }
 
+// LayerZtocDescriptor returns the Descriptor of a ztoc of the image layer with the given digest,
+// or errdefs.ErrNotFound if there is none.
+func (db *ArtifactsDb) LayerZtocDescriptor(layerDigest digest.Digest) (ocispec.Descriptor, error) {
+	var ztoc *ArtifactEntry
+	err := db.Walk(func(ae *ArtifactEntry) error {
+		if ztoc == nil && ae.Type == ArtifactEntryTypeLayer && ae.OriginalDigest == layerDigest.String() {
+			ztoc = ae
+		}
+		return nil
+	})
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if ztoc == nil {
+		return ocispec.Descriptor{}, fmt.Errorf("no ztoc for layer %s: %w", layerDigest, errdefs.ErrNotFound)
+	}
+	ztocDigest, err := digest.Parse(ztoc.Digest)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return ztocDescriptor(ztocDigest, ztoc.Size, layerDigest), nil
+}
+
 // GetArtifactEntry loads a single ArtifactEntry from the ArtifactsDB by digest
 func (db *ArtifactsDb) GetArtifactEntry(digest string) (*ArtifactEntry, error) {
 	entry := ArtifactEntry{}
@@ -214,6 +276,21 @@ func (db *ArtifactsDb) WriteArtifactEntry(entry *ArtifactEntry) error {
 	return err
 }
 
+// RemoveArtifactEntry removes the ArtifactEntry with the given digest from the ArtifactsDB.
+func (db *ArtifactsDb) RemoveArtifactEntry(digest string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := getArtifactsBucket(tx)
+		if err != nil {
+			return err
+		}
+		err = bucket.DeleteBucket([]byte(digest))
+		if errors.Is(err, bolt.ErrBucketNotFound) {
+			return fmt.Errorf("couldn't remove artifact for %s, %w", digest, errdefs.ErrNotFound)
+		}
+		return err
+	})
+}
+
 func getArtifactsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
 	artifacts := tx.Bucket(bucketKeySociArtifacts)
 	if artifacts == nil {
@@ -246,6 +323,7 @@ func loadArtifact(artifactBkt *bolt.Bucket, digest string) (*ArtifactEntry, erro
 	ae.OriginalDigest = string(artifactBkt.Get(bucketKeyOriginalDigest))
 	ae.ImageDigest = string(artifactBkt.Get(bucketKeyImageDigest))
 	ae.Platform = string(artifactBkt.Get(bucketKeyPlatform))
+	ae.Supersedes = string(artifactBkt.Get(bucketKeySupersedes))
 	return &ae, nil
 }
 
@@ -274,6 +352,7 @@ func putArtifactEntry(artifacts *bolt.Bucket, ae *ArtifactEntry) error {
 		{bucketKeyImageDigest, []byte(ae.ImageDigest)},
 		{bucketKeyPlatform, []byte(ae.Platform)},
 		{bucketKeyType, []byte(ae.Type)},
+		{bucketKeySupersedes, []byte(ae.Supersedes)},
 	}
 
 	for _, update := range updates {
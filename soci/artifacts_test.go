@@ -17,9 +17,12 @@
 package soci
 
 import (
+	"errors"
 	"os"
 	"testing"
 
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -97,6 +100,71 @@ func TestGetIndexArtifactEntries(t *testing.T) {
 	}
 }
 
+func TestListIndices(t *testing.T) {
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	const (
+		manifestDigest1 = "sha256:1236aec48c0a74635a5f3dc666628c1673afaa21ed6e1270a9a44de66e811111"
+		manifestDigest2 = "sha256:bbbbbbb48c0a74635a5f3dc666628c1673afaa21ed6e1270a9a44de66e811111"
+	)
+	entries := []ArtifactEntry{
+		{Digest: "sha256:10d6aec48c0a74635a5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55", OriginalDigest: manifestDigest1, Type: ArtifactEntryTypeIndex},
+		{Digest: "sha256:20d6a9c48c0a74635a5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55", OriginalDigest: manifestDigest2, Type: ArtifactEntryTypeIndex},
+		{Digest: "sha256:99d6aec48caaaaaaaa5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55", OriginalDigest: manifestDigest1, Type: ArtifactEntryTypeLayer},
+	}
+	for _, entry := range entries {
+		if err := db.WriteArtifactEntry(&entry); err != nil {
+			t.Fatalf("can't put ArtifactEntry to a bucket")
+		}
+	}
+
+	all, err := db.ListIndices(nil)
+	if err != nil {
+		t.Fatalf("could not list indices: %v", err)
+	}
+	if len(all) != 2 || all[0] != entries[0] || all[1] != entries[1] {
+		t.Fatalf("unexpected indices %v", all)
+	}
+	filtered, err := db.ListIndices(ManifestDigestFilter(manifestDigest2))
+	if err != nil {
+		t.Fatalf("could not list indices: %v", err)
+	}
+	if len(filtered) != 1 || filtered[0] != entries[1] {
+		t.Fatalf("unexpected indices for manifest %s: %v", manifestDigest2, filtered)
+	}
+}
+
+func TestLayerZtocDescriptor(t *testing.T) {
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	layerDigest := digest.Digest("sha256:1236aec48c0a74635a5f3dc666628c1673afaa21ed6e1270a9a44de66e811111")
+	entry := ArtifactEntry{
+		Digest:         "sha256:99d6aec48caaaaaaaa5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55",
+		OriginalDigest: layerDigest.String(),
+		Type:           ArtifactEntryTypeLayer,
+		Size:           100,
+	}
+	if err := db.WriteArtifactEntry(&entry); err != nil {
+		t.Fatalf("can't put ArtifactEntry to a bucket")
+	}
+
+	desc, err := db.LayerZtocDescriptor(layerDigest)
+	if err != nil {
+		t.Fatalf("could not find ztoc: %v", err)
+	}
+	if desc.Digest.String() != entry.Digest || desc.Size != entry.Size || desc.Annotations[IndexAnnotationImageLayerDigest] != layerDigest.String() {
+		t.Fatalf("unexpected ztoc descriptor %v", desc)
+	}
+	_, err = db.LayerZtocDescriptor(digest.Digest("sha256:bbbbbbb48c0a74635a5f3dc666628c1673afaa21ed6e1270a9a44de66e811111"))
+	if !errors.Is(err, errdefs.ErrNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
 func TestGetArtifactEntry_ArtifactDB_DoesNotExist(t *testing.T) {
 	dgst := "sha256:80d6aec48c0a74635a5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55"
 	_, err := getArtifactEntry(dgst)
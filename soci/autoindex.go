@@ -0,0 +1,410 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/util/dbutil"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Auto-indexing jobs are stored in the ArtifactsDB in the following schema.
+//
+// - autoindex_jobs
+//       - *image_manifest_digest*      : bucket for each job keyed by the digest of the image manifest.
+//         - image_name: <string>       : the name of the image which the job was created for
+//         - status: <string>           : the status of the job (can be "pending", "done" or "failed")
+//         - attempts: <varint>         : the number of attempts to build the index
+//         - error: <string>            : the error of the last failed attempt
+//         - index_digest: <string>     : the digest of the built index
+//         - updated_at: <varint>       : the time of the last update in nanoseconds since the epoch
+
+var (
+	bucketKeyAutoIndexJobs = []byte("autoindex_jobs")
+	bucketKeyImageName     = []byte("image_name")
+	bucketKeyStatus        = []byte("status")
+	bucketKeyAttempts      = []byte("attempts")
+	bucketKeyError         = []byte("error")
+	bucketKeyIndexDigest   = []byte("index_digest")
+	bucketKeyUpdatedAt     = []byte("updated_at")
+)
+
+// AutoIndexJobStatus is the status of an AutoIndexJob.
+type AutoIndexJobStatus string
+
+const (
+	// AutoIndexJobPending indicates that the index of the job is yet to be built.
+	AutoIndexJobPending AutoIndexJobStatus = "pending"
+	// AutoIndexJobDone indicates that the index of the job was built.
+	AutoIndexJobDone AutoIndexJobStatus = "done"
+	// AutoIndexJobFailed indicates that building the index of the job failed too many times.
+	AutoIndexJobFailed AutoIndexJobStatus = "failed"
+)
+
+// AutoIndexJob is the job of building the SOCI index of an image manifest.
+type AutoIndexJob struct {
+	// ManifestDigest is the digest of the image manifest.
+	ManifestDigest string
+	// ImageName is the name of the image which the job was created for.
+	ImageName string
+	// Status is the status of the job.
+	Status AutoIndexJobStatus
+	// Attempts is the number of attempts to build the index.
+	Attempts int64
+	// Error is the error of the last failed attempt.
+	Error string
+	// IndexDigest is the digest of the built index.
+	IndexDigest string
+	// UpdatedAt is the time of the last update of the job.
+	UpdatedAt time.Time
+}
+
+// GetAutoIndexJob loads the AutoIndexJob of the image manifest with the given digest,
+// or returns errdefs.ErrNotFound if there is none.
+func (db *ArtifactsDb) GetAutoIndexJob(manifestDigest string) (*AutoIndexJob, error) {
+	var job *AutoIndexJob
+	err := db.db.View(func(tx *bolt.Tx) error {
+		jobs := tx.Bucket(bucketKeyAutoIndexJobs)
+		if jobs == nil {
+			return fmt.Errorf("no auto-index job for %s: %w", manifestDigest, errdefs.ErrNotFound)
+		}
+		jobBkt := jobs.Bucket([]byte(manifestDigest))
+		if jobBkt == nil {
+			return fmt.Errorf("no auto-index job for %s: %w", manifestDigest, errdefs.ErrNotFound)
+		}
+		var err error
+		job, err = loadAutoIndexJob(jobBkt, manifestDigest)
+		return err
+	})
+	return job, err
+}
+
+// ListAutoIndexJobs returns all the AutoIndexJobs in the ArtifactsDB.
+func (db *ArtifactsDb) ListAutoIndexJobs() ([]AutoIndexJob, error) {
+	jobs := []AutoIndexJob{}
+	err := db.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketKeyAutoIndexJobs)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			// Skip non-buckets
+			if v != nil {
+				return nil
+			}
+			job, err := loadAutoIndexJob(bucket.Bucket(k), string(k))
+			if err != nil {
+				return err
+			}
+			jobs = append(jobs, *job)
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+// WriteAutoIndexJob stores an AutoIndexJob into the ArtifactsDB, overwriting the job of the
+// same image manifest.
+func (db *ArtifactsDb) WriteAutoIndexJob(job *AutoIndexJob) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(bucketKeyAutoIndexJobs)
+		if err != nil {
+			return err
+		}
+		jobBkt, err := bucket.CreateBucketIfNotExists([]byte(job.ManifestDigest))
+		if err != nil {
+			return err
+		}
+		attempts, err := dbutil.EncodeInt(job.Attempts)
+		if err != nil {
+			return err
+		}
+		updatedAt, err := dbutil.EncodeInt(job.UpdatedAt.UnixNano())
+		if err != nil {
+			return err
+		}
+		updates := []struct {
+			key []byte
+			val []byte
+		}{
+			{bucketKeyImageName, []byte(job.ImageName)},
+			{bucketKeyStatus, []byte(job.Status)},
+			{bucketKeyAttempts, attempts},
+			{bucketKeyError, []byte(job.Error)},
+			{bucketKeyIndexDigest, []byte(job.IndexDigest)},
+			{bucketKeyUpdatedAt, updatedAt},
+		}
+		for _, update := range updates {
+			if err := jobBkt.Put(update.key, update.val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func loadAutoIndexJob(jobBkt *bolt.Bucket, manifestDigest string) (*AutoIndexJob, error) {
+	attempts, err := dbutil.DecodeInt(jobBkt.Get(bucketKeyAttempts))
+	if err != nil {
+		return nil, err
+	}
+	updatedAt, err := dbutil.DecodeInt(jobBkt.Get(bucketKeyUpdatedAt))
+	if err != nil {
+		return nil, err
+	}
+	return &AutoIndexJob{
+		ManifestDigest: manifestDigest,
+		ImageName:      string(jobBkt.Get(bucketKeyImageName)),
+		Status:         AutoIndexJobStatus(jobBkt.Get(bucketKeyStatus)),
+		Attempts:       attempts,
+		Error:          string(jobBkt.Get(bucketKeyError)),
+		IndexDigest:    string(jobBkt.Get(bucketKeyIndexDigest)),
+		UpdatedAt:      time.Unix(0, updatedAt),
+	}, nil
+}
+
+// ManifestResolver returns the digest of the image manifest to index of the image with the given name.
+type ManifestResolver func(ctx context.Context, imageName string) (digest.Digest, error)
+
+// ImageIndexer builds the SOCI index of the image manifest with the given digest of the image
+// with the given name and returns its digest. It must fail if the image no longer resolves to
+// the manifest, e.g. because its tag was moved since the job was created.
+type ImageIndexer func(ctx context.Context, imageName string, manifestDigest digest.Digest) (digest.Digest, error)
+
+const (
+	defaultAutoIndexMaxAttempts = 3
+	defaultAutoIndexRetryDelay  = 30 * time.Second
+)
+
+// AutoIndexer builds the SOCI indices of images whose names match a set of patterns. Its jobs
+// are deduplicated by image manifest digest and tracked in the ArtifactsDB, so that an index
+// is built once for each manifest, and failed attempts are retried.
+type AutoIndexer struct {
+	db          *ArtifactsDb
+	patterns    []string
+	resolve     ManifestResolver
+	index       ImageIndexer
+	maxAttempts int64
+	retryDelay  time.Duration
+
+	mu       sync.Mutex
+	inflight map[string]bool
+	queue    chan string
+}
+
+// AutoIndexOption is a functional option for NewAutoIndexer.
+type AutoIndexOption func(*AutoIndexer) error
+
+// WithImagePatterns only indexes the images whose names match one of the patterns,
+// with the syntax of path.Match. All images are indexed without patterns.
+func WithImagePatterns(patterns ...string) AutoIndexOption {
+	return func(a *AutoIndexer) error {
+		for _, p := range patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid image pattern %q: %w", p, err)
+			}
+		}
+		a.patterns = patterns
+		return nil
+	}
+}
+
+// WithMaxAttempts sets the number of attempts to build an index before its job fails.
+func WithMaxAttempts(n int64) AutoIndexOption {
+	return func(a *AutoIndexer) error {
+		if n <= 0 {
+			return fmt.Errorf("max attempts must be positive: %d", n)
+		}
+		a.maxAttempts = n
+		return nil
+	}
+}
+
+// WithRetryDelay sets the delay before retrying to build an index after a failed attempt.
+func WithRetryDelay(delay time.Duration) AutoIndexOption {
+	return func(a *AutoIndexer) error {
+		a.retryDelay = delay
+		return nil
+	}
+}
+
+// NewAutoIndexer returns an AutoIndexer which tracks its jobs in db, resolves the image
+// manifests to index with resolve and builds their indices with index.
+func NewAutoIndexer(db *ArtifactsDb, resolve ManifestResolver, index ImageIndexer, opts ...AutoIndexOption) (*AutoIndexer, error) {
+	a := &AutoIndexer{
+		db:          db,
+		resolve:     resolve,
+		index:       index,
+		maxAttempts: defaultAutoIndexMaxAttempts,
+		retryDelay:  defaultAutoIndexRetryDelay,
+		inflight:    make(map[string]bool),
+		queue:       make(chan string, 128),
+	}
+	for _, o := range opts {
+		if err := o(a); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Matches returns whether the image with the given name is indexed.
+func (a *AutoIndexer) Matches(imageName string) bool {
+	if len(a.patterns) == 0 {
+		return true
+	}
+	for _, p := range a.patterns {
+		if ok, _ := path.Match(p, imageName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Enqueue creates a job to build the SOCI index of the image with the given name, unless the
+// image doesn't match the patterns or its manifest already has a job which isn't failed.
+// It returns whether a job was queued.
+func (a *AutoIndexer) Enqueue(ctx context.Context, imageName string) (bool, error) {
+	if !a.Matches(imageName) {
+		return false, nil
+	}
+	manifestDigest, err := a.resolve(ctx, imageName)
+	if err != nil {
+		return false, fmt.Errorf("cannot resolve the manifest of %s: %w", imageName, err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.inflight[manifestDigest.String()] {
+		return false, nil
+	}
+	job, err := a.db.GetAutoIndexJob(manifestDigest.String())
+	if err != nil && !errdefs.IsNotFound(err) {
+		return false, err
+	}
+	if job != nil && job.Status == AutoIndexJobDone {
+		return false, nil
+	}
+	if job == nil || job.Status == AutoIndexJobFailed {
+		job = &AutoIndexJob{ManifestDigest: manifestDigest.String(), ImageName: imageName}
+	}
+	job.Status = AutoIndexJobPending
+	job.UpdatedAt = time.Now()
+	if err := a.db.WriteAutoIndexJob(job); err != nil {
+		return false, err
+	}
+	a.inflight[job.ManifestDigest] = true
+	go func() {
+		select {
+		case a.queue <- job.ManifestDigest:
+		case <-ctx.Done():
+		}
+	}()
+	return true, nil
+}
+
+// Run processes the queued jobs until ctx is done, after queueing the pending jobs in the
+// ArtifactsDB, e.g. from before a restart.
+func (a *AutoIndexer) Run(ctx context.Context) error {
+	jobs, err := a.db.ListAutoIndexJobs()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.Status != AutoIndexJobPending {
+			continue
+		}
+		a.mu.Lock()
+		if !a.inflight[job.ManifestDigest] {
+			a.inflight[job.ManifestDigest] = true
+			manifestDigest := job.ManifestDigest
+			go func() {
+				select {
+				case a.queue <- manifestDigest:
+				case <-ctx.Done():
+				}
+			}()
+		}
+		a.mu.Unlock()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case manifestDigest := <-a.queue:
+			if retry := a.process(ctx, manifestDigest); retry {
+				time.AfterFunc(a.retryDelay, func() {
+					select {
+					case a.queue <- manifestDigest:
+					case <-ctx.Done():
+					}
+				})
+			}
+		}
+	}
+}
+
+// process makes an attempt to build the index of the job of the image manifest with the
+// given digest, and returns whether it should be retried.
+func (a *AutoIndexer) process(ctx context.Context, manifestDigest string) bool {
+	job, err := a.db.GetAutoIndexJob(manifestDigest)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("manifest", manifestDigest).Error("cannot load auto-index job")
+		a.done(manifestDigest)
+		return false
+	}
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("image", job.ImageName).WithField("manifest", manifestDigest))
+
+	job.Attempts++
+	indexDigest, err := a.index(ctx, job.ImageName, digest.Digest(manifestDigest))
+	if err == nil {
+		job.Status = AutoIndexJobDone
+		job.IndexDigest = indexDigest.String()
+		job.Error = ""
+		log.G(ctx).WithField("index", indexDigest).Info("built soci index")
+	} else {
+		job.Error = err.Error()
+		if job.Attempts >= a.maxAttempts {
+			job.Status = AutoIndexJobFailed
+		}
+		log.G(ctx).WithError(err).WithField("attempts", job.Attempts).Warn("cannot build soci index")
+	}
+	job.UpdatedAt = time.Now()
+	if err := a.db.WriteAutoIndexJob(job); err != nil {
+		log.G(ctx).WithError(err).Error("cannot update auto-index job")
+	}
+	if job.Status != AutoIndexJobPending {
+		a.done(manifestDigest)
+		return false
+	}
+	return true
+}
+
+func (a *AutoIndexer) done(manifestDigest string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.inflight, manifestDigest)
+}
@@ -0,0 +1,152 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestAutoIndexer(t *testing.T) {
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	manifests := map[string]digest.Digest{
+		"registry.example.com/app:v1":     digest.FromString("app"),
+		"registry.example.com/app:latest": digest.FromString("app"),
+		"registry.example.com/flaky:v1":   digest.FromString("flaky"),
+		"registry.example.com/broken:v1":  digest.FromString("broken"),
+		"registry.example.com/moved:v1":   digest.FromString("moved"),
+		"docker.io/library/other:v1":      digest.FromString("other"),
+	}
+	// the tags moved to other manifests after their jobs were created
+	moved := map[string]digest.Digest{
+		"registry.example.com/moved:v1": digest.FromString("moved again"),
+	}
+	resolve := func(_ context.Context, name string) (digest.Digest, error) {
+		return manifests[name], nil
+	}
+	var (
+		mu       sync.Mutex
+		attempts = make(map[string]int)
+	)
+	index := func(_ context.Context, name string, manifestDigest digest.Digest) (digest.Digest, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		current, ok := moved[name]
+		if !ok {
+			current = manifests[name]
+		}
+		if manifestDigest != current {
+			return "", fmt.Errorf("%s doesn't resolve to %s", name, manifestDigest)
+		}
+		attempts[name]++
+		switch {
+		case name == "registry.example.com/broken:v1",
+			name == "registry.example.com/flaky:v1" && attempts[name] == 1:
+			return "", fmt.Errorf("cannot build index")
+		}
+		return digest.FromString("index of " + name), nil
+	}
+	a, err := NewAutoIndexer(db, resolve, index,
+		WithImagePatterns("registry.example.com/*"), WithMaxAttempts(2), WithRetryDelay(time.Millisecond))
+	if err != nil {
+		t.Fatalf("cannot create auto-indexer: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	for _, name := range []string{
+		"registry.example.com/app:v1",
+		"registry.example.com/app:latest",
+		"registry.example.com/flaky:v1",
+		"registry.example.com/broken:v1",
+		"registry.example.com/moved:v1",
+		"docker.io/library/other:v1",
+	} {
+		if _, err := a.Enqueue(ctx, name); err != nil {
+			t.Fatalf("cannot enqueue %s: %v", name, err)
+		}
+	}
+
+	expected := map[digest.Digest]AutoIndexJobStatus{
+		digest.FromString("app"):    AutoIndexJobDone,
+		digest.FromString("flaky"):  AutoIndexJobDone,
+		digest.FromString("broken"): AutoIndexJobFailed,
+		digest.FromString("moved"):  AutoIndexJobFailed,
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		jobs, err := db.ListAutoIndexJobs()
+		if err != nil {
+			t.Fatalf("cannot list jobs: %v", err)
+		}
+		finished := len(jobs) == len(expected)
+		for _, job := range jobs {
+			if job.Status == AutoIndexJobPending {
+				finished = false
+			}
+		}
+		if finished {
+			for _, job := range jobs {
+				if job.Status != expected[digest.Digest(job.ManifestDigest)] {
+					t.Fatalf("unexpected job %+v", job)
+				}
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("jobs didn't finish: %+v", jobs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts["registry.example.com/app:v1"]+attempts["registry.example.com/app:latest"] != 1 {
+		t.Fatalf("the index of a manifest should be built once: %v", attempts)
+	}
+	if attempts["registry.example.com/flaky:v1"] != 2 || attempts["registry.example.com/broken:v1"] != 2 {
+		t.Fatalf("failed attempts should be retried up to the max attempts: %v", attempts)
+	}
+	if attempts["docker.io/library/other:v1"] != 0 {
+		t.Fatalf("images not matching the patterns shouldn't be indexed")
+	}
+
+	job, err := db.GetAutoIndexJob(digest.FromString("flaky").String())
+	if err != nil {
+		t.Fatalf("cannot get job: %v", err)
+	}
+	if job.IndexDigest != digest.FromString("index of registry.example.com/flaky:v1").String() || job.Attempts != 2 || job.Error != "" {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	job, err = db.GetAutoIndexJob(digest.FromString("moved").String())
+	if err != nil {
+		t.Fatalf("cannot get job: %v", err)
+	}
+	if job.IndexDigest != "" || !strings.Contains(job.Error, "doesn't resolve") {
+		t.Fatalf("the job of a moved tag should fail: %+v", job)
+	}
+}
@@ -0,0 +1,277 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/containerd/containerd/archive/compression"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/converter"
+	"github.com/containerd/containerd/labels"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+const tarBlockSize = 512
+
+// Converter recompresses image layers into SOCI-optimized gzip layers and builds their ztocs.
+//
+// The layers are recompressed with deflate full flush points in between files, roughly every
+// span size bytes, and every span size bytes inside of large files. The ztocs of such layers
+// have a span per full flush point, so that spans line up with files, and don't need windows.
+// The uncompressed layers are byte-identical, so the diff IDs of the image stay valid.
+type Converter struct {
+	spanSize int64
+	store    orascontent.Storage
+	config   buildConfig
+
+	mu    sync.Mutex
+	ztocs map[digest.Digest]ocispec.Descriptor // ztoc descriptors by converted layer digest
+}
+
+func NewConverter(spanSize int64, store orascontent.Storage, opts ...BuildOption) (*Converter, error) {
+	var config buildConfig
+	for _, o := range opts {
+		if err := o(&config); err != nil {
+			return nil, err
+		}
+	}
+	return &Converter{
+		spanSize: spanSize,
+		store:    store,
+		config:   config,
+		ztocs:    make(map[digest.Digest]ocispec.Descriptor),
+	}, nil
+}
+
+var _ converter.ConvertFunc = (&Converter{}).LayerConvertFunc
+
+// LayerConvertFunc is a converter.ConvertFunc which recompresses a layer into a gzip layer with
+// full flush points, writes it to the content store and builds its ztoc.
+// Non-distributable layers and layers below the minimum layer size aren't converted.
+func (c *Converter) LayerConvertFunc(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+	if !images.IsLayerType(desc.MediaType) || images.IsNonDistributable(desc.MediaType) {
+		return nil, nil
+	}
+	if skipBuildingZtoc(desc, &c.config) {
+		log.G(ctx).WithField("layer", desc.Digest).Debug("conversion skipped")
+		return nil, nil
+	}
+
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer ra.Close()
+	r, err := compression.DecompressStream(io.NewSectionReader(ra, 0, desc.Size))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	tmpFile, err := os.CreateTemp("", "tmp.*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	flushPoints, diffID, err := recompressLayer(r, tmpFile, c.spanSize)
+	if err != nil {
+		return nil, fmt.Errorf("cannot recompress layer %s: %w", desc.Digest, err)
+	}
+
+	newDesc, err := writeLayer(ctx, cs, tmpFile, desc, diffID)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := c.config
+	cfg.spanStrategy = SpanStrategyFullFlush
+	cfg.flushPoints = flushPoints
+	ztoc, err := BuildZtoc(tmpFile.Name(), c.spanSize, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	ztocDesc, err := pushZtoc(ctx, ztoc, *newDesc, c.store)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.ztocs[newDesc.Digest] = *ztocDesc
+	c.mu.Unlock()
+	return newDesc, nil
+}
+
+// BuildSociIndex builds the SociIndex of an image converted with LayerConvertFunc.
+func (c *Converter) BuildSociIndex(ctx context.Context, cs content.Store, img images.Image) (*SociIndex, error) {
+	platform := platforms.Default()
+	imgManifestDesc, err := GetImageManifestDescriptor(ctx, cs, img, platform)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := images.Manifest(ctx, cs, img.Target, platform)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sociLayersDesc := make([]*ocispec.Descriptor, len(manifest.Layers))
+	for i, l := range manifest.Layers {
+		if desc, ok := c.ztocs[l.Digest]; ok {
+			sociLayersDesc[i] = &desc
+		}
+	}
+	return newSociIndex(sociLayersDesc, imgManifestDesc, &c.config), nil
+}
+
+// writeLayer writes the recompressed layer in f to the content store and returns its descriptor.
+func writeLayer(ctx context.Context, cs content.Store, f *os.File, desc ocispec.Descriptor, diffID digest.Digest) (*ocispec.Descriptor, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	ref := fmt.Sprintf("convert-soci-from-%s", desc.Digest)
+	w, err := content.OpenWriter(ctx, cs, content.WithRef(ref))
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+
+	// Reset the writing position
+	// Old writer possibly remains without aborted
+	// (e.g. conversion interrupted by a signal)
+	if err := w.Truncate(0); err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return nil, err
+	}
+	// the distribution source labels of the original layer don't apply to the new blob
+	labelsMap := map[string]string{
+		labels.LabelUncompressed: diffID.String(),
+	}
+	if err := w.Commit(ctx, 0, "", content.WithLabels(labelsMap)); err != nil && !errdefs.IsAlreadyExists(err) {
+		return nil, err
+	}
+
+	newDesc := desc
+	newDesc.Digest = w.Digest()
+	newDesc.Size = n
+	newDesc.URLs = nil
+	if images.IsDockerType(desc.MediaType) {
+		newDesc.MediaType = images.MediaTypeDockerSchema2LayerGzip
+	} else {
+		newDesc.MediaType = ocispec.MediaTypeImageLayerGzip
+	}
+	return &newDesc, nil
+}
+
+// recompressLayer writes the uncompressed layer from r to w as gzip with full flush points
+// placed by getFlushPoints. It returns the flush points and the diff ID of the layer.
+func recompressLayer(r io.Reader, w io.Writer, spanSize int64) ([]FileSize, digest.Digest, error) {
+	tarFile, err := os.CreateTemp("", "tmp.*")
+	if err != nil {
+		return nil, "", err
+	}
+	defer os.Remove(tarFile.Name())
+	defer tarFile.Close()
+
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(tarFile, digester.Hash()), r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	flushPoints, err := getFlushPoints(tarFile, size, spanSize)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fw, err := newFullFlushWriter(w)
+	if err != nil {
+		return nil, "", err
+	}
+	defer fw.Close()
+	var pos FileSize
+	for _, p := range flushPoints {
+		if _, err := io.Copy(fw, io.NewSectionReader(tarFile, int64(pos), int64(p-pos))); err != nil {
+			return nil, "", err
+		}
+		if err := fw.FullFlush(); err != nil {
+			return nil, "", err
+		}
+		pos = p
+	}
+	if _, err := io.Copy(fw, io.NewSectionReader(tarFile, int64(pos), size-int64(pos))); err != nil {
+		return nil, "", err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, "", err
+	}
+	return flushPoints, digester.Digest(), nil
+}
+
+// getFlushPoints returns the uncompressed offsets of the full flush points for the tar archive
+// in ra. There is a flush point at the start of an entry (including any extended headers) if
+// the span would otherwise grow larger than spanSize, and every spanSize bytes inside of larger
+// entries, so that entries smaller than spanSize are never split.
+func getFlushPoints(ra io.ReaderAt, size int64, spanSize int64) ([]FileSize, error) {
+	span := FileSize(spanSize)
+	pt := &positionTrackerReader{r: io.NewSectionReader(ra, 0, size)}
+	tarRdr := tar.NewReader(pt)
+
+	var (
+		points     []FileSize
+		last       FileSize
+		entryStart FileSize
+	)
+	for {
+		hdr, err := tarRdr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("error while reading tar header: %v", err)
+		}
+
+		dataEnd := pt.CurrentPos() + FileSize(hdr.Size)
+		if entryStart > last && dataEnd-last > span {
+			points = append(points, entryStart)
+			last = entryStart
+		}
+		for last+span < dataEnd {
+			last += span
+			points = append(points, last)
+		}
+		entryStart = (dataEnd + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+	}
+	return points, nil
+}
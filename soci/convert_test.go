@@ -0,0 +1,177 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestFullFlushWriter(t *testing.T) {
+	data := genRandomByteData(3*fullFlushWriterBufferSize + 100)
+	var buf bytes.Buffer
+	fw, err := newFullFlushWriter(&buf)
+	if err != nil {
+		t.Fatalf("cannot create full flush writer: %v", err)
+	}
+	flushAt := []int{0, 1000, fullFlushWriterBufferSize, 2*fullFlushWriterBufferSize + 1}
+	pos := 0
+	for _, p := range append(flushAt, len(data)) {
+		if _, err := fw.Write(data[pos:p]); err != nil {
+			t.Fatalf("cannot write: %v", err)
+		}
+		if err := fw.FullFlush(); err != nil {
+			t.Fatalf("cannot flush: %v", err)
+		}
+		pos = p
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatalf("cannot close: %v", err)
+	}
+	if _, err := fw.Write([]byte{0}); err == nil {
+		t.Fatalf("expected write after close to fail")
+	}
+
+	gr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("cannot read gzip stream: %v", err)
+	}
+	decompressed, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("cannot decompress: %v", err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Fatalf("decompressed data doesn't match")
+	}
+}
+
+func TestConvertLayer(t *testing.T) {
+	const spanSize = 65536
+	var ents []testutil.TarEntry
+	contents := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("file%d", i)
+		size := rand.Intn(spanSize / 4)
+		if i%25 == 0 {
+			// a few files are larger than a span
+			size = rand.Intn(3*spanSize) + spanSize
+		}
+		contents[name] = genRandomByteData(size)
+		ents = append(ents, testutil.File(name, string(contents[name])))
+	}
+	tarBytes, err := io.ReadAll(testutil.BuildTar(ents))
+	if err != nil {
+		t.Fatalf("cannot build tar: %v", err)
+	}
+
+	gzipFile, err := os.CreateTemp("", "convert.tar.gz")
+	if err != nil {
+		t.Fatalf("cannot create temp file: %v", err)
+	}
+	defer os.Remove(gzipFile.Name())
+	defer gzipFile.Close()
+
+	flushPoints, diffID, err := recompressLayer(bytes.NewReader(tarBytes), gzipFile, spanSize)
+	if err != nil {
+		t.Fatalf("cannot recompress layer: %v", err)
+	}
+	if diffID != digest.FromBytes(tarBytes) {
+		t.Fatalf("unexpected diff ID; expected %s, got %s", digest.FromBytes(tarBytes), diffID)
+	}
+	if len(flushPoints) == 0 {
+		t.Fatalf("expected flush points")
+	}
+
+	// the uncompressed layer must be byte-identical
+	if _, err := gzipFile.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("cannot seek: %v", err)
+	}
+	gr, err := gzip.NewReader(gzipFile)
+	if err != nil {
+		t.Fatalf("cannot read gzip stream: %v", err)
+	}
+	decompressed, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("cannot decompress: %v", err)
+	}
+	if !bytes.Equal(decompressed, tarBytes) {
+		t.Fatalf("decompressed layer doesn't match the original tar")
+	}
+
+	ztoc, err := BuildZtoc(gzipFile.Name(), spanSize, &buildConfig{spanStrategy: SpanStrategyFullFlush, flushPoints: flushPoints})
+	if err != nil {
+		t.Fatalf("cannot build ztoc: %v", err)
+	}
+	if ztoc.SpanStrategy != SpanStrategyFullFlush {
+		t.Fatalf("unexpected span strategy; expected %q, got %q", SpanStrategyFullFlush, ztoc.SpanStrategy)
+	}
+	if ztoc.Version != ztocVersionWindowless {
+		t.Fatalf("unexpected version; expected %q, got %q", ztocVersionWindowless, ztoc.Version)
+	}
+	if int(ztoc.MaxSpanId) != len(flushPoints) {
+		t.Fatalf("expected a span per flush point; expected %d spans, got %d", len(flushPoints)+1, ztoc.MaxSpanId+1)
+	}
+
+	// access points after the first one are serialized as in (8 bytes), out (8 bytes) and
+	// bits (1 byte), without their empty windows, which is flagged in the bits
+	const headerSize, pointSize, windowlessFlag = 12, 8 + 8 + 1, 0x80
+	if len(ztoc.IndexByteData) != headerSize+int(ztoc.MaxSpanId)*pointSize {
+		t.Fatalf("expected access points without windows; got %d bytes for %d spans", len(ztoc.IndexByteData), ztoc.MaxSpanId+1)
+	}
+	for i := 1; i <= int(ztoc.MaxSpanId); i++ {
+		point := ztoc.IndexByteData[headerSize+(i-1)*pointSize:]
+		if out := FileSize(binary.LittleEndian.Uint64(point[8:])); out != flushPoints[i-1] {
+			t.Fatalf("span %d doesn't start at a flush point; expected %d, got %d", i, flushPoints[i-1], out)
+		}
+		if point[16]&windowlessFlag == 0 {
+			t.Fatalf("expected the window of span %d to be left out; got bits %#x", i, point[16])
+		}
+	}
+
+	sr := io.NewSectionReader(gzipFile, 0, int64(ztoc.CompressedFileSize))
+	for _, m := range ztoc.Metadata {
+		if m.UncompressedSize < spanSize/4 && m.SpanStart != m.SpanEnd {
+			t.Fatalf("expected small file %s to be in a single span", m.Name)
+		}
+		extracted, err := ExtractFile(sr, &FileExtractConfig{
+			UncompressedSize:   m.UncompressedSize,
+			UncompressedOffset: m.UncompressedOffset,
+			SpanStart:          m.SpanStart,
+			SpanEnd:            m.SpanEnd,
+			FirstSpanHasBits:   strconv.FormatBool(m.FirstSpanHasBits),
+			IndexByteData:      ztoc.IndexByteData,
+			CompressedFileSize: ztoc.CompressedFileSize,
+			MaxSpanId:          ztoc.MaxSpanId,
+		})
+		if err != nil {
+			t.Fatalf("could not extract %s: %v", m.Name, err)
+		}
+		if !bytes.Equal(extracted, contents[m.Name]) {
+			t.Fatalf("the content of %s does not match", m.Name)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	oraslib "oras.land/oras-go/v2"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+// CopyResult is the result of copying an image with its SOCI artifacts.
+type CopyResult struct {
+	// Root is the descriptor of the copied image manifest or index.
+	Root ocispec.Descriptor
+	// Indices are the descriptors of the copied SOCI indices.
+	Indices []ocispec.Descriptor
+	// ReferrersTags are the referrers fallback tags updated in the destination to list the SOCI indices.
+	ReferrersTags []string
+	// Copied are the artifacts which were copied.
+	Copied []ocispec.Descriptor
+	// Skipped are the artifacts which already existed in the destination.
+	Skipped []ocispec.Descriptor
+}
+
+// CopyImage copies the image srcRef in src to dstRef in dst, along with the SOCI indices and
+// ztocs of its manifests, preserving their digests. The targets can be registry repositories,
+// e.g. from NewRepository, or OCI layouts. The SOCI indices are found in src with the Referrers
+// API, referrers tag indices and the predecessors of the manifests in OCI layouts. They are made
+// discoverable in dst in the same way as by PushIndex.
+// WithMaxConcurrentUploads and WithPushProgress apply to copying, other options are ignored.
+func CopyImage(ctx context.Context, src oraslib.Target, srcRef string, dst oraslib.Target, dstRef string, opts ...PushOption) (*CopyResult, error) {
+	var config pushConfig
+	for _, o := range opts {
+		if err := o(&config); err != nil {
+			return nil, err
+		}
+	}
+	var (
+		mu     sync.Mutex
+		result CopyResult
+	)
+	graphOptions := copyGraphOptions(&config, func(event PushEvent, desc ocispec.Descriptor) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch event {
+		case PushEventPushed:
+			result.Copied = append(result.Copied, desc)
+		case PushEventSkipped:
+			result.Skipped = append(result.Skipped, desc)
+		}
+	})
+
+	root, err := oraslib.Copy(ctx, src, srcRef, dst, dstRef, oraslib.CopyOptions{CopyGraphOptions: graphOptions})
+	if err != nil {
+		return nil, fmt.Errorf("cannot copy image %s: %w", srcRef, err)
+	}
+	result.Root = root
+
+	manifests, err := imageManifests(ctx, src, root)
+	if err != nil {
+		return nil, err
+	}
+	for _, manifest := range manifests {
+		indices, err := findSociIndices(ctx, src, manifest)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find SOCI indices of %s: %w", manifest.Digest, err)
+		}
+		for _, indexDesc := range indices {
+			if err := oraslib.CopyGraph(ctx, src, dst, indexDesc, graphOptions); err != nil {
+				return nil, fmt.Errorf("cannot copy SOCI index %s: %w", indexDesc.Digest, err)
+			}
+			b, err := orascontent.FetchAll(ctx, src, indexDesc)
+			if err != nil {
+				return nil, err
+			}
+			var index SociIndex
+			if err := json.Unmarshal(b, &index); err != nil {
+				return nil, fmt.Errorf("cannot parse SOCI index %s: %w", indexDesc.Digest, err)
+			}
+			tag, err := updateReferrers(ctx, dst, indexDesc, &index)
+			if err != nil {
+				return nil, err
+			}
+			result.Indices = append(result.Indices, indexDesc)
+			if tag != "" {
+				result.ReferrersTags = append(result.ReferrersTags, tag)
+			}
+		}
+	}
+	return &result, nil
+}
+
+// imageManifests returns root and, if it's an image index, its manifests.
+func imageManifests(ctx context.Context, fetcher orascontent.Fetcher, root ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	manifests := []ocispec.Descriptor{root}
+	if !images.IsIndexType(root.MediaType) {
+		return manifests, nil
+	}
+	b, err := orascontent.FetchAll(ctx, fetcher, root)
+	if err != nil {
+		return nil, err
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, fmt.Errorf("cannot parse image index %s: %w", root.Digest, err)
+	}
+	return append(manifests, index.Manifests...), nil
+}
@@ -0,0 +1,117 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func TestCopyImage(t *testing.T) {
+	ctx := context.Background()
+	marshal := func(v interface{}) []byte {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("cannot marshal: %v", err)
+		}
+		return b
+	}
+	blob := func(reg *testRegistry, mediaType string, b []byte) ocispec.Descriptor {
+		dgst := digest.FromBytes(b)
+		reg.blobs[dgst] = b
+		return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(b))}
+	}
+
+	// the source registry has an image with a SOCI index, found with the Referrers API
+	src := newTestRegistry(true)
+	manifest := marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    blob(src, ocispec.MediaTypeImageConfig, []byte("{}")),
+		Layers:    []ocispec.Descriptor{blob(src, ocispec.MediaTypeImageLayerGzip, []byte("layer"))},
+	})
+	manifestDigest := src.putManifest("v1", ocispec.MediaTypeImageManifest, manifest)
+	index := marshal(SociIndex{
+		MediaType:    sociIndexMediaType,
+		ArtifactType: SociIndexArtifactType,
+		Blobs:        []ocispec.Descriptor{blob(src, SociLayerMediaType, []byte("ztoc"))},
+		Subject:      ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: manifestDigest, Size: int64(len(manifest))},
+	})
+	indexDigest := src.putManifest(digest.FromBytes(index).String(), sociIndexMediaType, index)
+	srcSrv := httptest.NewServer(src)
+	defer srcSrv.Close()
+
+	dst := newTestRegistry(false)
+	dstSrv := httptest.NewServer(dst)
+	defer dstSrv.Close()
+
+	repository := func(srv *httptest.Server) string {
+		return strings.TrimPrefix(srv.URL, "http://") + "/test"
+	}
+	srcRepo, err := NewRepository(repository(srcSrv), WithPlainHTTP(true))
+	if err != nil {
+		t.Fatalf("cannot create repository: %v", err)
+	}
+	dstRepo, err := NewRepository(repository(dstSrv), WithPlainHTTP(true))
+	if err != nil {
+		t.Fatalf("cannot create repository: %v", err)
+	}
+
+	// copy from the source registry to an OCI layout, and from the reopened layout to the destination
+	layoutDir := t.TempDir()
+	layout, err := oci.New(layoutDir)
+	if err != nil {
+		t.Fatalf("cannot create OCI layout: %v", err)
+	}
+	result, err := CopyImage(ctx, srcRepo, "v1", layout, "v1")
+	if err != nil {
+		t.Fatalf("cannot copy to OCI layout: %v", err)
+	}
+	if result.Root.Digest != manifestDigest || len(result.Indices) != 1 || result.Indices[0].Digest != indexDigest {
+		t.Fatalf("unexpected copy to OCI layout: %+v", result)
+	}
+	layout, err = oci.New(layoutDir)
+	if err != nil {
+		t.Fatalf("cannot open OCI layout: %v", err)
+	}
+	result, err = CopyImage(ctx, layout, "v1", dstRepo, "v2")
+	if err != nil {
+		t.Fatalf("cannot copy from OCI layout: %v", err)
+	}
+	if len(result.Indices) != 1 || result.Indices[0].Digest != indexDigest {
+		t.Fatalf("SOCI index wasn't found in OCI layout: %+v", result)
+	}
+
+	for dgst, b := range src.blobs {
+		if string(dst.blobs[dgst]) != string(b) {
+			t.Fatalf("%s wasn't copied", dgst)
+		}
+	}
+	if dst.manifests["v2"] != manifestDigest {
+		t.Fatalf("image wasn't tagged in destination")
+	}
+	referrers := dst.referrersIndex(t, manifestDigest)
+	if referrers == nil || len(referrers.Manifests) != 1 || referrers.Manifests[0].Digest != indexDigest {
+		t.Fatalf("referrers tag index wasn't written in destination: %+v", referrers)
+	}
+}
@@ -0,0 +1,245 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxSociIndexSize is the size of the largest blob parsed as a SOCI index while rebuilding
+// ArtifactEntries, so that ztocs aren't read into memory.
+const maxSociIndexSize = 4 << 20
+
+// ImageLinker finds the image of the image manifest with the given digest. It's used to fill
+// in the ImageDigest and Platform of rebuilt SOCI index entries. ok is false if there is no such image.
+type ImageLinker func(ctx context.Context, manifestDigest digest.Digest) (imageDigest digest.Digest, platform ocispec.Platform, ok bool, err error)
+
+// FsckReport is the result of checking the SOCI content store and the ArtifactsDB.
+type FsckReport struct {
+	// CorruptBlobs are the blobs in the store whose contents don't match their digests.
+	CorruptBlobs []digest.Digest
+	// RebuiltEntries are the ArtifactEntries of SOCI indices and ztocs in the store
+	// which were missing from the ArtifactsDB, or missing their image, and were written.
+	RebuiltEntries []ArtifactEntry
+	// DanglingEntries are the ArtifactEntries of blobs missing from the store.
+	DanglingEntries []ArtifactEntry
+}
+
+// Fsck checks the blobs of the OCI layout at root, the SOCI content store, against their digests,
+// and rebuilds the ArtifactEntries of the SOCI indices and ztocs in it from the indices.
+// ArtifactEntries whose blobs are missing from the store are reported as dangling.
+// If remove is set, corrupt blobs are removed from the store and dangling entries from the ArtifactsDB.
+func (db *ArtifactsDb) Fsck(ctx context.Context, root string, link ImageLinker, remove bool) (*FsckReport, error) {
+	var report FsckReport
+	blobs, corrupt, err := verifyBlobs(filepath.Join(root, "blobs"))
+	if err != nil {
+		return nil, err
+	}
+	report.CorruptBlobs = corrupt
+	present := make(map[digest.Digest]bool, len(blobs)+len(corrupt))
+	for _, b := range blobs {
+		present[b.digest] = true
+	}
+	for _, dgst := range corrupt {
+		if remove {
+			if err := os.Remove(blobPath(root, dgst)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		present[dgst] = true
+	}
+
+	entries := make(map[string]*ArtifactEntry)
+	err = db.Walk(func(ae *ArtifactEntry) error {
+		entries[ae.Digest] = ae
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	write := func(ae *ArtifactEntry) error {
+		if err := db.WriteArtifactEntry(ae); err != nil {
+			return err
+		}
+		entries[ae.Digest] = ae
+		report.RebuiltEntries = append(report.RebuiltEntries, *ae)
+		return nil
+	}
+	for _, b := range blobs {
+		if b.size > maxSociIndexSize {
+			continue
+		}
+		index, err := readSociIndexBlob(blobPath(root, b.digest))
+		if err != nil {
+			return nil, err
+		}
+		if index == nil {
+			continue
+		}
+
+		existing, ok := entries[b.digest.String()]
+		if !ok || existing.ImageDigest == "" {
+			ae := &ArtifactEntry{
+				Digest:         b.digest.String(),
+				OriginalDigest: index.Subject.Digest.String(),
+				Type:           ArtifactEntryTypeIndex,
+				Location:       index.Subject.Digest.String(),
+				Size:           b.size,
+				Supersedes:     index.Annotations[IndexAnnotationSupersedes],
+			}
+			imageDigest, platform, linked, err := link(ctx, index.Subject.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if linked {
+				ae.ImageDigest = imageDigest.String()
+				ae.Platform = platforms.Format(platform)
+			}
+			// an existing entry is only replaced if its image could be found now
+			if !ok || linked {
+				if err := write(ae); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		for _, desc := range index.Blobs {
+			if _, ok := entries[desc.Digest.String()]; ok || !present[desc.Digest] {
+				continue
+			}
+			layerDigest := desc.Annotations[IndexAnnotationImageLayerDigest]
+			err := write(&ArtifactEntry{
+				Size:           desc.Size,
+				Digest:         desc.Digest.String(),
+				OriginalDigest: layerDigest,
+				Type:           ArtifactEntryTypeLayer,
+				Location:       layerDigest,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, ae := range entries {
+		if dgst, err := digest.Parse(ae.Digest); err == nil && present[dgst] {
+			continue
+		}
+		report.DanglingEntries = append(report.DanglingEntries, *ae)
+		if remove {
+			if err := db.RemoveArtifactEntry(ae.Digest); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Slice(report.DanglingEntries, func(i, j int) bool {
+		return report.DanglingEntries[i].Digest < report.DanglingEntries[j].Digest
+	})
+	return &report, nil
+}
+
+type blobInfo struct {
+	digest digest.Digest
+	size   int64
+}
+
+// verifyBlobs returns the blobs under the blobs directory of an OCI layout whose contents
+// match their digests, and the digests of the ones which don't.
+func verifyBlobs(blobsDir string) ([]blobInfo, []digest.Digest, error) {
+	var (
+		blobs   []blobInfo
+		corrupt []digest.Digest
+	)
+	algs, err := os.ReadDir(blobsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	for _, alg := range algs {
+		if !alg.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(blobsDir, alg.Name()))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, f := range files {
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(alg.Name()), f.Name())
+			if dgst.Validate() != nil || f.IsDir() {
+				continue
+			}
+			size, ok, err := verifyBlob(filepath.Join(blobsDir, alg.Name(), f.Name()), dgst)
+			if err != nil {
+				return nil, nil, err
+			}
+			if ok {
+				blobs = append(blobs, blobInfo{digest: dgst, size: size})
+			} else {
+				corrupt = append(corrupt, dgst)
+			}
+		}
+	}
+	return blobs, corrupt, nil
+}
+
+func verifyBlob(p string, dgst digest.Digest) (int64, bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+	verifier := dgst.Verifier()
+	size, err := io.Copy(verifier, f)
+	if err != nil {
+		return 0, false, fmt.Errorf("cannot read blob %s: %w", dgst, err)
+	}
+	return size, verifier.Verified(), nil
+}
+
+// readSociIndexBlob returns the SOCI index in the blob at p, or nil if the blob isn't a SOCI index.
+func readSociIndexBlob(p string) (*SociIndex, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var index SociIndex
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, nil
+	}
+	if index.MediaType != sociIndexMediaType || index.ArtifactType != SociIndexArtifactType {
+		return nil, nil
+	}
+	return &index, nil
+}
+
+func blobPath(root string, dgst digest.Digest) string {
+	return filepath.Join(root, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
@@ -0,0 +1,149 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func TestFsck(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	store, err := oci.New(root)
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	push := func(b []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{Digest: digest.FromBytes(b), Size: int64(len(b))}
+		if err := store.Push(ctx, desc, bytes.NewReader(b)); err != nil {
+			t.Fatalf("cannot push blob: %v", err)
+		}
+		return desc
+	}
+
+	const (
+		layerDigest    = "sha256:1236aec48c0a74635a5f3dc666628c1673afaa21ed6e1270a9a44de66e811111"
+		manifestDigest = "sha256:bbbbbbb48c0a74635a5f3dc666628c1673afaa21ed6e1270a9a44de66e811111"
+		imageDigest    = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+		danglingDigest = "sha256:80d6aec48caaaaaaaa5f3dc555528c1673afaa21ed6e1270a9a44de66e8ffa55"
+	)
+	ztocDesc := push([]byte("ztoc"))
+	ztocDesc.MediaType = SociLayerMediaType
+	ztocDesc.Annotations = map[string]string{IndexAnnotationImageLayerDigest: layerDigest}
+	index := SociIndex{
+		MediaType:    sociIndexMediaType,
+		ArtifactType: SociIndexArtifactType,
+		Blobs:        []ocispec.Descriptor{ztocDesc},
+		Subject:      ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: manifestDigest},
+	}
+	b, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("cannot marshal index: %v", err)
+	}
+	indexDesc := push(b)
+	corruptDesc := push([]byte("corrupt"))
+	if err := os.WriteFile(blobPath(root, corruptDesc.Digest), []byte("c0rrupt"), 0644); err != nil {
+		t.Fatalf("cannot corrupt blob: %v", err)
+	}
+
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	dangling := ArtifactEntry{Digest: danglingDigest, Type: ArtifactEntryTypeLayer, Size: 10}
+	if err := db.WriteArtifactEntry(&dangling); err != nil {
+		t.Fatalf("can't put ArtifactEntry to a bucket")
+	}
+	link := func(_ context.Context, dgst digest.Digest) (digest.Digest, ocispec.Platform, bool, error) {
+		return imageDigest, ocispec.Platform{OS: "linux", Architecture: "amd64"}, dgst == manifestDigest, nil
+	}
+
+	report, err := db.Fsck(ctx, root, link, false)
+	if err != nil {
+		t.Fatalf("fsck failed: %v", err)
+	}
+	if len(report.CorruptBlobs) != 1 || report.CorruptBlobs[0] != corruptDesc.Digest {
+		t.Fatalf("unexpected corrupt blobs %v", report.CorruptBlobs)
+	}
+	if len(report.DanglingEntries) != 1 || report.DanglingEntries[0] != dangling {
+		t.Fatalf("unexpected dangling entries %v", report.DanglingEntries)
+	}
+	expected := []ArtifactEntry{
+		{
+			Size:           indexDesc.Size,
+			Digest:         indexDesc.Digest.String(),
+			OriginalDigest: manifestDigest,
+			ImageDigest:    imageDigest,
+			Platform:       "linux/amd64",
+			Location:       manifestDigest,
+			Type:           ArtifactEntryTypeIndex,
+		},
+		{
+			Size:           ztocDesc.Size,
+			Digest:         ztocDesc.Digest.String(),
+			OriginalDigest: layerDigest,
+			Location:       layerDigest,
+			Type:           ArtifactEntryTypeLayer,
+		},
+	}
+	for _, e := range expected {
+		ae, err := db.GetArtifactEntry(e.Digest)
+		if err != nil {
+			t.Fatalf("entry %s wasn't rebuilt: %v", e.Digest, err)
+		}
+		if *ae != e {
+			t.Fatalf("unexpected rebuilt entry; expected %v, got %v", e, *ae)
+		}
+	}
+	if len(report.RebuiltEntries) != len(expected) {
+		t.Fatalf("expected %d rebuilt entries, got %d", len(expected), len(report.RebuiltEntries))
+	}
+	if _, err := db.GetArtifactEntry(danglingDigest); err != nil {
+		t.Fatalf("dangling entry was removed without remove set")
+	}
+
+	// the rebuilt entries are up to date now, and removing fixes the rest
+	report, err = db.Fsck(ctx, root, link, true)
+	if err != nil {
+		t.Fatalf("fsck failed: %v", err)
+	}
+	if len(report.RebuiltEntries) != 0 {
+		t.Fatalf("unexpected rebuilt entries %v", report.RebuiltEntries)
+	}
+	if _, err := os.Stat(blobPath(root, corruptDesc.Digest)); !os.IsNotExist(err) {
+		t.Fatalf("corrupt blob wasn't removed")
+	}
+	if _, err := db.GetArtifactEntry(danglingDigest); err == nil {
+		t.Fatalf("dangling entry wasn't removed")
+	}
+
+	report, err = db.Fsck(ctx, root, link, false)
+	if err != nil {
+		t.Fatalf("fsck failed: %v", err)
+	}
+	if len(report.CorruptBlobs) != 0 || len(report.DanglingEntries) != 0 || len(report.RebuiltEntries) != 0 {
+		t.Fatalf("unexpected problems after removing: %+v", report)
+	}
+}
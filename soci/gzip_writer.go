@@ -0,0 +1,118 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+// #cgo CFLAGS: -I${SRCDIR}/../c/
+// #cgo LDFLAGS: -L${SRCDIR}/../out -lindexer -lz
+// #include "indexer.h"
+// #include <stdlib.h>
+// #include <zlib.h>
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+const fullFlushWriterBufferSize = 64 << 10
+
+var errFullFlushWriterClosed = errors.New("full flush writer is closed")
+
+// fullFlushWriter writes a gzip stream that can contain deflate full flush points.
+// Compress/flate only supports sync flushes, after which the compressed data still
+// refers to the data before, so this writer uses zlib instead.
+type fullFlushWriter struct {
+	w    io.Writer
+	strm *C.z_stream
+	in   unsafe.Pointer
+	out  unsafe.Pointer
+}
+
+func newFullFlushWriter(w io.Writer) (*fullFlushWriter, error) {
+	strm := C.gzip_deflate_new(C.Z_DEFAULT_COMPRESSION)
+	if strm == nil {
+		return nil, errors.New("cannot initialize deflate stream")
+	}
+	return &fullFlushWriter{
+		w:    w,
+		strm: strm,
+		in:   C.malloc(fullFlushWriterBufferSize),
+		out:  C.malloc(fullFlushWriterBufferSize),
+	}, nil
+}
+
+func (fw *fullFlushWriter) Write(p []byte) (int, error) {
+	if fw.strm == nil {
+		return 0, errFullFlushWriterClosed
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(unsafe.Slice((*byte)(fw.in), fullFlushWriterBufferSize), p)
+		if err := fw.deflate(n, C.Z_NO_FLUSH); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// FullFlush writes all pending data and resets the compression state, so that the
+// data written after it can be decompressed without anything before the flush point.
+func (fw *fullFlushWriter) FullFlush() error {
+	return fw.deflate(0, C.Z_FULL_FLUSH)
+}
+
+// Close writes the gzip trailer and releases the deflate stream.
+// It doesn't close the underlying writer.
+func (fw *fullFlushWriter) Close() error {
+	if fw.strm == nil {
+		return nil
+	}
+	err := fw.deflate(0, C.Z_FINISH)
+	C.gzip_deflate_free(fw.strm)
+	C.free(fw.in)
+	C.free(fw.out)
+	fw.strm = nil
+	return err
+}
+
+// deflate compresses the first n bytes of fw.in, writing out the compressed data as long as
+// the output buffer gets filled up, since that means deflate has more output pending.
+func (fw *fullFlushWriter) deflate(n int, flush C.int) error {
+	if fw.strm == nil {
+		return errFullFlushWriterClosed
+	}
+	in := fw.in
+	for {
+		var used C.uint
+		ret := C.gzip_deflate(fw.strm, in, C.uint(n), &used, fw.out, fullFlushWriterBufferSize, flush)
+		if ret < 0 {
+			return fmt.Errorf("cannot deflate: %d", int(ret))
+		}
+		if _, err := fw.w.Write(C.GoBytes(fw.out, ret)); err != nil {
+			return err
+		}
+		in = unsafe.Add(in, int(used))
+		n -= int(used)
+		if n == 0 && ret < fullFlushWriterBufferSize {
+			return nil
+		}
+	}
+}
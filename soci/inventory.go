@@ -0,0 +1,275 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+	opaqueXattrValue  = "y"
+)
+
+// LayerZtoc is the ztoc of an image layer.
+type LayerZtoc struct {
+	LayerDigest digest.Digest
+	Ztoc        *Ztoc
+}
+
+// InventoryEntry is a file in the file system of an image.
+type InventoryEntry struct {
+	// Path is the absolute path of the file in the image.
+	Path string
+	// LayerDigest is the digest of the layer the file is read from.
+	LayerDigest digest.Digest
+	FileMetadata
+}
+
+// inventoryNode is a file in the merged file system. Directories which are only implied
+// by the paths of their children don't have an entry.
+type inventoryNode struct {
+	entry    *InventoryEntry
+	children map[string]*inventoryNode
+}
+
+func (n *inventoryNode) child(name string) *inventoryNode {
+	if n.children == nil {
+		n.children = make(map[string]*inventoryNode)
+	}
+	c, ok := n.children[name]
+	if !ok {
+		c = &inventoryNode{}
+		n.children[name] = c
+	}
+	return c
+}
+
+// Inventory returns the files of an image from the ztocs of its layers, ordered from the lowest
+// layer, without reading the layers. The layers are merged the same way as their file systems are
+// by overlayfs: files of upper layers replace the ones of lower layers, whiteouts remove files of
+// lower layers, and the contents of lower layers are hidden by opaque directories. Whiteouts aren't
+// listed themselves, as in node.readdir. The entries are in depth-first order, sorted by name
+// within each directory.
+func Inventory(layers []LayerZtoc) []InventoryEntry {
+	root := &inventoryNode{}
+	for _, l := range layers {
+		var entries []InventoryEntry
+		// whiteouts only apply to lower layers, so they are applied before adding the files of the layer
+		for _, m := range l.Ztoc.Metadata {
+			p := path.Clean("/" + m.Name)
+			if p == "/" {
+				continue
+			}
+			dir, base := path.Split(p)
+			switch {
+			case base == whiteoutOpaqueDir:
+				lookupInventoryNode(root, dir, true).children = nil
+			case strings.HasPrefix(base, whiteoutPrefix):
+				if parent := lookupInventoryNode(root, dir, false); parent != nil {
+					delete(parent.children, base[len(whiteoutPrefix):])
+				}
+			default:
+				if m.Type == "dir" && isOpaque(PAXXattrs(m.Xattrs)) {
+					lookupInventoryNode(root, p, true).children = nil
+				}
+				entries = append(entries, InventoryEntry{Path: p, LayerDigest: l.LayerDigest, FileMetadata: m})
+			}
+		}
+		for i := range entries {
+			n := lookupInventoryNode(root, entries[i].Path, true)
+			if entries[i].Type != "dir" {
+				// a file replaces a directory of a lower layer with all of its contents
+				n.children = nil
+			}
+			n.entry = &entries[i]
+		}
+	}
+
+	var inventory []InventoryEntry
+	var walk func(n *inventoryNode)
+	walk = func(n *inventoryNode) {
+		if n.entry != nil {
+			inventory = append(inventory, *n.entry)
+		}
+		names := make([]string, 0, len(n.children))
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			walk(n.children[name])
+		}
+	}
+	walk(root)
+	return inventory
+}
+
+// lookupInventoryNode returns the node for the absolute path p. If create is set, missing
+// nodes are created, otherwise nil is returned if there is no node for p.
+func lookupInventoryNode(root *inventoryNode, p string, create bool) *inventoryNode {
+	n := root
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if create {
+			n = n.child(name)
+			continue
+		}
+		c, ok := n.children[name]
+		if !ok {
+			return nil
+		}
+		n = c
+	}
+	return n
+}
+
+func isOpaque(xattrs map[string]string) bool {
+	for _, x := range OpaqueXattrs {
+		if xattrs[x] == opaqueXattrValue {
+			return true
+		}
+	}
+	return false
+}
+
+// ChangeKind is the kind of change of a file between two images.
+type ChangeKind string
+
+const (
+	ChangeAdded    ChangeKind = "A"
+	ChangeRemoved  ChangeKind = "D"
+	ChangeModified ChangeKind = "M"
+)
+
+// InventoryChange is a change of a file between two images.
+type InventoryChange struct {
+	Kind ChangeKind
+	Path string
+	// Old is the file in the first image, nil for added files.
+	Old *InventoryEntry
+	// New is the file in the second image, nil for removed files.
+	New *InventoryEntry
+	// Fields are the names of the FileMetadata fields that differ for modified files.
+	Fields []string
+}
+
+// DiffInventories returns the changes of the files between two image inventories, sorted by path.
+// Ztocs don't record the digests of files, so files are compared by their metadata, except
+// that files read from the same offset of the same layer are always the same.
+func DiffInventories(a, b []InventoryEntry) []InventoryChange {
+	files := make(map[string]*InventoryEntry, len(a))
+	for i := range a {
+		files[a[i].Path] = &a[i]
+	}
+
+	var changes []InventoryChange
+	for i := range b {
+		n := &b[i]
+		o, ok := files[n.Path]
+		if !ok {
+			changes = append(changes, InventoryChange{Kind: ChangeAdded, Path: n.Path, New: n})
+			continue
+		}
+		delete(files, n.Path)
+		if fields := diffFileMetadata(o, n); len(fields) > 0 {
+			changes = append(changes, InventoryChange{Kind: ChangeModified, Path: n.Path, Old: o, New: n, Fields: fields})
+		}
+	}
+	for _, o := range files {
+		changes = append(changes, InventoryChange{Kind: ChangeRemoved, Path: o.Path, Old: o})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+func diffFileMetadata(o, n *InventoryEntry) []string {
+	if o.LayerDigest == n.LayerDigest && o.UncompressedOffset == n.UncompressedOffset {
+		return nil
+	}
+	var fields []string
+	if o.Type != n.Type {
+		fields = append(fields, "Type")
+	}
+	if o.UncompressedSize != n.UncompressedSize {
+		fields = append(fields, "UncompressedSize")
+	}
+	if o.Mode != n.Mode {
+		fields = append(fields, "Mode")
+	}
+	if o.UID != n.UID || o.GID != n.GID {
+		fields = append(fields, "Owner")
+	}
+	if !o.ModTime.Equal(n.ModTime) {
+		fields = append(fields, "ModTime")
+	}
+	if o.Linkname != n.Linkname {
+		fields = append(fields, "Linkname")
+	}
+	if o.Devmajor != n.Devmajor || o.Devminor != n.Devminor {
+		fields = append(fields, "Device")
+	}
+	// other PAX records, e.g. of times or long paths, aren't compared
+	if !reflect.DeepEqual(PAXXattrs(o.Xattrs), PAXXattrs(n.Xattrs)) {
+		fields = append(fields, "Xattrs")
+	}
+	return fields
+}
+
+// InventorySubtrees returns the entries of inventory at or below each of the paths, in inventory
+// order. The paths can be relative to the root of the image. An error is returned if there is
+// nothing in the inventory at any of the paths.
+func InventorySubtrees(inventory []InventoryEntry, paths []string) ([]InventoryEntry, error) {
+	found := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		found[path.Clean("/"+p)] = false
+	}
+	var entries []InventoryEntry
+	for _, e := range inventory {
+		selected := false
+		// check the entry and all of its parent directories
+		for p := e.Path; ; p = path.Dir(p) {
+			if _, ok := found[p]; ok {
+				found[p] = true
+				selected = true
+			}
+			if p == "/" {
+				break
+			}
+		}
+		if selected {
+			entries = append(entries, e)
+		}
+	}
+	for _, p := range paths {
+		if !found[path.Clean("/"+p)] {
+			return nil, fmt.Errorf("%s: no such file or directory", p)
+		}
+	}
+	return entries, nil
+}
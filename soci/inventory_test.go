@@ -0,0 +1,231 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestInventory(t *testing.T) {
+	layer := func(dgst digest.Digest, files ...FileMetadata) LayerZtoc {
+		return LayerZtoc{LayerDigest: dgst, Ztoc: &Ztoc{Metadata: files}}
+	}
+	dir := func(name string) FileMetadata { return FileMetadata{Name: name, Type: "dir"} }
+	reg := func(name string) FileMetadata { return FileMetadata{Name: name, Type: "reg"} }
+
+	testCases := []struct {
+		name     string
+		layers   []LayerZtoc
+		expected map[string]digest.Digest // path -> layer digest
+	}{
+		{
+			name: "single layer",
+			layers: []LayerZtoc{
+				layer("l1", dir("./"), dir("./etc/"), reg("./etc/passwd"), reg("bin/sh")),
+			},
+			expected: map[string]digest.Digest{"/etc": "l1", "/etc/passwd": "l1", "/bin/sh": "l1"},
+		},
+		{
+			name: "upper layer replaces files",
+			layers: []LayerZtoc{
+				layer("l1", dir("etc/"), reg("etc/passwd"), reg("etc/group")),
+				layer("l2", reg("etc/passwd")),
+			},
+			expected: map[string]digest.Digest{"/etc": "l1", "/etc/passwd": "l2", "/etc/group": "l1"},
+		},
+		{
+			name: "whiteouts remove files and directories of lower layers",
+			layers: []LayerZtoc{
+				layer("l1", dir("etc/"), reg("etc/passwd"), dir("var/"), dir("var/lib/"), reg("var/lib/db")),
+				layer("l2", reg("etc/.wh.passwd"), reg(".wh.var"), reg(".wh.missing")),
+			},
+			expected: map[string]digest.Digest{"/etc": "l1"},
+		},
+		{
+			name: "whiteouts don't remove files of the same layer",
+			layers: []LayerZtoc{
+				layer("l1", reg("a"), reg("b")),
+				layer("l2", reg(".wh.a"), reg("a")),
+			},
+			expected: map[string]digest.Digest{"/a": "l2", "/b": "l1"},
+		},
+		{
+			name: "opaque directories hide lower layers",
+			layers: []LayerZtoc{
+				layer("l1", dir("d/"), reg("d/a"), dir("d/sub/"), reg("d/sub/b"), reg("c")),
+				layer("l2", dir("d/"), reg("d/.wh..wh..opq"), reg("d/new")),
+			},
+			expected: map[string]digest.Digest{"/d": "l2", "/d/new": "l2", "/c": "l1"},
+		},
+		{
+			name: "opaque directories from xattrs hide lower layers",
+			layers: []LayerZtoc{
+				layer("l1", dir("d/"), reg("d/a")),
+				layer("l2", FileMetadata{Name: "d/", Type: "dir", Xattrs: map[string]string{"SCHILY.xattr.trusted.overlay.opaque": "y"}}),
+			},
+			expected: map[string]digest.Digest{"/d": "l2"},
+		},
+		{
+			name: "a file replaces a directory",
+			layers: []LayerZtoc{
+				layer("l1", dir("d/"), reg("d/a")),
+				layer("l2", reg("d")),
+			},
+			expected: map[string]digest.Digest{"/d": "l2"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			inventory := Inventory(tc.layers)
+			actual := make(map[string]digest.Digest)
+			for i, e := range inventory {
+				if i > 0 && inventory[i-1].Path >= e.Path {
+					t.Fatalf("entries are not sorted: %s before %s", inventory[i-1].Path, e.Path)
+				}
+				actual[e.Path] = e.LayerDigest
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Fatalf("unexpected inventory; expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDiffInventories(t *testing.T) {
+	mtime := time.Unix(1000, 0)
+	a := Inventory([]LayerZtoc{
+		{LayerDigest: "l1", Ztoc: &Ztoc{Metadata: []FileMetadata{
+			{Name: "same", Type: "reg", UncompressedSize: 10, ModTime: mtime},
+			{Name: "relayered", Type: "reg", UncompressedSize: 10, ModTime: mtime},
+			{Name: "resized", Type: "reg", UncompressedSize: 10, ModTime: mtime},
+			{Name: "chmod", Type: "reg", Mode: 0644, ModTime: mtime},
+			{Name: "removed", Type: "reg", ModTime: mtime},
+			{Name: "pax", Type: "reg", ModTime: mtime, Xattrs: map[string]string{"mtime": "1000.1"}},
+			{Name: "xattr", Type: "reg", ModTime: mtime, Xattrs: map[string]string{"SCHILY.xattr.user.a": "1"}},
+		}}},
+	})
+	b := Inventory([]LayerZtoc{
+		{LayerDigest: "l1", Ztoc: &Ztoc{Metadata: []FileMetadata{
+			{Name: "same", Type: "reg", UncompressedSize: 10, ModTime: mtime},
+			{Name: "resized", Type: "reg", UncompressedSize: 10, ModTime: mtime},
+			{Name: "chmod", Type: "reg", Mode: 0644, ModTime: mtime},
+		}}},
+		{LayerDigest: "l2", Ztoc: &Ztoc{Metadata: []FileMetadata{
+			{Name: "relayered", Type: "reg", UncompressedSize: 10, ModTime: mtime},
+			{Name: "resized", Type: "reg", UncompressedSize: 20, ModTime: mtime.Add(time.Second)},
+			{Name: "chmod", Type: "reg", Mode: 0755, ModTime: mtime},
+			{Name: "added", Type: "reg", ModTime: mtime},
+			{Name: "pax", Type: "reg", ModTime: mtime, Xattrs: map[string]string{"mtime": "1000.2", "path": "pax"}},
+			{Name: "xattr", Type: "reg", ModTime: mtime, Xattrs: map[string]string{"SCHILY.xattr.user.a": "2"}},
+		}}},
+	})
+
+	type change struct {
+		kind   ChangeKind
+		path   string
+		fields []string
+	}
+	expected := []change{
+		{ChangeAdded, "/added", nil},
+		{ChangeModified, "/chmod", []string{"Mode"}},
+		{ChangeRemoved, "/removed", nil},
+		{ChangeModified, "/resized", []string{"UncompressedSize", "ModTime"}},
+		{ChangeModified, "/xattr", []string{"Xattrs"}},
+	}
+	var actual []change
+	for _, c := range DiffInventories(a, b) {
+		if (c.Old == nil) != (c.Kind == ChangeAdded) || (c.New == nil) != (c.Kind == ChangeRemoved) {
+			t.Fatalf("unexpected files for %s change of %s", c.Kind, c.Path)
+		}
+		actual = append(actual, change{c.Kind, c.Path, c.Fields})
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("unexpected changes; expected %v, got %v", expected, actual)
+	}
+}
+
+func TestInventorySubtrees(t *testing.T) {
+	inventory := Inventory([]LayerZtoc{
+		{LayerDigest: "l1", Ztoc: &Ztoc{Metadata: []FileMetadata{
+			{Name: "etc/", Type: "dir"},
+			{Name: "etc/passwd", Type: "reg"},
+			{Name: "etc/ssl/certs/ca.pem", Type: "reg"},
+			{Name: "etcetera", Type: "reg"},
+			{Name: "bin/sh", Type: "reg"},
+		}}},
+	})
+
+	testCases := []struct {
+		name     string
+		paths    []string
+		expected []string
+		err      bool
+	}{
+		{
+			name:     "a file",
+			paths:    []string{"/etc/passwd"},
+			expected: []string{"/etc/passwd"},
+		},
+		{
+			name:     "a directory",
+			paths:    []string{"etc"},
+			expected: []string{"/etc", "/etc/passwd", "/etc/ssl/certs/ca.pem"},
+		},
+		{
+			name:     "an implied directory",
+			paths:    []string{"/etc/ssl/"},
+			expected: []string{"/etc/ssl/certs/ca.pem"},
+		},
+		{
+			name:     "overlapping paths",
+			paths:    []string{"/etc/ssl", "/etc", "/bin/sh"},
+			expected: []string{"/bin/sh", "/etc", "/etc/passwd", "/etc/ssl/certs/ca.pem"},
+		},
+		{
+			name:  "a missing path",
+			paths: []string{"/etc/passwd", "/etc/shadow"},
+			err:   true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			entries, err := InventorySubtrees(inventory, tc.paths)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var actual []string
+			for _, e := range entries {
+				actual = append(actual, e.Path)
+			}
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Fatalf("unexpected entries; expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
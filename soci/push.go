@@ -0,0 +1,264 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	oraslib "oras.land/oras-go/v2"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// PushEvent is the kind of progress reported while pushing SOCI artifacts.
+type PushEvent string
+
+const (
+	// PushEventPushing is reported before pushing an artifact.
+	PushEventPushing PushEvent = "pushing"
+	// PushEventPushed is reported after pushing an artifact.
+	PushEventPushed PushEvent = "pushed"
+	// PushEventSkipped is reported for artifacts which already exist in the repository.
+	PushEventSkipped PushEvent = "skipped"
+)
+
+type pushConfig struct {
+	credential     func(ctx context.Context, host string) (auth.Credential, error)
+	plainHTTP      bool
+	maxConcurrency int64
+	progress       func(PushEvent, ocispec.Descriptor)
+	dryRun         bool
+}
+
+// PushOption is a functional option for PushIndex.
+type PushOption func(*pushConfig) error
+
+// WithCredentials sets the username and password to push with.
+func WithCredentials(username, password string) PushOption {
+	return func(c *pushConfig) error {
+		c.credential = func(context.Context, string) (auth.Credential, error) {
+			return auth.Credential{Username: username, Password: password}, nil
+		}
+		return nil
+	}
+}
+
+// WithCredentialFunc sets the function returning the credentials to push to a registry host with.
+func WithCredentialFunc(credential func(ctx context.Context, host string) (auth.Credential, error)) PushOption {
+	return func(c *pushConfig) error {
+		c.credential = credential
+		return nil
+	}
+}
+
+// WithKeychain sets the keychains to find the credentials to push to a registry host in.
+// A keychain returns the username and password for a host, or an identity token as the password
+// with an empty username, like dockerconfig.DockerCreds, which also runs the credential helpers
+// of the docker config. The first credentials found are used.
+func WithKeychain(keychains ...func(host string) (string, string, error)) PushOption {
+	return func(c *pushConfig) error {
+		c.credential = func(_ context.Context, host string) (auth.Credential, error) {
+			for _, keychain := range keychains {
+				username, secret, err := keychain(host)
+				if err != nil {
+					return auth.EmptyCredential, err
+				}
+				if username == "" && secret != "" {
+					return auth.Credential{RefreshToken: secret}, nil
+				}
+				if username != "" || secret != "" {
+					return auth.Credential{Username: username, Password: secret}, nil
+				}
+			}
+			return auth.EmptyCredential, nil
+		}
+		return nil
+	}
+}
+
+// WithDryRun only reports which artifacts would be pushed, without pushing anything.
+func WithDryRun(dryRun bool) PushOption {
+	return func(c *pushConfig) error {
+		c.dryRun = dryRun
+		return nil
+	}
+}
+
+// WithPlainHTTP pushes over HTTP instead of HTTPS.
+func WithPlainHTTP(plainHTTP bool) PushOption {
+	return func(c *pushConfig) error {
+		c.plainHTTP = plainHTTP
+		return nil
+	}
+}
+
+// WithMaxConcurrentUploads limits the number of artifacts pushed concurrently.
+func WithMaxConcurrentUploads(n int64) PushOption {
+	return func(c *pushConfig) error {
+		if n < 0 {
+			return fmt.Errorf("max concurrent uploads must not be negative: %d", n)
+		}
+		c.maxConcurrency = n
+		return nil
+	}
+}
+
+// WithPushProgress sets the function to report the progress of pushing each artifact to.
+func WithPushProgress(progress func(PushEvent, ocispec.Descriptor)) PushOption {
+	return func(c *pushConfig) error {
+		c.progress = progress
+		return nil
+	}
+}
+
+// PushResult is the result of pushing a SOCI index.
+type PushResult struct {
+	// Index is the descriptor of the pushed SOCI index.
+	Index ocispec.Descriptor
+	// Pushed are the artifacts which were pushed, or would be pushed on a dry run.
+	Pushed []ocispec.Descriptor
+	// Skipped are the artifacts which already existed in the repository.
+	Skipped []ocispec.Descriptor
+	// ReferrersTag is the referrers fallback tag which was updated to list the SOCI index,
+	// or empty if the registry supports the Referrers API.
+	ReferrersTag string
+}
+
+// PushIndex pushes the SOCI index indexDesc and its ztocs from store to the repository repo,
+// e.g. "registry.example.com/namespace/image". If the registry doesn't support the Referrers API,
+// the referrers fallback tag of the image manifest is updated to list the SOCI index, so that
+// it can be discovered by other clients.
+func PushIndex(ctx context.Context, store orascontent.Storage, repo string, indexDesc ocispec.Descriptor, opts ...PushOption) (*PushResult, error) {
+	var config pushConfig
+	for _, o := range opts {
+		if err := o(&config); err != nil {
+			return nil, err
+		}
+	}
+
+	dst, err := newRepository(repo, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		mu     sync.Mutex
+		result = PushResult{Index: indexDesc}
+	)
+	options := copyGraphOptions(&config, func(event PushEvent, desc ocispec.Descriptor) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch event {
+		case PushEventPushed:
+			result.Pushed = append(result.Pushed, desc)
+		case PushEventSkipped:
+			result.Skipped = append(result.Skipped, desc)
+		}
+	})
+
+	index, err := ReadSociIndex(ctx, indexDesc.Digest, store)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read SOCI index %s: %w", indexDesc.Digest, err)
+	}
+	if config.dryRun {
+		exists, err := dst.Exists(ctx, index.Subject)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, fmt.Errorf("image manifest %s of the SOCI index is not in %s", index.Subject.Digest, repo)
+		}
+		for _, desc := range append(index.Blobs, indexDesc) {
+			exists, err := dst.Exists(ctx, desc)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				options.OnCopySkipped(ctx, desc)
+			} else {
+				options.PostCopy(ctx, desc)
+			}
+		}
+		return &result, nil
+	}
+
+	if err := oraslib.CopyGraph(ctx, store, dst, indexDesc, options); err != nil {
+		return nil, fmt.Errorf("error pushing graph to remote: %w", err)
+	}
+
+	result.ReferrersTag, err = updateReferrers(ctx, dst, indexDesc, index)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// NewRepository returns the repository repo, e.g. "registry.example.com/namespace/image", accessed
+// with the credentials and over the protocol set by opts. Other options are ignored.
+func NewRepository(repo string, opts ...PushOption) (*remote.Repository, error) {
+	var config pushConfig
+	for _, o := range opts {
+		if err := o(&config); err != nil {
+			return nil, err
+		}
+	}
+	return newRepository(repo, &config)
+}
+
+func newRepository(repo string, config *pushConfig) (*remote.Repository, error) {
+	r, err := remote.NewRepository(repo)
+	if err != nil {
+		return nil, err
+	}
+	r.PlainHTTP = config.plainHTTP
+	if config.credential != nil {
+		r.Client = &auth.Client{
+			Header:     auth.DefaultClient.Header,
+			Credential: config.credential,
+			Cache:      auth.NewCache(),
+		}
+	}
+	return r, nil
+}
+
+// copyGraphOptions returns the options to copy artifacts with, reporting the progress of each
+// artifact to record and then to the progress function of config.
+func copyGraphOptions(config *pushConfig, record func(PushEvent, ocispec.Descriptor)) oraslib.CopyGraphOptions {
+	report := func(event PushEvent, desc ocispec.Descriptor) error {
+		record(event, desc)
+		if config.progress != nil {
+			config.progress(event, desc)
+		}
+		return nil
+	}
+	options := oraslib.DefaultCopyGraphOptions
+	options.Concurrency = config.maxConcurrency
+	options.PreCopy = func(_ context.Context, desc ocispec.Descriptor) error {
+		return report(PushEventPushing, desc)
+	}
+	options.PostCopy = func(_ context.Context, desc ocispec.Descriptor) error {
+		return report(PushEventPushed, desc)
+	}
+	options.OnCopySkipped = func(_ context.Context, desc ocispec.Descriptor) error {
+		return report(PushEventSkipped, desc)
+	}
+	return options
+}
@@ -0,0 +1,236 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// testRegistry is an in-memory registry serving a single repository.
+type testRegistry struct {
+	mu        sync.Mutex
+	referrers bool // whether the Referrers API is supported
+	blobs     map[digest.Digest][]byte
+	manifests map[string]digest.Digest // by tag or digest
+	types     map[digest.Digest]string // manifest media types
+}
+
+func newTestRegistry(referrers bool) *testRegistry {
+	return &testRegistry{
+		referrers: referrers,
+		blobs:     make(map[digest.Digest][]byte),
+		manifests: make(map[string]digest.Digest),
+		types:     make(map[digest.Digest]string),
+	}
+}
+
+func (r *testRegistry) putManifest(ref, mediaType string, b []byte) digest.Digest {
+	dgst := digest.FromBytes(b)
+	r.blobs[dgst] = b
+	r.types[dgst] = mediaType
+	r.manifests[dgst.String()] = dgst
+	r.manifests[ref] = dgst
+	return dgst
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/v2/test/"), "/")
+	if len(parts) < 2 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	kind, ref := parts[0], parts[len(parts)-1]
+	switch {
+	case kind == "referrers":
+		if !r.referrers {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		referrers := referrersIndex{MediaType: ocispec.MediaTypeImageIndex, Manifests: []referrerDescriptor{}}
+		for dgst, mediaType := range r.types {
+			var m struct {
+				ArtifactType string             `json:"artifactType"`
+				Subject      ocispec.Descriptor `json:"subject"`
+			}
+			if json.Unmarshal(r.blobs[dgst], &m) == nil && m.Subject.Digest.String() == ref {
+				referrers.Manifests = append(referrers.Manifests, referrerDescriptor{
+					Descriptor:   ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(r.blobs[dgst]))},
+					ArtifactType: m.ArtifactType,
+				})
+			}
+		}
+		referrers.SchemaVersion = 2
+		b, _ := json.Marshal(referrers)
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+		w.Write(b)
+	case kind == "blobs" && parts[1] == "uploads" && req.Method == http.MethodPost:
+		w.Header().Set("Location", "/v2/test/blobs/uploads/upload")
+		w.WriteHeader(http.StatusAccepted)
+	case kind == "blobs" && parts[1] == "uploads" && req.Method == http.MethodPut:
+		b, _ := io.ReadAll(req.Body)
+		dgst := digest.FromBytes(b)
+		r.blobs[dgst] = b
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	case kind == "blobs":
+		b, ok := r.blobs[digest.Digest(ref)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+		w.Header().Set("Docker-Content-Digest", ref)
+		if req.Method == http.MethodGet {
+			w.Write(b)
+		}
+	case kind == "manifests" && req.Method == http.MethodPut:
+		b, _ := io.ReadAll(req.Body)
+		dgst := r.putManifest(ref, req.Header.Get("Content-Type"), b)
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	case kind == "manifests":
+		dgst, ok := r.manifests[ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		b := r.blobs[dgst]
+		w.Header().Set("Content-Type", r.types[dgst])
+		w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		if req.Method == http.MethodGet {
+			w.Write(b)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *testRegistry) referrersIndex(t *testing.T, subject digest.Digest) *referrersIndex {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dgst, ok := r.manifests[referrersTag(subject)]
+	if !ok {
+		return nil
+	}
+	var index referrersIndex
+	if err := json.Unmarshal(r.blobs[dgst], &index); err != nil {
+		t.Fatalf("cannot parse referrers index: %v", err)
+	}
+	return &index
+}
+
+func TestPushIndex(t *testing.T) {
+	ctx := context.Background()
+	store, err := oci.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("cannot create store: %v", err)
+	}
+	push := func(mediaType string, b []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(b), Size: int64(len(b))}
+		if err := store.Push(ctx, desc, bytes.NewReader(b)); err != nil {
+			t.Fatalf("cannot push blob: %v", err)
+		}
+		return desc
+	}
+	manifest := []byte(`{"schemaVersion":2}`)
+	subject := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromBytes(manifest), Size: int64(len(manifest))}
+	newIndex := func(ztoc string) ocispec.Descriptor {
+		index := SociIndex{
+			MediaType:    sociIndexMediaType,
+			ArtifactType: SociIndexArtifactType,
+			Blobs:        []ocispec.Descriptor{push(SociLayerMediaType, []byte(ztoc))},
+			Subject:      subject,
+			Annotations:  map[string]string{IndexAnnotationBuildToolIdentifier: "test"},
+		}
+		b, err := json.Marshal(index)
+		if err != nil {
+			t.Fatalf("cannot marshal index: %v", err)
+		}
+		return push(sociIndexMediaType, b)
+	}
+	index1 := newIndex("ztoc1")
+	index2 := newIndex("ztoc2")
+
+	for _, referrers := range []bool{false, true} {
+		t.Run(fmt.Sprintf("referrers API %t", referrers), func(t *testing.T) {
+			reg := newTestRegistry(referrers)
+			reg.putManifest("latest", ocispec.MediaTypeImageManifest, manifest)
+			srv := httptest.NewServer(reg)
+			defer srv.Close()
+			repo := strings.TrimPrefix(srv.URL, "http://") + "/test"
+
+			result, err := PushIndex(ctx, store, repo, index1, WithPlainHTTP(true), WithDryRun(true))
+			if err != nil {
+				t.Fatalf("dry run failed: %v", err)
+			}
+			if len(result.Pushed) != 2 || len(reg.blobs) != 1 {
+				t.Fatalf("unexpected dry run: %d artifacts to push, %d blobs in registry", len(result.Pushed), len(reg.blobs))
+			}
+
+			for _, index := range []ocispec.Descriptor{index1, index2, index1} {
+				result, err = PushIndex(ctx, store, repo, index, WithPlainHTTP(true))
+				if err != nil {
+					t.Fatalf("push failed: %v", err)
+				}
+			}
+			if len(result.Pushed) != 0 || len(result.Skipped) == 0 {
+				t.Fatalf("pushing again should skip everything: %+v", result)
+			}
+			for _, index := range []ocispec.Descriptor{index1, index2} {
+				if _, ok := reg.manifests[index.Digest.String()]; !ok {
+					t.Fatalf("index %s wasn't pushed", index.Digest)
+				}
+			}
+
+			referrersIndex := reg.referrersIndex(t, subject.Digest)
+			if referrers {
+				if referrersIndex != nil || result.ReferrersTag != "" {
+					t.Fatalf("referrers tag index shouldn't be written with the Referrers API")
+				}
+				return
+			}
+			if result.ReferrersTag != referrersTag(subject.Digest) || referrersIndex == nil {
+				t.Fatalf("referrers tag index wasn't written")
+			}
+			if len(referrersIndex.Manifests) != 2 {
+				t.Fatalf("expected 2 referrers, got %d", len(referrersIndex.Manifests))
+			}
+			for i, index := range []ocispec.Descriptor{index1, index2} {
+				m := referrersIndex.Manifests[i]
+				if m.Digest != index.Digest || m.ArtifactType != SociIndexArtifactType || m.Annotations[IndexAnnotationBuildToolIdentifier] != "test" {
+					t.Fatalf("unexpected referrer %d: %+v", i, m)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	oraslib "oras.land/oras-go/v2"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// maxReferrersIndexSize is the size of the largest referrers tag index read from a registry.
+const maxReferrersIndexSize = 4 << 20
+
+// referrerDescriptor is a descriptor in a referrers index. The image-spec version
+// used here doesn't have the artifact type of descriptors yet.
+type referrerDescriptor struct {
+	ocispec.Descriptor
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// referrersIndex is the image index listing the referrers of a manifest, which is tagged with
+// the referrers fallback tag of the manifest on registries without the Referrers API.
+type referrersIndex struct {
+	specs.Versioned
+	MediaType   string               `json:"mediaType"`
+	Manifests   []referrerDescriptor `json:"manifests"`
+	Annotations map[string]string    `json:"annotations,omitempty"`
+}
+
+// referrersTag returns the referrers fallback tag of the manifest with the given digest.
+func referrersTag(dgst digest.Digest) string {
+	return strings.Replace(dgst.String(), ":", "-", 1)
+}
+
+// fetchReferrers returns the referrers of subject in repo from the Referrers API, and whether the
+// registry supports it, which a registry without it reports with a 404 for the referrers of subject.
+func fetchReferrers(ctx context.Context, repo *remote.Repository, subject ocispec.Descriptor) ([]referrerDescriptor, bool, error) {
+	scheme := "https"
+	if repo.PlainHTTP {
+		scheme = "http"
+	}
+	url := fmt.Sprintf("%s://%s/v2/%s/referrers/%s", scheme, repo.Reference.Host(), repo.Reference.Repository, subject.Digest)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Accept", ocispec.MediaTypeImageIndex)
+	client := repo.Client
+	if client == nil {
+		client = auth.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("unexpected status from referrers API: %s", resp.Status)
+	}
+	var referrers referrersIndex
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxReferrersIndexSize))
+	if err != nil {
+		return nil, false, err
+	}
+	if err := json.Unmarshal(b, &referrers); err != nil {
+		return nil, false, fmt.Errorf("cannot parse referrers of %s: %w", subject.Digest, err)
+	}
+	return referrers.Manifests, true, nil
+}
+
+// readReferrersTagIndex returns the referrers index tagged with the referrers fallback tag of
+// the manifest with the given digest in target, or an empty one if there is none.
+func readReferrersTagIndex(ctx context.Context, target oraslib.Target, dgst digest.Digest) (*referrersIndex, error) {
+	referrers := &referrersIndex{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []referrerDescriptor{},
+	}
+	desc, err := target.Resolve(ctx, referrersTag(dgst))
+	if errors.Is(err, errdef.ErrNotFound) {
+		return referrers, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if desc.Size > maxReferrersIndexSize {
+		return nil, fmt.Errorf("referrers index %s is too large: %d bytes", referrersTag(dgst), desc.Size)
+	}
+	b, err := orascontent.FetchAll(ctx, target, desc)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, referrers); err != nil {
+		return nil, fmt.Errorf("cannot parse referrers index %s: %w", referrersTag(dgst), err)
+	}
+	return referrers, nil
+}
+
+// addToReferrersTagIndex adds the SOCI index to the referrers index of its subject in target,
+// tagged with the referrers fallback tag of the subject, creating it if needed. It returns the tag.
+func addToReferrersTagIndex(ctx context.Context, target oraslib.Target, indexDesc ocispec.Descriptor, index *SociIndex) (string, error) {
+	tag := referrersTag(index.Subject.Digest)
+	referrers, err := readReferrersTagIndex(ctx, target, index.Subject.Digest)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range referrers.Manifests {
+		if m.Digest == indexDesc.Digest {
+			return tag, nil
+		}
+	}
+	referrers.Manifests = append(referrers.Manifests, referrerDescriptor{
+		Descriptor: ocispec.Descriptor{
+			MediaType:   indexDesc.MediaType,
+			Digest:      indexDesc.Digest,
+			Size:        indexDesc.Size,
+			Annotations: index.Annotations,
+		},
+		ArtifactType: index.ArtifactType,
+	})
+
+	b, err := json.Marshal(referrers)
+	if err != nil {
+		return "", err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	if err := target.Push(ctx, desc, bytes.NewReader(b)); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return "", err
+	}
+	if err := target.Tag(ctx, desc, tag); err != nil {
+		return "", err
+	}
+	return tag, nil
+}
+
+// updateReferrers makes the SOCI index discoverable from its subject in target. Registries with
+// the Referrers API do that by themselves, otherwise the SOCI index is added to the referrers tag
+// index of its subject, whose tag is returned.
+func updateReferrers(ctx context.Context, target oraslib.Target, indexDesc ocispec.Descriptor, index *SociIndex) (string, error) {
+	if repo, ok := target.(*remote.Repository); ok {
+		_, supported, err := fetchReferrers(ctx, repo, index.Subject)
+		if err != nil {
+			return "", err
+		}
+		if supported {
+			return "", nil
+		}
+	}
+	tag, err := addToReferrersTagIndex(ctx, target, indexDesc, index)
+	if err != nil {
+		return "", fmt.Errorf("cannot update referrers tag index: %w", err)
+	}
+	return tag, nil
+}
+
+// findSociIndices returns the descriptors of the SOCI indices of the manifest in target, found
+// with the Referrers API of registries, the referrers tag index of the manifest, and the predecessors
+// of the manifest in targets which can find them, like OCI layouts.
+func findSociIndices(ctx context.Context, target oraslib.Target, manifest ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	var candidates []ocispec.Descriptor
+	supported := false
+	if repo, ok := target.(*remote.Repository); ok {
+		var (
+			referrers []referrerDescriptor
+			err       error
+		)
+		referrers, supported, err = fetchReferrers(ctx, repo, manifest)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range referrers {
+			candidates = append(candidates, r.Descriptor)
+		}
+	} else if finder, ok := target.(orascontent.PredecessorFinder); ok {
+		predecessors, err := finder.Predecessors(ctx, manifest)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, predecessors...)
+	}
+	if !supported {
+		referrers, err := readReferrersTagIndex(ctx, target, manifest.Digest)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range referrers.Manifests {
+			candidates = append(candidates, r.Descriptor)
+		}
+	}
+
+	var indices []ocispec.Descriptor
+	seen := make(map[digest.Digest]bool)
+	for _, desc := range candidates {
+		if desc.MediaType != sociIndexMediaType || seen[desc.Digest] {
+			continue
+		}
+		seen[desc.Digest] = true
+		b, err := orascontent.FetchAll(ctx, target, desc)
+		if err != nil {
+			return nil, err
+		}
+		var index SociIndex
+		if err := json.Unmarshal(b, &index); err != nil {
+			continue
+		}
+		if index.ArtifactType == SociIndexArtifactType && index.Subject.Digest == manifest.Digest {
+			indices = append(indices, ocispec.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: desc.Size})
+		}
+	}
+	return indices, nil
+}
@@ -51,10 +51,14 @@ const (
 	IndexAnnotationBuildToolIdentifier = "com.amazon.soci.build-tool-identifier"
 	// index annotation for build tool version
 	IndexAnnotationBuildToolVersion = "com.amazon.soci.build-tool-version"
+	// index annotation for the digest of the index which an updated index supersedes
+	IndexAnnotationSupersedes = "com.amazon.soci.supersedes"
 )
 
 var (
 	errNotLayerType = errors.New("not a layer mediaType")
+	// ErrNoSociIndex is returned when there is no SOCI index for an image.
+	ErrNoSociIndex = errors.New("could not find any soci indices")
 )
 
 // nolint:revive
@@ -87,7 +91,12 @@ func GetIndexDescriptorCollection(ctx context.Context, cs content.Store, img ima
 	if err != nil {
 		return descriptors, err
 	}
+	return indexDescriptors(entries), nil
+}
 
+// indexDescriptors returns the descriptors of the SOCI indices of entries.
+func indexDescriptors(entries []ArtifactEntry) []ocispec.Descriptor {
+	descriptors := []ocispec.Descriptor{}
 	for _, entry := range entries {
 		dgst, err := digest.Parse(entry.Digest)
 		if err != nil {
@@ -100,14 +109,54 @@ func GetIndexDescriptorCollection(ctx context.Context, cs content.Store, img ima
 		}
 		descriptors = append(descriptors, desc)
 	}
+	return descriptors
+}
 
-	return descriptors, nil
+// latestIndexEntries returns the SOCI index entries which aren't superseded by another one.
+func latestIndexEntries(entries []ArtifactEntry) []ArtifactEntry {
+	superseded := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Supersedes != "" {
+			superseded[entry.Supersedes] = true
+		}
+	}
+	latest := []ArtifactEntry{}
+	for _, entry := range entries {
+		if !superseded[entry.Digest] {
+			latest = append(latest, entry)
+		}
+	}
+	return latest
+}
+
+// DefaultIndexDescriptor returns the descriptor of the SOCI index of img that is used when no
+// index is chosen explicitly, which is the last one returned by GetIndexDescriptorCollection
+// that isn't superseded by an updated index.
+func DefaultIndexDescriptor(ctx context.Context, cs content.Store, img images.Image) (ocispec.Descriptor, error) {
+	manifestDesc, err := GetImageManifestDescriptor(ctx, cs, img, platforms.Default())
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	entries, err := getIndexArtifactEntries(manifestDesc.Digest.String())
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	descriptors := indexDescriptors(latestIndexEntries(entries))
+	if len(descriptors) == 0 {
+		return ocispec.Descriptor{}, ErrNoSociIndex
+	}
+	return descriptors[len(descriptors)-1], nil
 }
 
 type buildConfig struct {
 	minLayerSize        int64
+	spanStrategy        SpanStrategy
+	flushPoints         []FileSize // full flush points for SpanStrategyFullFlush
 	buildToolIdentifier string
 	buildToolVersion    string
+	layers              map[digest.Digest]bool // layers to build ztocs for, or nil for all of them
+	existingZtocs       map[digest.Digest]ocispec.Descriptor
+	supersedes          digest.Digest
 }
 
 type BuildOption func(c *buildConfig) error
@@ -119,6 +168,16 @@ func WithMinLayerSize(minLayerSize int64) BuildOption {
 	}
 }
 
+func WithSpanStrategy(spanStrategy SpanStrategy) BuildOption {
+	return func(c *buildConfig) error {
+		if _, err := ParseSpanStrategy(string(spanStrategy)); err != nil {
+			return err
+		}
+		c.spanStrategy = spanStrategy
+		return nil
+	}
+}
+
 func WithBuildToolIdentifier(tool string) BuildOption {
 	return func(c *buildConfig) error {
 		c.buildToolIdentifier = tool
@@ -133,6 +192,17 @@ func WithBuildToolVersion(version string) BuildOption {
 	}
 }
 
+// WithLayers only builds ztocs for the layers with the given digests.
+func WithLayers(layers ...digest.Digest) BuildOption {
+	return func(c *buildConfig) error {
+		c.layers = make(map[digest.Digest]bool, len(layers))
+		for _, l := range layers {
+			c.layers[l] = true
+		}
+		return nil
+	}
+}
+
 func BuildSociIndex(ctx context.Context, cs content.Store, img images.Image, spanSize int64, store orascontent.Storage, opts ...BuildOption) (*SociIndex, error) {
 	var config buildConfig
 	for _, o := range opts {
@@ -157,6 +227,10 @@ func BuildSociIndex(ctx context.Context, cs content.Store, img images.Image, spa
 	eg, ctx := errgroup.WithContext(ctx)
 	for i, l := range manifest.Layers {
 		i, l := i, l
+		if desc, ok := config.existingZtocs[l.Digest]; ok {
+			sociLayersDesc[i] = &desc
+			continue
+		}
 		eg.Go(func() error {
 			desc, err := buildSociLayer(ctx, cs, l, spanSize, store, &config)
 			if err != nil {
@@ -170,7 +244,13 @@ func BuildSociIndex(ctx context.Context, cs content.Store, img images.Image, spa
 		return nil, err
 	}
 
-	ztocsDesc := make([]ocispec.Descriptor, 0, len(manifest.Layers))
+	return newSociIndex(sociLayersDesc, imgManifestDesc, &config), nil
+}
+
+// newSociIndex creates the SociIndex for an image manifest from the descriptors of the
+// ztocs of its layers. Layers without a ztoc have a nil descriptor.
+func newSociIndex(sociLayersDesc []*ocispec.Descriptor, imgManifestDesc *ocispec.Descriptor, config *buildConfig) *SociIndex {
+	ztocsDesc := make([]ocispec.Descriptor, 0, len(sociLayersDesc))
 	for _, desc := range sociLayersDesc {
 		if desc != nil {
 			ztocsDesc = append(ztocsDesc, *desc)
@@ -181,8 +261,11 @@ func BuildSociIndex(ctx context.Context, cs content.Store, img images.Image, spa
 		IndexAnnotationBuildToolIdentifier: config.buildToolIdentifier,
 		IndexAnnotationBuildToolVersion:    config.buildToolVersion,
 	}
+	if config.supersedes != "" {
+		annotations[IndexAnnotationSupersedes] = config.supersedes.String()
+	}
 
-	sociIndex := SociIndex{
+	return &SociIndex{
 		MediaType:    sociIndexMediaType,
 		ArtifactType: SociIndexArtifactType,
 		Blobs:        ztocsDesc,
@@ -194,7 +277,6 @@ func BuildSociIndex(ctx context.Context, cs content.Store, img images.Image, spa
 		},
 		Annotations: annotations,
 	}
-	return &sociIndex, nil
 }
 
 func skipBuildingZtoc(desc ocispec.Descriptor, cfg *buildConfig) bool {
@@ -205,6 +287,9 @@ func skipBuildingZtoc(desc ocispec.Descriptor, cfg *buildConfig) bool {
 	if desc.Size < cfg.minLayerSize {
 		return true
 	}
+	if cfg.layers != nil && !cfg.layers[desc.Digest] {
+		return true
+	}
 	return false
 }
 
@@ -215,7 +300,7 @@ func buildSociLayer(ctx context.Context, cs content.Store, desc ocispec.Descript
 	}
 	// check if we need to skip building the zTOC
 	if skipBuildingZtoc(desc, cfg) {
-		fmt.Printf("layer %s -> ztoc skipped\n", desc.Digest)
+		log.G(ctx).WithField("layer", desc.Digest).Debug("ztoc skipped")
 		return nil, nil
 	}
 	ra, err := cs.ReaderAt(ctx, desc)
@@ -223,14 +308,36 @@ func buildSociLayer(ctx context.Context, cs content.Store, desc ocispec.Descript
 		return nil, err
 	}
 	defer ra.Close()
-	sr := io.NewSectionReader(ra, 0, desc.Size)
+	return buildLayerZtoc(ctx, io.NewSectionReader(ra, 0, desc.Size), desc, spanSize, store, cfg)
+}
 
+// BuildLayerZtoc builds the ztoc for the image layer desc from its compressed content r,
+// writes it to store and returns a Descriptor for the new ztoc. It returns a nil Descriptor
+// if the layer is skipped, e.g. with WithMinLayerSize.
+func BuildLayerZtoc(ctx context.Context, r io.Reader, desc ocispec.Descriptor, spanSize int64, store orascontent.Storage, opts ...BuildOption) (*ocispec.Descriptor, error) {
+	var config buildConfig
+	for _, o := range opts {
+		if err := o(&config); err != nil {
+			return nil, err
+		}
+	}
+	if !images.IsLayerType(desc.MediaType) {
+		return nil, errNotLayerType
+	}
+	if skipBuildingZtoc(desc, &config) {
+		return nil, nil
+	}
+	return buildLayerZtoc(ctx, r, desc, spanSize, store, &config)
+}
+
+func buildLayerZtoc(ctx context.Context, r io.Reader, desc ocispec.Descriptor, spanSize int64, store orascontent.Storage, cfg *buildConfig) (*ocispec.Descriptor, error) {
 	tmpFile, err := os.CreateTemp("", "tmp.*")
 	if err != nil {
 		return nil, err
 	}
 	defer os.Remove(tmpFile.Name())
-	n, err := io.Copy(tmpFile, sr)
+	defer tmpFile.Close()
+	n, err := io.Copy(tmpFile, r)
 	if err != nil {
 		return nil, err
 	}
@@ -243,6 +350,11 @@ func buildSociLayer(ctx context.Context, cs content.Store, desc ocispec.Descript
 		return nil, err
 	}
 
+	return pushZtoc(ctx, ztoc, desc, store)
+}
+
+// pushZtoc writes the ztoc of an image layer to the local store and returns a Descriptor for it.
+func pushZtoc(ctx context.Context, ztoc *Ztoc, desc ocispec.Descriptor, store orascontent.Storage) (*ocispec.Descriptor, error) {
 	ztocReader, ztocDesc, err := NewZtocReader(ztoc)
 	if err != nil {
 		return nil, err
@@ -267,16 +379,25 @@ func buildSociLayer(ctx context.Context, cs content.Store, desc ocispec.Descript
 		return nil, err
 	}
 
-	fmt.Printf("layer %s -> ztoc %s\n", desc.Digest, ztocDesc.Digest)
+	log.G(ctx).WithField("layer", desc.Digest).WithField("ztoc", ztocDesc.Digest).Debug("ztoc has been built")
 
-	ztocDesc.MediaType = SociLayerMediaType
-	ztocDesc.Annotations = map[string]string{
-		IndexAnnotationImageLayerMediaType: ocispec.MediaTypeImageLayerGzip,
-		IndexAnnotationImageLayerDigest:    desc.Digest.String(),
-	}
+	ztocDesc = ztocDescriptor(ztocDesc.Digest, ztocDesc.Size, desc.Digest)
 	return &ztocDesc, err
 }
 
+// ztocDescriptor returns the Descriptor in a SociIndex of the ztoc of an image layer.
+func ztocDescriptor(ztocDigest digest.Digest, size int64, layerDigest digest.Digest) ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType: SociLayerMediaType,
+		Digest:    ztocDigest,
+		Size:      size,
+		Annotations: map[string]string{
+			IndexAnnotationImageLayerMediaType: ocispec.MediaTypeImageLayerGzip,
+			IndexAnnotationImageLayerDigest:    layerDigest.String(),
+		},
+	}
+}
+
 // getImageManifestDescriptor gets the descriptor of image manifest
 func GetImageManifestDescriptor(ctx context.Context, cs content.Store, img images.Image, platform platforms.MatchComparer) (*ocispec.Descriptor, error) {
 	target := img.Target
@@ -301,6 +422,71 @@ func GetImageManifestDescriptor(ctx context.Context, cs content.Store, img image
 	return nil, nil
 }
 
+// CreateIndex builds the SociIndex of img with BuildSociIndex and writes it with WriteSociIndex.
+func CreateIndex(ctx context.Context, cs content.Store, img images.Image, spanSize int64, store orascontent.Storage, opts ...BuildOption) (*IndexWithMetadata, error) {
+	sociIndex, err := BuildSociIndex(ctx, cs, img, spanSize, store, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return writeIndex(ctx, img, sociIndex, store)
+}
+
+// UpdateIndex creates a SociIndex of img from the existing SOCI index indexDigest in store,
+// reusing its ztocs and building ztocs for the layers which have none, or only for the ones
+// of them selected with WithLayers. Selected layers which already have a ztoc keep it. The new
+// index supersedes the existing one, which is recorded with the IndexAnnotationSupersedes annotation.
+func UpdateIndex(ctx context.Context, cs content.Store, img images.Image, indexDigest digest.Digest, spanSize int64, store orascontent.Storage, opts ...BuildOption) (*IndexWithMetadata, error) {
+	existing, err := ReadSociIndex(ctx, indexDigest, store)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read SOCI index %s: %w", indexDigest, err)
+	}
+	manifestDesc, err := GetImageManifestDescriptor(ctx, cs, img, platforms.Default())
+	if err != nil {
+		return nil, err
+	}
+	if existing.Subject.Digest != manifestDesc.Digest {
+		return nil, fmt.Errorf("SOCI index %s is not an index of %s", indexDigest, img.Name)
+	}
+
+	existingZtocs := make(map[digest.Digest]ocispec.Descriptor, len(existing.Blobs))
+	for _, desc := range existing.Blobs {
+		layerDigest, err := digest.Parse(desc.Annotations[IndexAnnotationImageLayerDigest])
+		if err != nil {
+			return nil, fmt.Errorf("ztoc %s of SOCI index %s has no valid layer digest: %w", desc.Digest, indexDigest, err)
+		}
+		existingZtocs[layerDigest] = desc
+	}
+	opts = append(opts, func(c *buildConfig) error {
+		c.existingZtocs = existingZtocs
+		c.supersedes = indexDigest
+		return nil
+	})
+	sociIndex, err := BuildSociIndex(ctx, cs, img, spanSize, store, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if len(sociIndex.Blobs) == len(existing.Blobs) {
+		return nil, fmt.Errorf("SOCI index %s already has ztocs for all the selected layers", indexDigest)
+	}
+	return writeIndex(ctx, img, sociIndex, store)
+}
+
+// writeIndex writes the SociIndex of img with WriteSociIndex.
+func writeIndex(ctx context.Context, img images.Image, sociIndex *SociIndex, store orascontent.Storage) (*IndexWithMetadata, error) {
+	indexWithMetadata := IndexWithMetadata{
+		Index:       sociIndex,
+		ImageDigest: img.Target.Digest,
+		// TODO: This is not strictly correct because the default platform matcher used in BuildSociIndex
+		// might match a compatible version (i.e. linux/amd64 will match linux/i386). Building indices for
+		// multiple/non-default platforms will be needed at some point and this should be fixed with that change as well.
+		Platform: platforms.DefaultSpec(),
+	}
+	if err := WriteSociIndex(ctx, indexWithMetadata, store); err != nil {
+		return nil, err
+	}
+	return &indexWithMetadata, nil
+}
+
 // WriteSociIndex writes the SociIndex manifest
 func WriteSociIndex(ctx context.Context, indexWithMetadata IndexWithMetadata, store orascontent.Storage) error {
 	manifest, err := json.Marshal(indexWithMetadata.Index)
@@ -331,6 +517,7 @@ func WriteSociIndex(ctx context.Context, indexWithMetadata IndexWithMetadata, st
 		Type:           ArtifactEntryTypeIndex,
 		Location:       indexWithMetadata.Index.Subject.Digest.String(),
 		Size:           size,
+		Supersedes:     indexWithMetadata.Index.Annotations[IndexAnnotationSupersedes],
 	}
 	return writeArtifactEntry(entry)
 }
@@ -20,6 +20,7 @@ import (
 	"context"
 	"testing"
 
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"oras.land/oras-go/v2/content/memory"
 )
@@ -67,6 +68,34 @@ func TestSkipBuildingZtoc(t *testing.T) {
 			},
 			skip: false,
 		},
+		{
+			name: "skip, layer not selected",
+			desc: ocispec.Descriptor{
+				MediaType: SociLayerMediaType,
+				Digest:    parseDigest("sha256:88a7002d88ed7b174259637a08a2ef9b7f4f2a314dfb51fa1a4a6a1d7e05dd01"),
+				Size:      5000,
+			},
+			buildConfig: buildConfig{
+				layers: map[digest.Digest]bool{
+					parseDigest("sha256:d9b7a4a4f55b6fbbeaa8a1e5c5a2c1d8b6a1e7e7b9d6e8a3c0f3e6d1a2b4c5d6"): true,
+				},
+			},
+			skip: true,
+		},
+		{
+			name: "do not skip, layer selected",
+			desc: ocispec.Descriptor{
+				MediaType: SociLayerMediaType,
+				Digest:    parseDigest("sha256:88a7002d88ed7b174259637a08a2ef9b7f4f2a314dfb51fa1a4a6a1d7e05dd01"),
+				Size:      5000,
+			},
+			buildConfig: buildConfig{
+				layers: map[digest.Digest]bool{
+					parseDigest("sha256:88a7002d88ed7b174259637a08a2ef9b7f4f2a314dfb51fa1a4a6a1d7e05dd01"): true,
+				},
+			},
+			skip: false,
+		},
 	}
 
 	for _, tc := range testcases {
@@ -210,3 +239,49 @@ func TestBuildSociIndexWithLimits(t *testing.T) {
 		})
 	}
 }
+
+func TestNewSociIndexSupersedes(t *testing.T) {
+	manifestDesc := &ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    parseDigest("sha256:88a7002d88ed7b174259637a08a2ef9b7f4f2a314dfb51fa1a4a6a1d7e05dd01"),
+	}
+	index := newSociIndex(nil, manifestDesc, &buildConfig{})
+	if _, ok := index.Annotations[IndexAnnotationSupersedes]; ok {
+		t.Fatalf("a new index shouldn't supersede another one")
+	}
+	supersedes := parseDigest("sha256:d9b7a4a4f55b6fbbeaa8a1e5c5a2c1d8b6a1e7e7b9d6e8a3c0f3e6d1a2b4c5d6")
+	index = newSociIndex(nil, manifestDesc, &buildConfig{supersedes: supersedes})
+	if index.Annotations[IndexAnnotationSupersedes] != supersedes.String() {
+		t.Fatalf("unexpected supersedes annotation: %v", index.Annotations)
+	}
+}
+
+func TestLatestIndexEntries(t *testing.T) {
+	entries := []ArtifactEntry{
+		{Digest: "sha256:1"},
+		{Digest: "sha256:2", Supersedes: "sha256:1"},
+		{Digest: "sha256:3", Supersedes: "sha256:2"},
+		{Digest: "sha256:4"},
+	}
+	latest := latestIndexEntries(entries)
+	if len(latest) != 2 || latest[0].Digest != "sha256:3" || latest[1].Digest != "sha256:4" {
+		t.Fatalf("unexpected latest entries: %+v", latest)
+	}
+}
+
+func TestBuildLayerZtocSkipped(t *testing.T) {
+	ctx := context.Background()
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    parseDigest("sha256:88a7002d88ed7b174259637a08a2ef9b7f4f2a314dfb51fa1a4a6a1d7e05dd01"),
+		Size:      500,
+	}
+	ztoc, err := BuildLayerZtoc(ctx, nil, desc, 65535, memory.New(), WithMinLayerSize(32000))
+	if ztoc != nil || err != nil {
+		t.Fatalf("ztoc should've been skipped: ztoc=%v, error=%v", ztoc, err)
+	}
+	desc.MediaType = SociLayerMediaType
+	if _, err := BuildLayerZtoc(ctx, nil, desc, 65535, memory.New()); err != errNotLayerType {
+		t.Fatalf("should error out as not a layer: %v", err)
+	}
+}
@@ -134,6 +134,114 @@ func buildTempTarGz(contents []fileContent, targzName string) (*string, []string
 	return name, resultingFileNames, nil
 }
 
+// buildTempMultiMemberTarGz builds a tar.gz file out of the contents, where the
+// tar stream is cut into pieces of memberSize bytes and every piece is compressed
+// as a separate gzip member, the same way pigz or concatenated gzip files lay out
+// a layer. The files are named after fileContent.fileName.
+func buildTempMultiMemberTarGz(contents []fileContent, memberSize int, targzName string) (*string, error) {
+	tarBuf := new(bytes.Buffer)
+	tw := tar.NewWriter(tarBuf)
+	for _, fc := range contents {
+		h := &tar.Header{
+			Name:     fc.fileName,
+			Typeflag: tar.TypeReg,
+			Size:     int64(len(fc.content)),
+			Mode:     0644,
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(fc.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	fw, err := os.CreateTemp("", targzName)
+	if err != nil {
+		return nil, err
+	}
+	defer fw.Close()
+
+	tarData := tarBuf.Bytes()
+	for len(tarData) > 0 {
+		n := memberSize
+		if n > len(tarData) {
+			n = len(tarData)
+		}
+		gw := gzip.NewWriter(fw)
+		if _, err := gw.Write(tarData[:n]); err != nil {
+			os.Remove(fw.Name())
+			return nil, err
+		}
+		if err := gw.Close(); err != nil {
+			os.Remove(fw.Name())
+			return nil, err
+		}
+		tarData = tarData[n:]
+	}
+	outputFileName := fw.Name()
+	return &outputFileName, nil
+}
+
+// buildTempFlushedTarGz builds a tar.gz file out of the contents, flushing the
+// compressor right after every tar header and after every flushSize bytes of file
+// data, so that there are deflate block boundaries at the start of the data of
+// every file as well as within the files.
+func buildTempFlushedTarGz(contents []fileContent, flushSize int, targzName string) (*string, error) {
+	fw, err := os.CreateTemp("", targzName)
+	if err != nil {
+		return nil, err
+	}
+	defer fw.Close()
+
+	gw := gzip.NewWriter(fw)
+	tw := tar.NewWriter(gw)
+	for _, fc := range contents {
+		h := &tar.Header{
+			Name:     fc.fileName,
+			Typeflag: tar.TypeReg,
+			Size:     int64(len(fc.content)),
+			Mode:     0644,
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			os.Remove(fw.Name())
+			return nil, err
+		}
+		if err := gw.Flush(); err != nil {
+			os.Remove(fw.Name())
+			return nil, err
+		}
+		for data := fc.content; len(data) > 0; {
+			n := flushSize
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := tw.Write(data[:n]); err != nil {
+				os.Remove(fw.Name())
+				return nil, err
+			}
+			if err := gw.Flush(); err != nil {
+				os.Remove(fw.Name())
+				return nil, err
+			}
+			data = data[n:]
+		}
+	}
+	if err := tw.Close(); err != nil {
+		os.Remove(fw.Name())
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		os.Remove(fw.Name())
+		return nil, err
+	}
+	outputFileName := fw.Name()
+	return &outputFileName, nil
+}
+
 func writeTempTarGz(filePath string, tw *tar.Writer, fi os.FileInfo) error {
 	fr, err := os.Open(filePath)
 	if err != nil {
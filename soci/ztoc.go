@@ -25,6 +25,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"strings"
 	"time"
 	"unsafe"
 
@@ -38,6 +39,30 @@ type FileSize int64
 // SpanId will hold any span related values (SpanId, MaxSpanId, SpanStart, SpanEnd, etc)
 type SpanId int32
 
+// SpanStrategy is the strategy used to place span boundaries when building a ztoc
+type SpanStrategy string
+
+const (
+	// SpanStrategyFixed starts a new span every span size bytes of uncompressed data.
+	SpanStrategyFixed SpanStrategy = "fixed"
+	// SpanStrategyFileAligned starts a new span roughly every span size bytes of uncompressed data,
+	// preferably between files, so that most small files are contained in a single span.
+	SpanStrategyFileAligned SpanStrategy = "file-aligned"
+	// SpanStrategyFullFlush starts a new span at every full flush point of a layer
+	// recompressed by Converter. Such spans don't need a window. It can't be used
+	// for arbitrary layers, so it isn't accepted by ParseSpanStrategy.
+	SpanStrategyFullFlush SpanStrategy = "full-flush"
+)
+
+// ParseSpanStrategy parses a SpanStrategy from its name.
+func ParseSpanStrategy(s string) (SpanStrategy, error) {
+	switch strategy := SpanStrategy(s); strategy {
+	case SpanStrategyFixed, SpanStrategyFileAligned:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown span strategy %q, must be one of %q, %q", s, SpanStrategyFixed, SpanStrategyFileAligned)
+}
+
 type FileMetadata struct {
 	Name               string
 	Type               string
@@ -57,9 +82,38 @@ type FileMetadata struct {
 	Devmajor int64     // Major device number (valid for TypeChar or TypeBlock)
 	Devminor int64     // Minor device number (valid for TypeChar or TypeBlock)
 
-	Xattrs map[string]string
+	Xattrs map[string]string // PAX records of the tar header, see PAXXattrs
 }
 
+// paxSchilyXattr is the prefix of the PAX records of extended attributes.
+const paxSchilyXattr = "SCHILY.xattr."
+
+// OpaqueXattrs are the extended attributes marking overlay directories as opaque.
+var OpaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+
+// PAXXattrs returns the extended attributes in the PAX records of a tar header, e.g.
+// FileMetadata.Xattrs, by their names without the SCHILY.xattr. prefix of their records.
+func PAXXattrs(paxRecords map[string]string) map[string]string {
+	var xattrs map[string]string
+	for k, v := range paxRecords {
+		if name := strings.TrimPrefix(k, paxSchilyXattr); name != k {
+			if xattrs == nil {
+				xattrs = make(map[string]string)
+			}
+			xattrs[name] = v
+		}
+	}
+	return xattrs
+}
+
+const (
+	// ztocVersion is the version of ztocs whose index has a window for every access point.
+	ztocVersion = "0.1"
+	// ztocVersionWindowless is the version of ztocs whose index has access points without
+	// windows, e.g. at full flush points, which readers of ztocVersion can't decode.
+	ztocVersionWindowless = "0.2"
+)
+
 type Ztoc struct {
 	Version             string
 	BuildToolIdentifier string
@@ -68,7 +122,8 @@ type Ztoc struct {
 
 	CompressedFileSize   FileSize
 	UncompressedFileSize FileSize
-	MaxSpanId            SpanId //The total number of spans in Ztoc - 1
+	MaxSpanId            SpanId       //The total number of spans in Ztoc - 1
+	SpanStrategy         SpanStrategy // Empty for fixed spans, which aren't recorded so that their ztocs stay the same
 	ZtocInfo             ztocInfo
 	IndexByteData        []byte
 }
@@ -96,6 +151,19 @@ type MetadataEntry struct {
 	FirstSpanHasBits   bool
 }
 
+// SpanSize returns the span size the ztoc was built with.
+func SpanSize(ztoc *Ztoc) (FileSize, error) {
+	if len(ztoc.IndexByteData) == 0 {
+		return 0, fmt.Errorf("ztoc has no index")
+	}
+	index := C.blob_to_index(unsafe.Pointer(&ztoc.IndexByteData[0]))
+	if index == nil {
+		return 0, fmt.Errorf("cannot convert blob to gzip_index")
+	}
+	defer C.free_index(index)
+	return FileSize(C.get_span_size(index)), nil
+}
+
 func ExtractFile(r *io.SectionReader, config *FileExtractConfig) ([]byte, error) {
 	bytes := make([]byte, config.UncompressedSize)
 	if config.UncompressedSize == 0 {
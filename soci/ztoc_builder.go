@@ -38,21 +38,43 @@ import (
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// fileAlignedSpanToleranceDivisor determines how much shorter or longer than the span size
+// a span built with SpanStrategyFileAligned can be: span size / fileAlignedSpanToleranceDivisor.
+const fileAlignedSpanToleranceDivisor = 4
+
 func BuildZtoc(gzipFile string, span int64, cfg *buildConfig) (*Ztoc, error) {
 	if gzipFile == "" {
 		return nil, fmt.Errorf("need to provide gzip file")
 	}
 
-	index, indexData, err := getGzipIndexByteData(gzipFile, span)
+	spanStrategy := cfg.spanStrategy
+	if spanStrategy == "" {
+		spanStrategy = SpanStrategyFixed
+	}
+	version := ztocVersion
+	if spanStrategy == SpanStrategyFullFlush {
+		version = ztocVersionWindowless
+	}
+	// the fixed span strategy isn't recorded, so that the ztocs built with it don't change
+	recordedSpanStrategy := spanStrategy
+	if spanStrategy == SpanStrategyFixed {
+		recordedSpanStrategy = ""
+	}
+
+	fm, uncompressedFileSize, err := getGzipFileMetadata(gzipFile)
 	if err != nil {
 		return nil, err
 	}
-	defer C.free(unsafe.Pointer(index))
 
-	fm, uncompressedFileSize, err := getGzipFileMetadata(gzipFile, index)
+	index, indexData, err := getGzipIndexByteData(gzipFile, span, spanStrategy, fm, cfg.flushPoints)
 	if err != nil {
 		return nil, err
 	}
+	defer C.free(unsafe.Pointer(index))
+
+	if err := setSpanIndices(fm, index); err != nil {
+		return nil, err
+	}
 
 	fs, err := getFileSize(gzipFile)
 	if err != nil {
@@ -69,21 +91,38 @@ func BuildZtoc(gzipFile string, span int64, cfg *buildConfig) (*Ztoc, error) {
 	}
 
 	return &Ztoc{
-		Version:              "0.1",
+		Version:              version,
 		IndexByteData:        indexData,
 		Metadata:             fm,
 		CompressedFileSize:   fs,
 		UncompressedFileSize: uncompressedFileSize,
 		MaxSpanId:            SpanId(index.have) - 1,
+		SpanStrategy:         recordedSpanStrategy,
 		BuildToolIdentifier:  cfg.buildToolIdentifier,
 		ZtocInfo:             ztocInfo,
 	}, nil
 }
 
+// BuildZtocWithOptions builds the ztoc of a gzip file, configured by opts.
+func BuildZtocWithOptions(gzipFile string, span int64, opts ...BuildOption) (*Ztoc, error) {
+	var config buildConfig
+	for _, o := range opts {
+		if err := o(&config); err != nil {
+			return nil, err
+		}
+	}
+	return BuildZtoc(gzipFile, span, &config)
+}
+
 func NewZtocReader(ztoc *Ztoc) (io.Reader, ocispec.Descriptor, error) {
 	serializedBuf := new(bytes.Buffer)
 	enc := gob.NewEncoder(serializedBuf)
-	err := enc.Encode(*ztoc)
+	var err error
+	if ztoc.SpanStrategy == "" {
+		err = enc.Encode(withoutSpanStrategy(ztoc))
+	} else {
+		err = enc.Encode(*ztoc)
+	}
 	if err != nil {
 		return nil, ocispec.Descriptor{}, fmt.Errorf("cannot serialize ztoc: %v", err)
 	}
@@ -111,6 +150,35 @@ func NewZtocReader(ztoc *Ztoc) (io.Reader, ocispec.Descriptor, error) {
 	}, nil
 }
 
+// withoutSpanStrategy returns ztoc as it was before span strategies were recorded. gob encodes
+// the fields of types even if they are empty, so encoding it keeps the digests of ztocs with
+// fixed spans the same as before.
+func withoutSpanStrategy(ztoc *Ztoc) interface{} {
+	// gob encodes the name of the type too
+	type Ztoc struct {
+		Version             string
+		BuildToolIdentifier string
+
+		Metadata []FileMetadata
+
+		CompressedFileSize   FileSize
+		UncompressedFileSize FileSize
+		MaxSpanId            SpanId
+		ZtocInfo             ztocInfo
+		IndexByteData        []byte
+	}
+	return Ztoc{
+		Version:              ztoc.Version,
+		BuildToolIdentifier:  ztoc.BuildToolIdentifier,
+		Metadata:             ztoc.Metadata,
+		CompressedFileSize:   ztoc.CompressedFileSize,
+		UncompressedFileSize: ztoc.UncompressedFileSize,
+		MaxSpanId:            ztoc.MaxSpanId,
+		ZtocInfo:             ztoc.ZtocInfo,
+		IndexByteData:        ztoc.IndexByteData,
+	}
+}
+
 func getPerSpanDigests(gzipFile string, fileSize int64, index *C.struct_gzip_index) ([]digest.Digest, error) {
 	file, err := os.Open(gzipFile)
 	if err != nil {
@@ -147,13 +215,42 @@ func getPerSpanDigests(gzipFile string, fileSize int64, index *C.struct_gzip_ind
 	return digests, nil
 }
 
-func getGzipIndexByteData(gzipFile string, span int64) (*C.struct_gzip_index, []byte, error) {
+func getGzipIndexByteData(gzipFile string, span int64, spanStrategy SpanStrategy, fm []FileMetadata, flushPoints []FileSize) (*C.struct_gzip_index, []byte, error) {
 	cstr := C.CString(gzipFile)
 	defer C.free(unsafe.Pointer(cstr))
 
 	var index *C.struct_gzip_index
-
-	ret := C.generate_index(cstr, C.off_t(span), &index)
+	var ret C.int
+
+	switch spanStrategy {
+	case SpanStrategyFixed:
+		ret = C.generate_index(cstr, C.off_t(span), &index)
+	case SpanStrategyFileAligned:
+		starts := make([]C.off_t, len(fm))
+		ends := make([]C.off_t, len(fm))
+		for i, m := range fm {
+			starts[i] = C.off_t(m.UncompressedOffset)
+			ends[i] = C.off_t(m.UncompressedOffset + m.UncompressedSize)
+		}
+		var startsPtr, endsPtr *C.off_t
+		if len(fm) > 0 {
+			startsPtr, endsPtr = &starts[0], &ends[0]
+		}
+		tolerance := span / fileAlignedSpanToleranceDivisor
+		ret = C.generate_index_aligned(cstr, C.off_t(span), C.off_t(tolerance), startsPtr, endsPtr, C.int(len(fm)), &index)
+	case SpanStrategyFullFlush:
+		flushes := make([]C.off_t, len(flushPoints))
+		for i, p := range flushPoints {
+			flushes[i] = C.off_t(p)
+		}
+		var flushesPtr *C.off_t
+		if len(flushes) > 0 {
+			flushesPtr = &flushes[0]
+		}
+		ret = C.generate_index_flushed(cstr, C.off_t(span), flushesPtr, C.int(len(flushes)), &index)
+	default:
+		return nil, nil, fmt.Errorf("unknown span strategy %q", spanStrategy)
+	}
 
 	if int(ret) < 0 {
 		return nil, nil, fmt.Errorf("could not get index: %v", ret)
@@ -174,7 +271,9 @@ func getGzipIndexByteData(gzipFile string, span int64) (*C.struct_gzip_index, []
 	return index, bytes, nil
 }
 
-func getGzipFileMetadata(gzipFile string, index *C.struct_gzip_index) ([]FileMetadata, FileSize, error) {
+// getGzipFileMetadata reads the metadata of the files in the tar archive. Span
+// related fields are filled in by setSpanIndices once the index is built.
+func getGzipFileMetadata(gzipFile string) ([]FileMetadata, FileSize, error) {
 	file, err := os.Open(gzipFile)
 	if err != nil {
 		return nil, 0, fmt.Errorf("could not open file for reading: %v", err)
@@ -207,26 +306,6 @@ func getGzipFileMetadata(gzipFile string, index *C.struct_gzip_index) ([]FileMet
 			}
 		}
 
-		start := pt.CurrentPos()
-		end := pt.CurrentPos() + FileSize(hdr.Size)
-
-		var indexStart SpanId
-		var indexEnd SpanId
-
-		ret := C.span_indices_for_file(index, C.off_t(start), C.off_t(end), unsafe.Pointer(&indexStart), unsafe.Pointer(&indexEnd))
-
-		if int(ret) <= 0 {
-			return nil, 0, fmt.Errorf("cannot get the span indices for file with start and end offset: %d, %d; return code: %v", start, end, ret)
-		}
-
-		var hasBits bool
-		ret = C.has_bits(index, C.int(indexStart))
-		if ret == 0 {
-			hasBits = false
-		} else {
-			hasBits = true
-		}
-
 		fileType, err := getType(hdr)
 		if err != nil {
 			return nil, 0, err
@@ -237,9 +316,6 @@ func getGzipFileMetadata(gzipFile string, index *C.struct_gzip_index) ([]FileMet
 			Type:               fileType,
 			UncompressedOffset: pt.CurrentPos(),
 			UncompressedSize:   FileSize(hdr.Size),
-			SpanStart:          indexStart,
-			SpanEnd:            indexEnd,
-			FirstSpanHasBits:   hasBits,
 			Linkname:           hdr.Linkname,
 			Mode:               hdr.Mode,
 			UID:                hdr.Uid,
@@ -256,6 +332,28 @@ func getGzipFileMetadata(gzipFile string, index *C.struct_gzip_index) ([]FileMet
 	return md, uncompressedFileSize, nil
 }
 
+// setSpanIndices sets the spans containing each file in fm.
+func setSpanIndices(fm []FileMetadata, index *C.struct_gzip_index) error {
+	for i := range fm {
+		start := fm[i].UncompressedOffset
+		end := start + fm[i].UncompressedSize
+
+		var indexStart SpanId
+		var indexEnd SpanId
+
+		ret := C.span_indices_for_file(index, C.off_t(start), C.off_t(end), unsafe.Pointer(&indexStart), unsafe.Pointer(&indexEnd))
+
+		if int(ret) <= 0 {
+			return fmt.Errorf("cannot get the span indices for file with start and end offset: %d, %d; return code: %v", start, end, ret)
+		}
+
+		fm[i].SpanStart = indexStart
+		fm[i].SpanEnd = indexEnd
+		fm[i].FirstSpanHasBits = C.has_bits(index, C.int(indexStart)) != 0
+	}
+	return nil
+}
+
 func getFileSize(file string) (FileSize, error) {
 	f, err := os.Open(file)
 	if err != nil {
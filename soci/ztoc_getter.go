@@ -35,7 +35,7 @@ func GetZtocFromFile(filename string) (*Ztoc, error) {
 	return GetZtoc(reader)
 }
 
-// GetZtoc reads and returns the Ztoc
+// GetZtoc reads and returns the Ztoc. Ztocs of unknown versions are rejected.
 func GetZtoc(reader io.Reader) (*Ztoc, error) {
 	zs, err := zstd.NewReader(reader)
 	if err != nil {
@@ -49,6 +49,11 @@ func GetZtoc(reader io.Reader) (*Ztoc, error) {
 	if err := decoder.Decode(ztoc); err != nil {
 		return nil, fmt.Errorf("cannot decode ztoc: %w", err)
 	}
+	switch ztoc.Version {
+	case ztocVersion, ztocVersionWindowless:
+	default:
+		return nil, fmt.Errorf("unsupported ztoc version %q", ztoc.Version)
+	}
 	return ztoc, nil
 }
 
@@ -18,6 +18,8 @@ package soci
 
 import (
 	"bytes"
+	"compress/gzip"
+	"fmt"
 	"io"
 	"math/rand"
 	"os"
@@ -27,6 +29,8 @@ import (
 	"strconv"
 	"testing"
 
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/klauspost/compress/zstd"
 	"github.com/opencontainers/go-digest"
 )
 
@@ -406,6 +410,276 @@ func TestZtocGeneration(t *testing.T) {
 
 }
 
+func TestZtocGenerationMultiMemberGzip(t *testing.T) {
+	testcases := []struct {
+		name         string
+		fileContents []fileContent
+		memberSize   int
+		spanSize     int64
+	}{
+		{
+			name: "members smaller than spans, span_size=64KiB",
+			fileContents: []fileContent{
+				{fileName: "file1", content: genRandomByteData(300000)},
+				{fileName: "file2", content: genRandomByteData(10)},
+				{fileName: "file3", content: genRandomByteData(150000)},
+			},
+			memberSize: 20000,
+			spanSize:   65535,
+		},
+		{
+			name: "members larger than spans, span_size=10kB",
+			fileContents: []fileContent{
+				{fileName: "file1", content: genRandomByteData(200000)},
+				{fileName: "file2", content: genRandomByteData(3000)},
+				{fileName: "file3", content: genRandomByteData(77777)},
+				{fileName: "file4", content: genRandomByteData(1)},
+			},
+			memberSize: 100000,
+			spanSize:   10000,
+		},
+		{
+			name: "member boundaries inside small files, span_size=64",
+			fileContents: []fileContent{
+				{fileName: "file1", content: genRandomByteData(700)},
+				{fileName: "file2", content: genRandomByteData(1500)},
+				{fileName: "file3", content: genRandomByteData(15)},
+				{fileName: "file4", content: genRandomByteData(2500)},
+			},
+			memberSize: 1000,
+			spanSize:   64,
+		},
+		{
+			name: "single member, span_size=64KiB",
+			fileContents: []fileContent{
+				{fileName: "file1", content: genRandomByteData(100000)},
+				{fileName: "file2", content: genRandomByteData(100000)},
+			},
+			memberSize: 1 << 20,
+			spanSize:   65535,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			tarGzip, err := buildTempMultiMemberTarGz(tc.fileContents, tc.memberSize, "multimember.tar.gz")
+			if err != nil {
+				t.Fatalf("cannot build targzip: %v", err)
+			}
+			defer os.Remove(*tarGzip)
+
+			ztoc, err := BuildZtoc(*tarGzip, tc.spanSize, &buildConfig{})
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			if len(ztoc.Metadata) != len(tc.fileContents) {
+				t.Fatalf("ztoc metadata count mismatch. expected: %d, actual: %d", len(tc.fileContents), len(ztoc.Metadata))
+			}
+
+			file, err := os.Open(*tarGzip)
+			if err != nil {
+				t.Fatalf("could not open the .tar.gz file: %v", err)
+			}
+			defer file.Close()
+			sr := io.NewSectionReader(file, 0, int64(ztoc.CompressedFileSize))
+
+			for i, m := range ztoc.Metadata {
+				expected := tc.fileContents[i].content
+				if m.Name != tc.fileContents[i].fileName {
+					t.Fatalf("%d file name mismatch. expected: %s, actual: %s", i, tc.fileContents[i].fileName, m.Name)
+				}
+
+				extracted, err := ExtractFile(sr, &FileExtractConfig{
+					UncompressedSize:   m.UncompressedSize,
+					UncompressedOffset: m.UncompressedOffset,
+					SpanStart:          m.SpanStart,
+					SpanEnd:            m.SpanEnd,
+					FirstSpanHasBits:   strconv.FormatBool(m.FirstSpanHasBits),
+					IndexByteData:      ztoc.IndexByteData,
+					CompressedFileSize: ztoc.CompressedFileSize,
+					MaxSpanId:          ztoc.MaxSpanId,
+				})
+				if err != nil {
+					t.Fatalf("could not extract %s using spans %d-%d: %v", m.Name, m.SpanStart, m.SpanEnd, err)
+				}
+				if !bytes.Equal(extracted, expected) {
+					t.Fatalf("the content of %s extracted using spans %d-%d does not match", m.Name, m.SpanStart, m.SpanEnd)
+				}
+
+				extractedFromFile, err := ExtractFromTarGz(*tarGzip, ztoc, m.Name)
+				if err != nil {
+					t.Fatalf("could not extract %s from %s: %v", m.Name, *tarGzip, err)
+				}
+				if extractedFromFile != string(expected) {
+					t.Fatalf("the content of %s extracted from %s does not match", m.Name, *tarGzip)
+				}
+			}
+
+			for i, dgst := range ztoc.ZtocInfo.SpanDigests {
+				if dgst == "" {
+					t.Fatalf("span %d has no digest", i)
+				}
+			}
+		})
+	}
+}
+
+func TestZtocGenerationSpanStrategy(t *testing.T) {
+	const spanSize = 65536
+	var fileContents []fileContent
+	for i := 0; i < 100; i++ {
+		// all files are smaller than the span size tolerance, so the file-aligned
+		// strategy can always find a span boundary in between two files
+		size := rand.Intn(spanSize/fileAlignedSpanToleranceDivisor-1024) + 1
+		fileContents = append(fileContents, fileContent{fileName: fmt.Sprintf("file%d", i), content: genRandomByteData(size)})
+	}
+	tarGzip, err := buildTempFlushedTarGz(fileContents, 4096, "spanstrategy.tar.gz")
+	if err != nil {
+		t.Fatalf("cannot build targzip: %v", err)
+	}
+	defer os.Remove(*tarGzip)
+
+	file, err := os.Open(*tarGzip)
+	if err != nil {
+		t.Fatalf("could not open the .tar.gz file: %v", err)
+	}
+	defer file.Close()
+
+	testCases := []struct {
+		name             string
+		spanStrategy     SpanStrategy
+		expSpanStrategy  SpanStrategy
+		expNoSplitFiles  bool
+		expSomeSplitFile bool
+	}{
+		{
+			name:             "default span strategy is fixed",
+			expSomeSplitFile: true,
+		},
+		{
+			name:             "fixed span strategy",
+			spanStrategy:     SpanStrategyFixed,
+			expSomeSplitFile: true,
+		},
+		{
+			name:            "file-aligned span strategy",
+			spanStrategy:    SpanStrategyFileAligned,
+			expSpanStrategy: SpanStrategyFileAligned,
+			expNoSplitFiles: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ztoc, err := BuildZtoc(*tarGzip, spanSize, &buildConfig{spanStrategy: tc.spanStrategy})
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			if ztoc.SpanStrategy != tc.expSpanStrategy {
+				t.Fatalf("unexpected span strategy; expected %q, got %q", tc.expSpanStrategy, ztoc.SpanStrategy)
+			}
+			// the fixed span strategy isn't recorded, so that the digests of such ztocs don't change
+			r, _, err := NewZtocReader(ztoc)
+			if err != nil {
+				t.Fatalf("cannot serialize ztoc: %v", err)
+			}
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				t.Fatalf("cannot decompress ztoc: %v", err)
+			}
+			serialized, err := io.ReadAll(zr)
+			zr.Close()
+			if err != nil {
+				t.Fatalf("cannot decompress ztoc: %v", err)
+			}
+			if recorded := bytes.Contains(serialized, []byte("SpanStrategy")); recorded != (tc.expSpanStrategy != "") {
+				t.Fatalf("unexpected serialized ztoc; span strategy recorded: %v", recorded)
+			}
+			if ztoc.MaxSpanId == 0 {
+				t.Fatalf("expected more than one span")
+			}
+
+			sr := io.NewSectionReader(file, 0, int64(ztoc.CompressedFileSize))
+			splitFiles := 0
+			for i, m := range ztoc.Metadata {
+				if m.SpanStart != m.SpanEnd {
+					splitFiles++
+				}
+				extracted, err := ExtractFile(sr, &FileExtractConfig{
+					UncompressedSize:   m.UncompressedSize,
+					UncompressedOffset: m.UncompressedOffset,
+					SpanStart:          m.SpanStart,
+					SpanEnd:            m.SpanEnd,
+					FirstSpanHasBits:   strconv.FormatBool(m.FirstSpanHasBits),
+					IndexByteData:      ztoc.IndexByteData,
+					CompressedFileSize: ztoc.CompressedFileSize,
+					MaxSpanId:          ztoc.MaxSpanId,
+				})
+				if err != nil {
+					t.Fatalf("could not extract %s: %v", m.Name, err)
+				}
+				if !bytes.Equal(extracted, fileContents[i].content) {
+					t.Fatalf("the content of %s does not match", m.Name)
+				}
+			}
+			if tc.expNoSplitFiles && splitFiles != 0 {
+				t.Fatalf("expected every file to be contained in a single span, but %d files are not", splitFiles)
+			}
+			if tc.expSomeSplitFile && splitFiles == 0 {
+				t.Fatalf("expected some files to be contained in more than one span")
+			}
+		})
+	}
+}
+
+func TestParseSpanStrategy(t *testing.T) {
+	testCases := []struct {
+		name        string
+		input       string
+		expStrategy SpanStrategy
+		expErr      bool
+	}{
+		{
+			name:        "fixed",
+			input:       "fixed",
+			expStrategy: SpanStrategyFixed,
+		},
+		{
+			name:        "file-aligned",
+			input:       "file-aligned",
+			expStrategy: SpanStrategyFileAligned,
+		},
+		{
+			name:   "unknown",
+			input:  "foo",
+			expErr: true,
+		},
+		{
+			name:   "empty",
+			input:  "",
+			expErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			strategy, err := ParseSpanStrategy(tc.input)
+			if tc.expErr {
+				if err == nil {
+					t.Fatalf("expected an error parsing %q", tc.input)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strategy != tc.expStrategy {
+				t.Fatalf("unexpected span strategy; expected %q, got %q", tc.expStrategy, strategy)
+			}
+		})
+	}
+}
+
 func TestWriteZtoc(t *testing.T) {
 	testCases := []struct {
 		name                 string
@@ -461,6 +735,50 @@ func TestWriteZtoc(t *testing.T) {
 	}
 }
 
+func TestGetZtocVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version string
+		valid   bool
+	}{
+		{version: ztocVersion, valid: true},
+		{version: ztocVersionWindowless, valid: true},
+		{version: "0.3"},
+		{version: ""},
+	} {
+		t.Run(fmt.Sprintf("version %q", tc.version), func(t *testing.T) {
+			r, _, err := NewZtocReader(&Ztoc{Version: tc.version, BuildToolIdentifier: "AWS SOCI CLI"})
+			if err != nil {
+				t.Fatalf("cannot serialize ztoc: %v", err)
+			}
+			ztoc, err := GetZtoc(r)
+			if tc.valid && (err != nil || ztoc.Version != tc.version) {
+				t.Fatalf("cannot read ztoc: %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatalf("ztoc of unknown version %q was read", tc.version)
+			}
+		})
+	}
+}
+
+func TestSpanSize(t *testing.T) {
+	for _, spanSize := range []int64{65536, 1 << 20} {
+		ztoc, _, err := BuildZtocReader([]testutil.TarEntry{
+			testutil.File("file", string(genRandomByteData(100000))),
+		}, gzip.BestCompression, spanSize)
+		if err != nil {
+			t.Fatalf("failed to build ztoc: %v", err)
+		}
+		got, err := SpanSize(ztoc)
+		if err != nil {
+			t.Fatalf("failed to get span size: %v", err)
+		}
+		if got != FileSize(spanSize) {
+			t.Fatalf("expected span size %d but got %d", spanSize, got)
+		}
+	}
+}
+
 func genRandomByteData(size int) []byte {
 	b := make([]byte, size)
 	rand.Read(b)